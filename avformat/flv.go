@@ -380,7 +380,7 @@ func WriteFLVHeader(w io.Writer, header FLVHeader) (err error) {
 		return
 	}
 
-	flags := uint8(header.TypeFlagsReserved1)<<3 + uint8(header.TypeFlagsAudio)<<2 + uint8(header.TypeFlagsReserved2)<<1 + uint8(header.TypeFlagsReserved1)
+	flags := uint8(header.TypeFlagsReserved1)<<3 + uint8(header.TypeFlagsAudio)<<2 + uint8(header.TypeFlagsReserved2)<<1 + uint8(header.TypeFlagsVideo)
 	if err = util.WriteUint8ToByte(w, flags); err != nil {
 		return
 	}
@@ -0,0 +1,641 @@
+package avformat
+
+import (
+	"bytes"
+	"errors"
+	"github.com/onedss/gortmp/util"
+)
+
+// 分片MP4(fMP4/CMAF)的封装. ISO_IEC_14496-12_2012.pdf 8.8
+//
+// 初始化段(Initialization Segment) = ftyp + moov, moov中没有样本,只有轨道的描述(avcC, esds)和mvex/trex.
+// 媒体段(Media Segment) = 一个或多个 moof + mdat, 每个moof中每个有样本的轨道一个traf(tfhd + tfdt + trun).
+// 视频轨道的时间刻度是90000,音频轨道的时间刻度是采样率,RTMP的时间戳(毫秒)换算到轨道的时间刻度.
+
+const (
+	FMP4_VIDEO_TRACK_ID  = 1     // 视频轨道的track_ID
+	FMP4_AUDIO_TRACK_ID  = 2     // 音频轨道的track_ID
+	FMP4_VIDEO_TIMESCALE = 90000 // 视频轨道的时间刻度
+)
+
+// tfhd的flags (8.8.7.1)
+const (
+	TFHD_DEFAULT_BASE_IS_MOOF = 0x020000 // 数据偏移相对于moof的开始
+)
+
+// trun的flags (8.8.8.1)
+const (
+	TRUN_DATA_OFFSET_PRESENT                    = 0x000001
+	TRUN_SAMPLE_DURATION_PRESENT                = 0x000100
+	TRUN_SAMPLE_SIZE_PRESENT                    = 0x000200
+	TRUN_SAMPLE_FLAGS_PRESENT                   = 0x000400
+	TRUN_SAMPLE_COMPOSITION_TIME_OFFSET_PRESENT = 0x000800
+)
+
+// sample_flags (8.8.3.1)
+const (
+	FMP4_SAMPLE_FLAGS_SYNC     = 0x02000000 // sample_depends_on = 2, 不依赖其他样本(关键帧,音频帧)
+	FMP4_SAMPLE_FLAGS_NON_SYNC = 0x01010000 // sample_depends_on = 1, sample_is_non_sync_sample = 1
+)
+
+// AAC的采样率, AudioSpecificConfig.SamplingFrequencyIndex -> 采样率
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// 写box的缓冲区,box的大小在box的内容写完之后填写
+type mp4Writer struct {
+	bytes.Buffer
+}
+
+func (w *mp4Writer) u8(v uint8)   { w.WriteByte(v) }
+func (w *mp4Writer) u16(v uint16) { w.Write(util.BigEndian.ToUint16(v)) }
+func (w *mp4Writer) u24(v uint32) { w.Write(util.BigEndian.ToUint24(v)) }
+func (w *mp4Writer) u32(v uint32) { w.Write(util.BigEndian.ToUint32(v)) }
+func (w *mp4Writer) u64(v uint64) { w.Write(util.BigEndian.ToUint64(v)) }
+
+// 写一个box, f写box的内容
+func (w *mp4Writer) box(boxType string, f func()) {
+	start := w.Len()
+
+	w.u32(0)
+	w.WriteString(boxType)
+	f()
+
+	util.BigEndian.PutUint32(w.Bytes()[start:], uint32(w.Len()-start))
+}
+
+// 写一个full box, version和flags之后是box的内容
+func (w *mp4Writer) fullBox(boxType string, version uint8, flags uint32, f func()) {
+	w.box(boxType, func() {
+		w.u8(version)
+		w.u24(flags)
+		f()
+	})
+}
+
+func newFullBoxHeader(version uint8, flags uint32) MP4FullBoxHeader {
+	return MP4FullBoxHeader{Version: version, Flags: [3]byte{byte(flags >> 16), byte(flags >> 8), byte(flags)}}
+}
+
+func (h MP4FullBoxHeader) flags() uint32 {
+	return uint32(h.Flags[0])<<16 | uint32(h.Flags[1])<<8 | uint32(h.Flags[2])
+}
+
+// ftyp
+func (box *FileTypeBox) write(w *mp4Writer) {
+	w.box("ftyp", func() {
+		w.u32(box.MajorBrand)
+		w.u32(box.MinorVersion)
+		for _, brand := range box.CompatibleBrands {
+			w.u32(brand)
+		}
+	})
+}
+
+// trex
+func (box *TrackExtendsBox) write(w *mp4Writer) {
+	w.fullBox("trex", box.Version, box.MP4FullBoxHeader.flags(), func() {
+		w.u32(box.TrackID)
+		w.u32(box.DefaultSampleDescriptionIndex)
+		w.u32(box.DefaultSampleDuration)
+		w.u32(box.DefaultSampleSize)
+		w.u32(box.DefaultSampleFlags)
+	})
+}
+
+// mfhd
+func (box *MovieFragmentHeaderBox) write(w *mp4Writer) {
+	w.fullBox("mfhd", box.Version, box.MP4FullBoxHeader.flags(), func() {
+		w.u32(box.SequenceNumber)
+	})
+}
+
+// tfhd, 只写flags中有的可选字段
+func (box *TrackFragmentHeaderBox) write(w *mp4Writer) {
+	flags := box.MP4FullBoxHeader.flags()
+
+	w.fullBox("tfhd", box.Version, flags, func() {
+		w.u32(box.TrackID)
+
+		if flags&0x000001 != 0 {
+			w.u64(box.BaseDataOffset)
+		}
+
+		if flags&0x000002 != 0 {
+			w.u32(box.SampleDescriptionIndex)
+		}
+
+		if flags&0x000008 != 0 {
+			w.u32(box.DefaultSampleDuration)
+		}
+
+		if flags&0x000010 != 0 {
+			w.u32(box.DefaultSampleSize)
+		}
+
+		if flags&0x000020 != 0 {
+			w.u32(box.DefaultSampleFlags)
+		}
+	})
+}
+
+// tfdt, BaseMediaDecodeTime是uint64的时候写version 1
+func (box *TrackFragmentBaseMediaDecodeTimeBox) write(w *mp4Writer) {
+	switch t := box.BaseMediaDecodeTime.(type) {
+	case uint64:
+		w.fullBox("tfdt", 1, box.MP4FullBoxHeader.flags(), func() {
+			w.u64(t)
+		})
+	case uint32:
+		w.fullBox("tfdt", 0, box.MP4FullBoxHeader.flags(), func() {
+			w.u32(t)
+		})
+	}
+}
+
+// trun, 只写flags中有的可选字段.返回data_offset在w中的位置,mdat的位置确定之后再填写,没有data_offset的时候返回-1
+func (box *TrackFragmentRunBox) write(w *mp4Writer) (dataOffset int) {
+	flags := box.MP4FullBoxHeader.flags()
+	dataOffset = -1
+
+	w.fullBox("trun", box.Version, flags, func() {
+		w.u32(box.SampleCount)
+
+		if flags&TRUN_DATA_OFFSET_PRESENT != 0 {
+			dataOffset = w.Len()
+			w.u32(uint32(box.DataOffset))
+		}
+
+		if flags&0x000004 != 0 {
+			w.u32(box.FirstSampleFlags)
+		}
+
+		for _, t := range box.Table {
+			if flags&TRUN_SAMPLE_DURATION_PRESENT != 0 {
+				w.u32(t.SampleDuration)
+			}
+
+			if flags&TRUN_SAMPLE_SIZE_PRESENT != 0 {
+				w.u32(t.SampleSize)
+			}
+
+			if flags&TRUN_SAMPLE_FLAGS_PRESENT != 0 {
+				w.u32(t.SampleFlags)
+			}
+
+			if flags&TRUN_SAMPLE_COMPOSITION_TIME_OFFSET_PRESENT != 0 {
+				switch offset := t.SampleCompositionTimeOffset.(type) {
+				case int32:
+					w.u32(uint32(offset))
+				case uint32:
+					w.u32(offset)
+				default:
+					w.u32(0)
+				}
+			}
+		}
+	})
+
+	return
+}
+
+// mdat
+func (box *MediaDataBox) write(w *mp4Writer) {
+	w.box("mdat", func() {
+		w.Write(box.Data)
+	})
+}
+
+// 一个样本(一个视频帧或者一个AAC帧)
+type fmp4Sample struct {
+	dts  uint64 // 解码时间,轨道的时间刻度
+	cts  int32  // 显示时间 - 解码时间,轨道的时间刻度
+	sync bool   // 关键帧
+	data []byte // 视频是AVCC格式(长度 + NALU),音频是AAC的原始数据
+}
+
+// 一个轨道还没有写到moof中的样本
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	duration  uint64 // 最后一个样本的时长,没有下一个样本和结束时间的时候使用
+	samples   []fmp4Sample
+}
+
+// RTMP的时间戳(毫秒)换算到轨道的时间刻度
+func (t *fmp4Track) time(timestamp uint32) uint64 {
+	return uint64(timestamp) * uint64(t.timescale) / 1000
+}
+
+// 轨道的trun,样本的时长是下一个样本的解码时间减去这个样本的解码时间,最后一个样本的时长是end减去它的解码时间
+func (t *fmp4Track) run(end uint64) *TrackFragmentRunBox {
+	trun := &TrackFragmentRunBox{
+		MP4FullBoxHeader: newFullBoxHeader(1, TRUN_DATA_OFFSET_PRESENT|TRUN_SAMPLE_DURATION_PRESENT|TRUN_SAMPLE_SIZE_PRESENT|TRUN_SAMPLE_FLAGS_PRESENT|TRUN_SAMPLE_COMPOSITION_TIME_OFFSET_PRESENT),
+		SampleCount:      uint32(len(t.samples)),
+	}
+
+	for i, s := range t.samples {
+		duration := t.duration
+		if i+1 < len(t.samples) {
+			duration = t.samples[i+1].dts - s.dts
+		} else if end > s.dts {
+			duration = end - s.dts
+		}
+
+		flags := uint32(FMP4_SAMPLE_FLAGS_NON_SYNC)
+		if s.sync {
+			flags = FMP4_SAMPLE_FLAGS_SYNC
+		}
+
+		trun.Table = append(trun.Table, TrackFragmentRunTable{
+			SampleDuration:              uint32(duration),
+			SampleSize:                  uint32(len(s.data)),
+			SampleFlags:                 flags,
+			SampleCompositionTimeOffset: s.cts,
+		})
+
+		if duration > 0 {
+			t.duration = duration
+		}
+	}
+
+	return trun
+}
+
+// fMP4的封装,输入RTMP的H.264/AAC帧,输出初始化段和媒体段.
+// 音频的AudioSpecificConfig可以在生成初始化段之前用SetAudio设置,生成初始化段之后没有音频轨道的时候忽略音频帧
+type FMP4Muxer struct {
+	avc      AVCDecoderConfigurationRecord
+	asc      AudioSpecificConfig
+	width    int
+	height   int
+	sequence uint32 // mfhd的序号,每个moof加1
+	inited   bool   // 已经生成了初始化段,之后不能再增加轨道
+	video    *fmp4Track
+	audio    *fmp4Track
+}
+
+func NewFMP4Muxer(avc AVCDecoderConfigurationRecord) *FMP4Muxer {
+	m := &FMP4Muxer{
+		avc:   avc,
+		video: &fmp4Track{id: FMP4_VIDEO_TRACK_ID, timescale: FMP4_VIDEO_TIMESCALE, duration: FMP4_VIDEO_TIMESCALE / 25},
+	}
+
+	m.width, m.height, _ = ParseSPSResolution(avc.SequenceParameterSetNALUnit)
+
+	return m
+}
+
+// 增加AAC音频轨道,生成初始化段之后调用没有作用
+func (m *FMP4Muxer) SetAudio(asc AudioSpecificConfig) error {
+	if m.inited {
+		return nil
+	}
+
+	if int(asc.SamplingFrequencyIndex) >= len(aacSampleRates) {
+		return errors.New("fmp4: unsupported AAC sampling frequency index")
+	}
+
+	m.asc = asc
+	m.audio = &fmp4Track{id: FMP4_AUDIO_TRACK_ID, timescale: aacSampleRates[asc.SamplingFrequencyIndex], duration: 1024}
+
+	return nil
+}
+
+// 增加一个视频帧. timestamp是解码时间戳(毫秒), cts是显示时间戳减去解码时间戳(毫秒), data是AVCC格式的NALU
+func (m *FMP4Muxer) WriteVideo(timestamp uint32, cts int32, keyFrame bool, data []byte) {
+	t := m.video
+	t.samples = append(t.samples, fmp4Sample{
+		dts:  t.time(timestamp),
+		cts:  cts * int32(t.timescale/1000),
+		sync: keyFrame,
+		data: data,
+	})
+}
+
+// 增加一个AAC帧. timestamp是时间戳(毫秒), data是AAC的原始数据(没有ADTS)
+func (m *FMP4Muxer) WriteAudio(timestamp uint32, data []byte) {
+	t := m.audio
+	if t == nil {
+		return
+	}
+
+	t.samples = append(t.samples, fmp4Sample{
+		dts:  t.time(timestamp),
+		sync: true,
+		data: data,
+	})
+}
+
+// 初始化段 ftyp + moov
+func (m *FMP4Muxer) InitSegment() []byte {
+	m.inited = true
+
+	w := new(mp4Writer)
+
+	ftyp := NewFileTypeBox()
+	ftyp.MajorBrand = fourCC("iso6")
+	ftyp.CompatibleBrands = []uint32{fourCC("iso6"), fourCC("cmfc"), fourCC("mp41")}
+	ftyp.write(w)
+
+	w.box("moov", func() {
+		m.writeMvhd(w)
+
+		m.writeTrak(w, m.video, "vide")
+		if m.audio != nil {
+			m.writeTrak(w, m.audio, "soun")
+		}
+
+		w.box("mvex", func() {
+			for _, t := range []*fmp4Track{m.video, m.audio} {
+				if t == nil {
+					continue
+				}
+
+				trex := TrackExtendsBox{TrackID: t.id, DefaultSampleDescriptionIndex: 1}
+				trex.write(w)
+			}
+		})
+	})
+
+	return w.Bytes()
+}
+
+// 还有没有写到媒体段中的样本
+func (m *FMP4Muxer) Buffered() bool {
+	return len(m.video.samples) > 0 || (m.audio != nil && len(m.audio.samples) > 0)
+}
+
+// 将缓存的样本写成一个 moof + mdat, 清空缓存.
+// timestamp是这个fragment结束的时间戳(毫秒),也就是下一个视频帧的时间戳,用于计算最后一个视频帧的时长.
+// 没有样本的时候返回nil
+func (m *FMP4Muxer) Fragment(timestamp uint32) []byte {
+	var tracks []*fmp4Track
+	for _, t := range []*fmp4Track{m.video, m.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	m.sequence++
+
+	w := new(mp4Writer)
+	offsets := make([]int, len(tracks)) // 每个trun的data_offset的位置
+
+	w.box("moof", func() {
+		mfhd := MovieFragmentHeaderBox{SequenceNumber: m.sequence}
+		mfhd.write(w)
+
+		for i, t := range tracks {
+			w.box("traf", func() {
+				tfhd := TrackFragmentHeaderBox{MP4FullBoxHeader: newFullBoxHeader(0, TFHD_DEFAULT_BASE_IS_MOOF), TrackID: t.id}
+				tfhd.write(w)
+
+				tfdt := TrackFragmentBaseMediaDecodeTimeBox{BaseMediaDecodeTime: t.samples[0].dts}
+				tfdt.write(w)
+
+				// 音频帧的时长是固定的,最后一个音频帧使用前一个音频帧的时长
+				var end uint64
+				if t == m.video {
+					end = t.time(timestamp)
+				}
+
+				offsets[i] = t.run(end).write(w)
+			})
+		}
+	})
+
+	// 样本的数据在mdat中按轨道的顺序排列, data_offset是样本数据相对于moof开始的位置
+	var mdat MediaDataBox
+	offset := w.Len() + 8
+	for i, t := range tracks {
+		util.BigEndian.PutUint32(w.Bytes()[offsets[i]:], uint32(offset))
+
+		for _, s := range t.samples {
+			mdat.Data = append(mdat.Data, s.data...)
+			offset += len(s.data)
+		}
+
+		t.samples = nil
+	}
+
+	mdat.write(w)
+
+	return w.Bytes()
+}
+
+// mvhd, 时间刻度是1000,时长未知
+func (m *FMP4Muxer) writeMvhd(w *mp4Writer) {
+	w.fullBox("mvhd", 0, 0, func() {
+		w.u32(0)          // creation_time
+		w.u32(0)          // modification_time
+		w.u32(1000)       // timescale
+		w.u32(0)          // duration
+		w.u32(0x00010000) // rate 1.0
+		w.u16(0x0100)     // volume 1.0
+		w.u16(0)          // reserved
+		w.u64(0)          // reserved
+		writeMatrix(w)
+		w.Write(make([]byte, 24)) // pre_defined
+		w.u32(FMP4_AUDIO_TRACK_ID + 1)
+	})
+}
+
+// trak, 没有样本的样本表(stts, stsc, stsz, stco都是空的),样本都在moof中
+func (m *FMP4Muxer) writeTrak(w *mp4Writer, t *fmp4Track, handler string) {
+	w.box("trak", func() {
+		// flags: track_enabled | track_in_movie
+		w.fullBox("tkhd", 0, 0x000003, func() {
+			w.u32(0) // creation_time
+			w.u32(0) // modification_time
+			w.u32(t.id)
+			w.u32(0) // reserved
+			w.u32(0) // duration
+			w.u64(0) // reserved
+			w.u16(0) // layer
+			w.u16(0) // alternate_group
+			if handler == "soun" {
+				w.u16(0x0100)
+			} else {
+				w.u16(0)
+			}
+			w.u16(0) // reserved
+			writeMatrix(w)
+			if handler == "vide" {
+				w.u32(uint32(m.width) << 16)
+				w.u32(uint32(m.height) << 16)
+			} else {
+				w.u32(0)
+				w.u32(0)
+			}
+		})
+
+		w.box("mdia", func() {
+			w.fullBox("mdhd", 0, 0, func() {
+				w.u32(0) // creation_time
+				w.u32(0) // modification_time
+				w.u32(t.timescale)
+				w.u32(0)      // duration
+				w.u16(0x55c4) // language, und
+				w.u16(0)      // pre_defined
+			})
+
+			w.fullBox("hdlr", 0, 0, func() {
+				w.u32(0) // pre_defined
+				w.WriteString(handler)
+				w.Write(make([]byte, 12)) // reserved
+				if handler == "vide" {
+					w.WriteString("VideoHandler\x00")
+				} else {
+					w.WriteString("SoundHandler\x00")
+				}
+			})
+
+			w.box("minf", func() {
+				if handler == "vide" {
+					w.fullBox("vmhd", 0, 1, func() {
+						w.u16(0) // graphicsmode
+						w.Write(make([]byte, 6))
+					})
+				} else {
+					w.fullBox("smhd", 0, 0, func() {
+						w.u16(0) // balance
+						w.u16(0) // reserved
+					})
+				}
+
+				w.box("dinf", func() {
+					w.fullBox("dref", 0, 0, func() {
+						w.u32(1)
+						// flags = 1, 数据在同一个文件中
+						w.fullBox("url ", 0, 1, func() {})
+					})
+				})
+
+				w.box("stbl", func() {
+					w.fullBox("stsd", 0, 0, func() {
+						w.u32(1)
+						if handler == "vide" {
+							m.writeAvc1(w)
+						} else {
+							m.writeMp4a(w)
+						}
+					})
+
+					w.fullBox("stts", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsc", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsz", 0, 0, func() { w.u32(0); w.u32(0) })
+					w.fullBox("stco", 0, 0, func() { w.u32(0) })
+				})
+			})
+		})
+	})
+}
+
+// avc1(VisualSampleEntry) + avcC(AVCDecoderConfigurationRecord). ISO/IEC 14496-15 5.3.4
+func (m *FMP4Muxer) writeAvc1(w *mp4Writer) {
+	avc := m.avc
+
+	w.box("avc1", func() {
+		w.Write(make([]byte, 6)) // reserved
+		w.u16(1)                 // data_reference_index
+		w.Write(make([]byte, 16))
+		w.u16(uint16(m.width))
+		w.u16(uint16(m.height))
+		w.u32(0x00480000) // horizresolution 72 dpi
+		w.u32(0x00480000) // vertresolution 72 dpi
+		w.u32(0)          // reserved
+		w.u16(1)          // frame_count
+		w.Write(make([]byte, 32))
+		w.u16(0x0018) // depth
+		w.u16(0xffff) // pre_defined = -1
+
+		w.box("avcC", func() {
+			w.u8(1) // configurationVersion
+			w.u8(avc.AVCProfileIndication)
+			w.u8(avc.ProfileCompatibility)
+			w.u8(avc.AVCLevelIndication)
+			w.u8(0xfc | avc.LengthSizeMinusOne&0x03)
+			w.u8(0xe0 | 1)
+			w.u16(uint16(len(avc.SequenceParameterSetNALUnit)))
+			w.Write(avc.SequenceParameterSetNALUnit)
+			w.u8(1)
+			w.u16(uint16(len(avc.PictureParameterSetNALUnit)))
+			w.Write(avc.PictureParameterSetNALUnit)
+		})
+	})
+}
+
+// mp4a(AudioSampleEntry) + esds(ES_Descriptor). ISO/IEC 14496-14 5.6, ISO/IEC 14496-1 7.2.6.5
+func (m *FMP4Muxer) writeMp4a(w *mp4Writer) {
+	asc := m.asc
+
+	channels := uint16(asc.ChannelConfiguration)
+	if channels == 7 {
+		channels = 8
+	}
+
+	rate := m.audio.timescale
+	if rate > 0xffff {
+		rate = 0
+	}
+
+	// AudioSpecificConfig: audioObjectType(5) + samplingFrequencyIndex(4) + channelConfiguration(4) + GASpecificConfig(3)
+	config := []byte{
+		asc.AudioObjectType<<3 | asc.SamplingFrequencyIndex>>1,
+		(asc.SamplingFrequencyIndex&0x01)<<7 | asc.ChannelConfiguration<<3 | asc.FrameLengthFlag<<2 | asc.DependsOnCoreCoder<<1 | asc.ExtensionFlag,
+	}
+
+	w.box("mp4a", func() {
+		w.Write(make([]byte, 6)) // reserved
+		w.u16(1)                 // data_reference_index
+		w.u64(0)                 // reserved
+		w.u16(channels)
+		w.u16(16) // samplesize
+		w.u16(0)  // pre_defined
+		w.u16(0)  // reserved
+		w.u32(rate << 16)
+
+		w.fullBox("esds", 0, 0, func() {
+			// ES_DescrTag
+			w.u8(0x03)
+			w.u8(byte(3 + 2 + 13 + 2 + len(config) + 3))
+			w.u16(0) // ES_ID
+			w.u8(0)  // flags
+
+			// DecoderConfigDescrTag
+			w.u8(0x04)
+			w.u8(byte(13 + 2 + len(config)))
+			w.u8(0x40) // objectTypeIndication, Audio ISO/IEC 14496-3
+			w.u8(0x15) // streamType(6) = 5(AudioStream), upStream(1) = 0, reserved(1) = 1
+			w.u24(0)   // bufferSizeDB
+			w.u32(0)   // maxBitrate
+			w.u32(0)   // avgBitrate
+
+			// DecSpecificInfoTag
+			w.u8(0x05)
+			w.u8(byte(len(config)))
+			w.Write(config)
+
+			// SLConfigDescrTag
+			w.u8(0x06)
+			w.u8(1)
+			w.u8(0x02)
+		})
+	})
+}
+
+// 单位矩阵 { 0x00010000,0,0,0,0x00010000,0,0,0,0x40000000 }
+func writeMatrix(w *mp4Writer) {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+func fourCC(s string) uint32 {
+	v, _ := util.ByteToUint32([]byte(s), true)
+	return v
+}
@@ -0,0 +1,322 @@
+package avformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// 解析出来的box, data是box的内容(不包括8字节的头)
+type testMP4Box struct {
+	typ      string
+	start    int // box在数据中的位置
+	data     []byte
+	children []testMP4Box
+}
+
+// 有子box的box,以及子box之前的字节数(full box的version/flags, stsd/dref的entry_count, avc1/mp4a的sample entry)
+var testMP4Containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "dinf": 0, "stbl": 0, "mvex": 0, "moof": 0, "traf": 0,
+	"stsd": 8, "dref": 8, "avc1": 78, "mp4a": 28,
+}
+
+// 解析b中的box,每个box的大小必须正好排满b
+func readTestMP4Boxes(t *testing.T, b []byte, base int) []testMP4Box {
+	t.Helper()
+
+	var boxes []testMP4Box
+	for i := 0; i < len(b); {
+		if len(b)-i < 8 {
+			t.Fatalf("box at %d: %d bytes left for the header", base+i, len(b)-i)
+		}
+
+		size := int(binary.BigEndian.Uint32(b[i:]))
+		if size < 8 || i+size > len(b) {
+			t.Fatalf("box %s at %d: size %d, %d bytes left", b[i+4:i+8], base+i, size, len(b)-i)
+		}
+
+		box := testMP4Box{typ: string(b[i+4 : i+8]), start: base + i, data: b[i+8 : i+size]}
+		if skip, ok := testMP4Containers[box.typ]; ok {
+			box.children = readTestMP4Boxes(t, box.data[skip:], box.start+8+skip)
+		}
+
+		boxes = append(boxes, box)
+		i += size
+	}
+
+	return boxes
+}
+
+// 按路径找box,例如 "moov/trak/mdia/mdhd"
+func findTestMP4Boxes(boxes []testMP4Box, path ...string) []testMP4Box {
+	var found []testMP4Box
+	for _, box := range boxes {
+		if box.typ != path[0] {
+			continue
+		}
+
+		if len(path) == 1 {
+			found = append(found, box)
+		} else {
+			found = append(found, findTestMP4Boxes(box.children, path[1:]...)...)
+		}
+	}
+
+	return found
+}
+
+func testMP4Types(boxes []testMP4Box) []string {
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.typ)
+	}
+
+	return types
+}
+
+func newTestFMP4Muxer(t *testing.T) *FMP4Muxer {
+	t.Helper()
+
+	m := NewFMP4Muxer(AVCDecoderConfigurationRecord{
+		AVCProfileIndication:        0x42,
+		AVCLevelIndication:          0x1e,
+		LengthSizeMinusOne:          3,
+		SequenceParameterSetNALUnit: []byte{0x67, 0x42, 0x00, 0x1e},
+		PictureParameterSetNALUnit:  []byte{0x68, 0xce, 0x3c, 0x80},
+	})
+
+	// AAC LC, 44100Hz, 双声道
+	if err := m.SetAudio(AudioSpecificConfig{AudioObjectType: 2, SamplingFrequencyIndex: 4, ChannelConfiguration: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// 初始化段是 ftyp + moov, moov中有视频和音频两个轨道以及它们的trex
+func TestFMP4InitSegment(t *testing.T) {
+	m := newTestFMP4Muxer(t)
+	boxes := readTestMP4Boxes(t, m.InitSegment(), 0)
+
+	if types := testMP4Types(boxes); len(types) != 2 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("top level boxes = %v", types)
+	}
+
+	if brand := string(boxes[0].data[:4]); brand != "iso6" {
+		t.Errorf("major brand = %s", brand)
+	}
+
+	moov := boxes[1]
+	if types := testMP4Types(moov.children); len(types) != 4 || types[0] != "mvhd" || types[1] != "trak" || types[2] != "trak" || types[3] != "mvex" {
+		t.Fatalf("moov boxes = %v", types)
+	}
+
+	tkhds := findTestMP4Boxes(boxes, "moov", "trak", "tkhd")
+	mdhds := findTestMP4Boxes(boxes, "moov", "trak", "mdia", "mdhd")
+	trexs := findTestMP4Boxes(boxes, "moov", "mvex", "trex")
+	if len(tkhds) != 2 || len(mdhds) != 2 || len(trexs) != 2 {
+		t.Fatalf("tkhd = %d, mdhd = %d, trex = %d", len(tkhds), len(mdhds), len(trexs))
+	}
+
+	for i, want := range []struct {
+		id        uint32
+		timescale uint32
+	}{{FMP4_VIDEO_TRACK_ID, FMP4_VIDEO_TIMESCALE}, {FMP4_AUDIO_TRACK_ID, 44100}} {
+		// tkhd version 0: version/flags(4) creation_time(4) modification_time(4) track_ID(4)
+		if id := binary.BigEndian.Uint32(tkhds[i].data[12:]); id != want.id {
+			t.Errorf("track %d: tkhd track id = %d, want %d", i, id, want.id)
+		}
+
+		// mdhd version 0: version/flags(4) creation_time(4) modification_time(4) timescale(4)
+		if timescale := binary.BigEndian.Uint32(mdhds[i].data[12:]); timescale != want.timescale {
+			t.Errorf("track %d: timescale = %d, want %d", i, timescale, want.timescale)
+		}
+
+		if id := binary.BigEndian.Uint32(trexs[i].data[4:]); id != want.id {
+			t.Errorf("trex %d: track id = %d, want %d", i, id, want.id)
+		}
+	}
+
+	avcC := findTestMP4Boxes(boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1", "avcC")
+	if len(avcC) != 1 || !bytes.Contains(avcC[0].data, []byte{0x67, 0x42, 0x00, 0x1e}) || !bytes.Contains(avcC[0].data, []byte{0x68, 0xce, 0x3c, 0x80}) {
+		t.Errorf("avcC = %+v", avcC)
+	}
+
+	if esds := findTestMP4Boxes(boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd", "mp4a", "esds"); len(esds) != 1 {
+		t.Errorf("esds = %+v", esds)
+	}
+}
+
+// trun中每个样本的字段
+type testTrunSample struct {
+	duration, size, flags uint32
+	cts                   int32
+}
+
+// 解析trun,样本的字段都存在(FMP4Muxer写的trun)
+func readTestTrun(t *testing.T, trun testMP4Box) (dataOffset int32, samples []testTrunSample) {
+	t.Helper()
+
+	b := trun.data
+	flags := binary.BigEndian.Uint32(b) & 0xffffff
+	want := uint32(TRUN_DATA_OFFSET_PRESENT | TRUN_SAMPLE_DURATION_PRESENT | TRUN_SAMPLE_SIZE_PRESENT | TRUN_SAMPLE_FLAGS_PRESENT | TRUN_SAMPLE_COMPOSITION_TIME_OFFSET_PRESENT)
+	if flags != want {
+		t.Fatalf("trun flags = %06x, want %06x", flags, want)
+	}
+
+	count := int(binary.BigEndian.Uint32(b[4:]))
+	if len(b) != 12+count*16 {
+		t.Fatalf("trun: %d bytes for %d samples", len(b), count)
+	}
+
+	dataOffset = int32(binary.BigEndian.Uint32(b[8:]))
+	for i := 0; i < count; i++ {
+		s := b[12+i*16:]
+		samples = append(samples, testTrunSample{
+			duration: binary.BigEndian.Uint32(s),
+			size:     binary.BigEndian.Uint32(s[4:]),
+			flags:    binary.BigEndian.Uint32(s[8:]),
+			cts:      int32(binary.BigEndian.Uint32(s[12:])),
+		})
+	}
+
+	return
+}
+
+// 媒体段是 moof + mdat, trun的data_offset指向mdat中这个轨道的样本数据,
+// tfdt是第一个样本的解码时间,样本的时长是下一个样本的解码时间减去这个样本的解码时间
+func TestFMP4Fragment(t *testing.T) {
+	m := newTestFMP4Muxer(t)
+	m.InitSegment()
+
+	if m.Buffered() || m.Fragment(0) != nil {
+		t.Fatal("fragment without samples")
+	}
+
+	video := [][]byte{{0, 0, 0, 2, 0x65, 1}, {0, 0, 0, 3, 0x41, 2, 3}, {0, 0, 0, 1, 0x41}}
+	audio := [][]byte{{0x21, 1, 2}, {0x21, 3, 4, 5}}
+
+	m.WriteVideo(0, 40, true, video[0])
+	m.WriteVideo(40, 40, false, video[1])
+	m.WriteVideo(80, 0, false, video[2])
+	m.WriteAudio(0, audio[0])
+	m.WriteAudio(23, audio[1])
+
+	tests := []struct {
+		id        uint32
+		tfdt      uint64
+		data      [][]byte
+		durations []uint32
+		flags     []uint32
+		cts       []int32
+	}{
+		{
+			id:        FMP4_VIDEO_TRACK_ID,
+			tfdt:      0,
+			data:      video,
+			durations: []uint32{3600, 3600, 3600},
+			flags:     []uint32{FMP4_SAMPLE_FLAGS_SYNC, FMP4_SAMPLE_FLAGS_NON_SYNC, FMP4_SAMPLE_FLAGS_NON_SYNC},
+			cts:       []int32{3600, 3600, 0},
+		},
+		{
+			// 23ms = 1014个采样,最后一个音频帧使用前一个音频帧的时长
+			id:        FMP4_AUDIO_TRACK_ID,
+			tfdt:      0,
+			data:      audio,
+			durations: []uint32{1014, 1014},
+			flags:     []uint32{FMP4_SAMPLE_FLAGS_SYNC, FMP4_SAMPLE_FLAGS_SYNC},
+			cts:       []int32{0, 0},
+		},
+	}
+
+	fragment := m.Fragment(120)
+	boxes := readTestMP4Boxes(t, fragment, 0)
+	if types := testMP4Types(boxes); len(types) != 2 || types[0] != "moof" || types[1] != "mdat" {
+		t.Fatalf("top level boxes = %v", types)
+	}
+
+	moof, mdat := boxes[0], boxes[1]
+	if size := len(video[0]) + len(video[1]) + len(video[2]) + len(audio[0]) + len(audio[1]); len(mdat.data) != size {
+		t.Errorf("mdat size = %d, want %d", len(mdat.data), size)
+	}
+
+	if mfhd := findTestMP4Boxes(boxes, "moof", "mfhd"); len(mfhd) != 1 || binary.BigEndian.Uint32(mfhd[0].data[4:]) != 1 {
+		t.Errorf("mfhd = %+v", mfhd)
+	}
+
+	trafs := findTestMP4Boxes(boxes, "moof", "traf")
+	if len(trafs) != len(tests) {
+		t.Fatalf("traf = %d, want %d", len(trafs), len(tests))
+	}
+
+	// 样本数据按轨道的顺序紧接着排在mdat中
+	next := mdat.start + 8
+	for i, want := range tests {
+		traf := trafs[i]
+		if types := testMP4Types(traf.children); len(types) != 3 || types[0] != "tfhd" || types[1] != "tfdt" || types[2] != "trun" {
+			t.Fatalf("traf %d boxes = %v", i, types)
+		}
+
+		tfhd, tfdt := traf.children[0], traf.children[1]
+		if flags := binary.BigEndian.Uint32(tfhd.data) & 0xffffff; flags != TFHD_DEFAULT_BASE_IS_MOOF {
+			t.Errorf("traf %d: tfhd flags = %06x", i, flags)
+		}
+
+		if id := binary.BigEndian.Uint32(tfhd.data[4:]); id != want.id {
+			t.Errorf("traf %d: track id = %d, want %d", i, id, want.id)
+		}
+
+		if tfdt.data[0] != 1 || binary.BigEndian.Uint64(tfdt.data[4:]) != want.tfdt {
+			t.Errorf("traf %d: tfdt = % x, want version 1, %d", i, tfdt.data, want.tfdt)
+		}
+
+		dataOffset, samples := readTestTrun(t, traf.children[2])
+		if len(samples) != len(want.data) {
+			t.Fatalf("traf %d: sample count = %d, want %d", i, len(samples), len(want.data))
+		}
+
+		// data_offset相对于moof的开始 (default-base-is-moof)
+		offset := moof.start + int(dataOffset)
+		if offset != next {
+			t.Errorf("traf %d: data offset points to %d, want %d", i, offset, next)
+		}
+
+		for j, s := range samples {
+			if s.duration != want.durations[j] || s.flags != want.flags[j] || s.cts != want.cts[j] {
+				t.Errorf("traf %d sample %d = %+v, want duration %d, flags %08x, cts %d", i, j, s, want.durations[j], want.flags[j], want.cts[j])
+			}
+
+			if int(s.size) != len(want.data[j]) || offset+int(s.size) > len(fragment) || !bytes.Equal(fragment[offset:offset+int(s.size)], want.data[j]) {
+				t.Errorf("traf %d sample %d: size %d, data at %d does not match", i, j, s.size, offset)
+			} else {
+				offset += int(s.size)
+			}
+		}
+
+		next = offset
+	}
+
+	// 下一个媒体段, tfdt接着上一个媒体段,最后一个视频帧的时长是结束时间减去它的解码时间
+	m.WriteVideo(120, 0, false, video[2])
+	m.WriteVideo(160, 0, false, video[2])
+
+	boxes = readTestMP4Boxes(t, m.Fragment(240), 0)
+
+	if mfhd := findTestMP4Boxes(boxes, "moof", "mfhd"); len(mfhd) != 1 || binary.BigEndian.Uint32(mfhd[0].data[4:]) != 2 {
+		t.Errorf("mfhd = %+v", mfhd)
+	}
+
+	trafs = findTestMP4Boxes(boxes, "moof", "traf")
+	if len(trafs) != 1 {
+		t.Fatalf("traf = %d, want only the video track", len(trafs))
+	}
+
+	if tfdt := trafs[0].children[1]; binary.BigEndian.Uint64(tfdt.data[4:]) != 120*90 {
+		t.Errorf("tfdt = % x, want %d", tfdt.data, 120*90)
+	}
+
+	_, samples := readTestTrun(t, trafs[0].children[2])
+	if len(samples) != 2 || samples[0].duration != 3600 || samples[1].duration != 7200 {
+		t.Errorf("samples = %+v", samples)
+	}
+}
@@ -0,0 +1,293 @@
+package avformat
+
+import (
+	"errors"
+)
+
+// ISO/IEC 14496-10 7.3.2.1.1 Sequence parameter set data syntax
+//
+// 只解析到frame_cropping,用于得到视频的宽和高
+
+var errSPSTooShort = errors.New("sps: not enough data")
+
+// 读RBSP的比特,去掉了防竞争字节(emulation_prevention_three_byte, 00 00 03)
+type spsBitReader struct {
+	data []byte
+	pos  int // 比特位置
+}
+
+func newSPSBitReader(nalu []byte) *spsBitReader {
+	rbsp := make([]byte, 0, len(nalu))
+	for i := 0; i < len(nalu); i++ {
+		if i >= 2 && nalu[i] == 0x03 && nalu[i-1] == 0x00 && nalu[i-2] == 0x00 {
+			continue
+		}
+
+		rbsp = append(rbsp, nalu[i])
+	}
+
+	return &spsBitReader{data: rbsp}
+}
+
+// u(n)
+func (r *spsBitReader) u(n int) (v uint32, err error) {
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, errSPSTooShort
+		}
+
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+
+	return
+}
+
+// ue(v), 无符号指数哥伦布编码
+func (r *spsBitReader) ue() (v uint32, err error) {
+	zeros := 0
+	for {
+		var b uint32
+		if b, err = r.u(1); err != nil {
+			return
+		}
+
+		if b == 1 {
+			break
+		}
+
+		if zeros++; zeros > 31 {
+			return 0, errors.New("sps: invalid exp-golomb code")
+		}
+	}
+
+	if v, err = r.u(zeros); err != nil {
+		return
+	}
+
+	return v + (1 << uint(zeros)) - 1, nil
+}
+
+// se(v), 有符号指数哥伦布编码
+func (r *spsBitReader) se() (v int32, err error) {
+	var k uint32
+	if k, err = r.ue(); err != nil {
+		return
+	}
+
+	if k%2 == 1 {
+		return int32((k + 1) / 2), nil
+	}
+
+	return -int32(k / 2), nil
+}
+
+// scaling_list(), 只跳过
+func (r *spsBitReader) skipScalingList(size int) error {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if nextScale != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+
+			nextScale = (lastScale + delta + 256) % 256
+		}
+
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+
+	return nil
+}
+
+// 从SPS(包括NALU header)中解析视频的宽和高,去掉了裁剪(frame_cropping)的部分
+func ParseSPSResolution(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 || sps[0]&0x1F != NALU_SPS {
+		return 0, 0, errors.New("sps: not a sequence parameter set")
+	}
+
+	r := newSPSBitReader(sps[1:])
+
+	var profile, v uint32
+	if profile, err = r.u(8); err != nil { // profile_idc
+		return
+	}
+
+	if _, err = r.u(16); err != nil { // constraint_set_flags, level_idc
+		return
+	}
+
+	if _, err = r.ue(); err != nil { // seq_parameter_set_id
+		return
+	}
+
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil { // chroma_format_idc
+			return
+		}
+
+		if chromaFormat == 3 {
+			if separateColourPlane, err = r.u(1); err != nil {
+				return
+			}
+		}
+
+		if _, err = r.ue(); err != nil { // bit_depth_luma_minus8
+			return
+		}
+
+		if _, err = r.ue(); err != nil { // bit_depth_chroma_minus8
+			return
+		}
+
+		if _, err = r.u(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return
+		}
+
+		if v, err = r.u(1); err != nil { // seq_scaling_matrix_present_flag
+			return
+		}
+
+		if v == 1 {
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				if v, err = r.u(1); err != nil { // seq_scaling_list_present_flag
+					return
+				}
+
+				if v == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+
+					if err = r.skipScalingList(size); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // log2_max_frame_num_minus4
+		return
+	}
+
+	var pocType uint32
+	if pocType, err = r.ue(); err != nil { // pic_order_cnt_type
+		return
+	}
+
+	switch pocType {
+	case 0:
+		if _, err = r.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return
+		}
+	case 1:
+		if _, err = r.u(1); err != nil { // delta_pic_order_always_zero_flag
+			return
+		}
+
+		if _, err = r.se(); err != nil { // offset_for_non_ref_pic
+			return
+		}
+
+		if _, err = r.se(); err != nil { // offset_for_top_to_bottom_field
+			return
+		}
+
+		var n uint32
+		if n, err = r.ue(); err != nil { // num_ref_frames_in_pic_order_cnt_cycle
+			return
+		}
+
+		for i := uint32(0); i < n; i++ {
+			if _, err = r.se(); err != nil { // offset_for_ref_frame
+				return
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // max_num_ref_frames
+		return
+	}
+
+	if _, err = r.u(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return
+	}
+
+	var widthInMbs, heightInMapUnits, frameMbsOnly uint32
+	if widthInMbs, err = r.ue(); err != nil { // pic_width_in_mbs_minus1
+		return
+	}
+
+	if heightInMapUnits, err = r.ue(); err != nil { // pic_height_in_map_units_minus1
+		return
+	}
+
+	if frameMbsOnly, err = r.u(1); err != nil { // frame_mbs_only_flag
+		return
+	}
+
+	if frameMbsOnly == 0 {
+		if _, err = r.u(1); err != nil { // mb_adaptive_frame_field_flag
+			return
+		}
+	}
+
+	if _, err = r.u(1); err != nil { // direct_8x8_inference_flag
+		return
+	}
+
+	width = int(widthInMbs+1) * 16
+	height = int(2-frameMbsOnly) * int(heightInMapUnits+1) * 16
+
+	var cropping uint32
+	if cropping, err = r.u(1); err != nil { // frame_cropping_flag
+		return
+	}
+
+	if cropping == 1 {
+		var crop [4]uint32 // left, right, top, bottom
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return
+			}
+		}
+
+		// 裁剪的单位(7-19, 7-20, 7-21, 7-22)
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormat != 0 && separateColourPlane == 0 {
+			subWidthC, subHeightC := 2, 2
+			switch chromaFormat {
+			case 2:
+				subHeightC = 1
+			case 3:
+				subWidthC, subHeightC = 1, 1
+			}
+
+			cropUnitX = subWidthC
+			cropUnitY = subHeightC * int(2-frameMbsOnly)
+		}
+
+		width -= cropUnitX * int(crop[0]+crop[1])
+		height -= cropUnitY * int(crop[2]+crop[3])
+	}
+
+	if width <= 0 || height <= 0 {
+		return 0, 0, errors.New("sps: invalid resolution")
+	}
+
+	return width, height, nil
+}
@@ -9,16 +9,52 @@ import (
 )
 
 var (
-	AppName          string
-	DebugMode        bool
-	HLSEnabled       bool
-	HLSFragment      int64
-	HLSWindow        int
-	HLSPath          string
-	ResourcePath     string // 资源文件的路径
-	ResourceLivePath string // 资源文件的路径
-	ResourceVodPath  string // 资源文件的路径
-	ResourceTempPath string // 资源文件的路径
+	AppName                  string
+	DebugMode                bool
+	HLSEnabled               bool
+	HLSFragment              int64
+	HLSWindow                int
+	HLSPath                  string
+	HLSMaxFragment           int64               // GOP太长的时候,不等关键帧切片的最大切片时长(秒),0表示HLSFragment的2倍
+	HLSMemory                bool                // HLS只保存在内存中,不写文件
+	HLSSegmentGrace          int                 // 切片离开滑动窗口之后保留的时间(秒)
+	HLSPurgeDelay            int                 // 广播结束之后保留HLS文件的时间(秒),0表示不删除
+	HLSEncrypt               bool                // HLS切片是否使用AES-128加密
+	HLSKeyRotate             int                 // 每个密钥加密的切片个数,0表示每次发布只使用一个密钥
+	HLSKeyURL                string              // HLS密钥URI的前缀,为空的时候使用相对路径
+	HLSVariants              map[string][]string // HLS多码率的分组, 应用名 -> 流名称的后缀列表
+	HLSLowLatency            bool                // 是否输出低延迟HLS
+	HLSPartDuration          int                 // 低延迟HLS分片的时长(毫秒)
+	HLSSegmentTypes          map[string]string   // HLS切片的格式, 应用名 -> ts或者fmp4
+	HLSPlaylistTypes         map[string]string   // HLS播放列表的类型, 应用名 -> live或者event
+	DASHEnabled              bool                // fMP4切片的流是否同时输出DASH
+	GopCacheNum              int                 // 广播缓存的GOP个数,0表示不缓存
+	SubscriberQueueSize      int                 // 每个订阅者发送队列的长度
+	SubscriberOverflowPolicy string              // 订阅者发送队列满了之后的处理策略: drop_frame, drop_gop, disconnect
+	ReadTimeout              int                 // 读一个消息的超时时间(秒),0表示不超时
+	WriteTimeout             int                 // 写一个块的超时时间(秒),0表示不超时
+	HandshakeTimeout         int                 // 握手和connect的超时时间(秒),0表示不超时
+	IdleTimeout              int                 // 广播收不到音视频包的超时时间(秒),0表示不超时
+	RelayTargets             map[string][]string // 转推的上游服务器地址, 应用名 -> 上游服务器地址列表
+	EdgeOrigin               string              // 边缘模式的源站地址,为空表示不开启边缘模式
+	RTMPSAddr                string              // RTMPS监听的地址,为空表示不开启RTMPS
+	RTMPSCertFile            string              // RTMPS默认的证书文件
+	RTMPSKeyFile             string              // RTMPS默认的证书私钥文件
+	RTMPSCerts               map[string][]string // RTMPS根据域名(SNI)选择的证书, 域名 -> [证书文件, 私钥文件]
+	HTTPAddr                 string              // HTTP(HTTP-FLV)监听的地址,为空表示不开启HTTP
+	AuthSecret               string              // 推流鉴权的HMAC密钥,为空表示不鉴权
+	AuthPlay                 bool                // 播放是否也需要鉴权
+	WebhookOnConnect         string              // 客户端connect的回调地址
+	WebhookOnPublish         string              // 开始发布的回调地址,返回非2xx拒绝发布
+	WebhookOnUnpublish       string              // 停止发布的回调地址
+	WebhookOnPlay            string              // 开始播放的回调地址,返回非2xx拒绝播放
+	WebhookOnStop            string              // 停止播放的回调地址
+	WebhookOnRecordDone      string              // 录制完成的回调地址
+	WebhookTimeout           int                 // 回调的超时时间(秒)
+	ResourcePath             string              // 资源文件的路径
+	ResourceLivePath         string              // 资源文件的路径
+	ResourceVodPath          string              // 资源文件的路径
+	ResourceTempPath         string              // 资源文件的路径
 )
 
 type Config struct {
@@ -142,6 +178,181 @@ func (cfg *Config) initBaseData() (err error) {
 		}
 	}
 
+	if value, err = cfg.Read("RTMP", "GOP_Cache"); err != nil {
+		GopCacheNum = 1
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v < 0 {
+			GopCacheNum = 1
+		} else {
+			GopCacheNum = v
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Subscriber_Queue"); err != nil {
+		SubscriberQueueSize = 512
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v <= 0 {
+			SubscriberQueueSize = 512
+		} else {
+			SubscriberQueueSize = v
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Overflow_Policy"); err != nil {
+		SubscriberOverflowPolicy = "drop_frame"
+	} else {
+		if value == "drop_gop" || value == "disconnect" {
+			SubscriberOverflowPolicy = value
+		} else {
+			SubscriberOverflowPolicy = "drop_frame"
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Read_Timeout"); err != nil {
+		ReadTimeout = 15
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v < 0 {
+			ReadTimeout = 15
+		} else {
+			ReadTimeout = v
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Write_Timeout"); err != nil {
+		WriteTimeout = 15
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v < 0 {
+			WriteTimeout = 15
+		} else {
+			WriteTimeout = v
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Handshake_Timeout"); err != nil {
+		HandshakeTimeout = 10
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v < 0 {
+			HandshakeTimeout = 10
+		} else {
+			HandshakeTimeout = v
+		}
+	}
+
+	if value, err = cfg.Read("RTMP", "Idle_Timeout"); err != nil {
+		IdleTimeout = 100
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v < 0 {
+			IdleTimeout = 100
+		} else {
+			IdleTimeout = v
+		}
+	}
+
+	// [Relay] 每一行是一个应用的转推配置, 应用名 = 上游服务器地址1,上游服务器地址2,...
+	RelayTargets = make(map[string][]string)
+	if sec, ok := cfg.Secions["Relay"]; ok {
+		for app, urls := range sec.Fields {
+			for _, v := range strings.Split(urls, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					RelayTargets[app] = append(RelayTargets[app], v)
+				}
+			}
+		}
+	}
+
+	if value, err = cfg.Read("Edge", "Origin"); err != nil {
+		EdgeOrigin = ""
+	} else {
+		EdgeOrigin = value
+	}
+
+	if value, err = cfg.Read("RTMPS", "Listen"); err != nil {
+		RTMPSAddr = ""
+	} else {
+		RTMPSAddr = value
+	}
+
+	if value, err = cfg.Read("RTMPS", "Cert_File"); err != nil {
+		RTMPSCertFile = ""
+	} else {
+		RTMPSCertFile = value
+	}
+
+	if value, err = cfg.Read("RTMPS", "Key_File"); err != nil {
+		RTMPSKeyFile = ""
+	} else {
+		RTMPSKeyFile = value
+	}
+
+	// [RTMPS_SNI] 每一行是一个域名的证书, 域名 = 证书文件,私钥文件
+	RTMPSCerts = make(map[string][]string)
+	if sec, ok := cfg.Secions["RTMPS_SNI"]; ok {
+		for name, files := range sec.Fields {
+			v := strings.Split(files, ",")
+			if len(v) != 2 {
+				return errors.New("Init error, RTMPS_SNI " + name + " must be cert_file,key_file.")
+			}
+
+			RTMPSCerts[name] = []string{strings.TrimSpace(v[0]), strings.TrimSpace(v[1])}
+		}
+	}
+
+	if value, err = cfg.Read("HTTP", "Listen"); err != nil {
+		HTTPAddr = ""
+	} else {
+		HTTPAddr = value
+	}
+
+	if value, err = cfg.Read("Auth", "Secret"); err != nil {
+		AuthSecret = ""
+	} else {
+		AuthSecret = value
+	}
+
+	if value, err = cfg.Read("Auth", "Play"); err != nil {
+		AuthPlay = false
+	} else {
+		if value == "on" {
+			AuthPlay = true
+		} else {
+			AuthPlay = false
+		}
+	}
+
+	// [Webhook] 回调地址,为空表示这个事件不回调
+	webhooks := map[string]*string{
+		"On_Connect":     &WebhookOnConnect,
+		"On_Publish":     &WebhookOnPublish,
+		"On_Unpublish":   &WebhookOnUnpublish,
+		"On_Play":        &WebhookOnPlay,
+		"On_Stop":        &WebhookOnStop,
+		"On_Record_Done": &WebhookOnRecordDone}
+
+	for key, p := range webhooks {
+		if value, err = cfg.Read("Webhook", key); err != nil {
+			*p = ""
+		} else {
+			*p = value
+		}
+	}
+
+	if value, err = cfg.Read("Webhook", "Timeout"); err != nil {
+		WebhookTimeout = 5
+	} else {
+		var v int
+		if v, err = strconv.Atoi(value); err != nil || v <= 0 {
+			WebhookTimeout = 5
+		} else {
+			WebhookTimeout = v
+		}
+	}
+
 	if value, err = cfg.Read("HLS", "Enabled"); err != nil {
 		HLSEnabled = false
 	} else {
@@ -159,6 +370,65 @@ func (cfg *Config) initBaseData() (err error) {
 			HLSPath = value
 		}
 
+		if value, err = cfg.Read("HLS", "Memory"); err != nil {
+			HLSMemory = false
+		} else {
+			if value == "on" {
+				HLSMemory = true
+			} else {
+				HLSMemory = false
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Segment_Grace"); err != nil {
+			HLSSegmentGrace = 10
+		} else {
+			var v int
+			if v, err = strconv.Atoi(value); err != nil || v < 0 {
+				HLSSegmentGrace = 10
+			} else {
+				HLSSegmentGrace = v
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Purge_Delay"); err != nil {
+			HLSPurgeDelay = 60
+		} else {
+			var v int
+			if v, err = strconv.Atoi(value); err != nil || v < 0 {
+				HLSPurgeDelay = 60
+			} else {
+				HLSPurgeDelay = v
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Encrypt"); err != nil {
+			HLSEncrypt = false
+		} else {
+			if value == "on" {
+				HLSEncrypt = true
+			} else {
+				HLSEncrypt = false
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Key_Rotate"); err != nil {
+			HLSKeyRotate = 0
+		} else {
+			var v int
+			if v, err = strconv.Atoi(value); err != nil || v < 0 {
+				HLSKeyRotate = 0
+			} else {
+				HLSKeyRotate = v
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Key_URL"); err != nil {
+			HLSKeyURL = ""
+		} else {
+			HLSKeyURL = value
+		}
+
 		if value, err = cfg.Read("HLS", "HLS_Fragment"); err != nil {
 			HLSFragment = 0
 		} else {
@@ -170,6 +440,38 @@ func (cfg *Config) initBaseData() (err error) {
 			}
 		}
 
+		if value, err = cfg.Read("HLS", "Low_Latency"); err != nil {
+			HLSLowLatency = false
+		} else {
+			if value == "on" {
+				HLSLowLatency = true
+			} else {
+				HLSLowLatency = false
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "Part_Duration"); err != nil {
+			HLSPartDuration = 200
+		} else {
+			var v int
+			if v, err = strconv.Atoi(value); err != nil || v <= 0 {
+				HLSPartDuration = 200
+			} else {
+				HLSPartDuration = v
+			}
+		}
+
+		if value, err = cfg.Read("HLS", "HLS_Max_Fragment"); err != nil {
+			HLSMaxFragment = 0
+		} else {
+			var v int64
+			if v, err = strconv.ParseInt(value, 10, 32); err != nil || v < 0 {
+				HLSMaxFragment = 0
+			} else {
+				HLSMaxFragment = v
+			}
+		}
+
 		if value, err = cfg.Read("HLS", "HLS_Window"); err != nil {
 			HLSWindow = 3
 		} else {
@@ -182,6 +484,49 @@ func (cfg *Config) initBaseData() (err error) {
 		}
 	}
 
+	// [HLS_Variant] 每一行是一个应用的多码率分组, 应用名 = 后缀1,后缀2,...
+	HLSVariants = make(map[string][]string)
+	if sec, ok := cfg.Secions["HLS_Variant"]; ok {
+		for app, suffixes := range sec.Fields {
+			for _, v := range strings.Split(suffixes, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					HLSVariants[app] = append(HLSVariants[app], v)
+				}
+			}
+		}
+	}
+
+	// [HLS_Segment] 每一行是一个应用的切片格式, 应用名 = ts或者fmp4
+	HLSSegmentTypes = make(map[string]string)
+	if sec, ok := cfg.Secions["HLS_Segment"]; ok {
+		for app, t := range sec.Fields {
+			HLSSegmentTypes[app] = strings.ToLower(strings.TrimSpace(t))
+		}
+	}
+
+	// [HLS_Playlist_Type] 每一行是一个应用的播放列表类型, 应用名 = live或者event
+	HLSPlaylistTypes = make(map[string]string)
+	if sec, ok := cfg.Secions["HLS_Playlist_Type"]; ok {
+		for app, t := range sec.Fields {
+			HLSPlaylistTypes[app] = strings.ToLower(strings.TrimSpace(t))
+		}
+	}
+
+	if value, err = cfg.Read("DASH", "Enabled"); err != nil {
+		DASHEnabled = false
+	} else {
+		if value == "on" {
+			DASHEnabled = true
+		} else {
+			DASHEnabled = false
+		}
+	}
+
+	// DASH和HLS使用同样的切片,加密的切片DASH的播放器不能解密
+	if DASHEnabled && HLSEncrypt {
+		return errors.New("Init error, DASH Enabled can not be on when HLS Encrypt is on.")
+	}
+
 	if dir, err = os.Getwd(); err != nil {
 		return
 	}
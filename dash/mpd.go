@@ -0,0 +1,219 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MPEG-DASH (ISO/IEC 23009-1) 直播的媒体描述(MPD)在内存中的模型.
+// 只有一个Period,一个AdaptationSet,一个Representation(音视频在同一个fMP4文件中),
+// 切片使用SegmentTemplate的$Number$编号,SegmentTimeline列出每个切片的开始时间和时长.
+// 每次更新之后用Encode重新生成整个MPD
+
+const (
+	DASH_MPD_TYPE_DYNAMIC = "dynamic" // 直播
+	DASH_MPD_TYPE_STATIC  = "static"  // 点播
+
+	DASH_PROFILE_LIVE = "urn:mpeg:dash:profile:isoff-live:2011"
+	DASH_MPD_XMLNS    = "urn:mpeg:dash:schema:mpd:2011"
+)
+
+// xs:dateTime 的格式, 精确到毫秒
+const DASH_DATE_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+type MPD struct {
+	AvailabilityStartTime     time.Time     // 直播开始的时间,媒体时间PresentationTimeOffset对应这个时间
+	PublishTime               time.Time     // MPD生成的时间
+	MinimumUpdatePeriod       time.Duration // 播放器重新请求MPD的最小间隔
+	MinBufferTime             time.Duration // 播放器开始播放之前需要缓冲的时长
+	TimeShiftBufferDepth      time.Duration // 可以回看的时长,和切片的保留时长一致
+	MediaPresentationDuration time.Duration // 不为0表示直播已经结束,播放到这个时长结束,不再更新MPD
+	Bandwidth                 int           // 码率(bit/s)
+	Codecs                    string        // RFC 6381, 例如 avc1.64001f,mp4a.40.2
+	Width                     int           // 视频的宽, 0表示不写
+	Height                    int           // 视频的高, 0表示不写
+	Timescale                 uint64        // SegmentTemplate的时间刻度
+	PresentationTimeOffset    uint64        // Period开始的媒体时间,时间刻度是Timescale
+	Initialization            string        // 初始化段的URI
+	Media                     string        // 切片的URI模板,例如 stream-$Number$.m4s
+	StartNumber               int           // 第一个切片的编号
+	Segments                  []Segment     // 切片,从StartNumber开始
+}
+
+// SegmentTimeline中的一个切片
+type Segment struct {
+	Time     uint64 // 切片开始的媒体时间,时间刻度是Timescale
+	Duration uint64 // 切片的时长,时间刻度是Timescale
+}
+
+type xmlMPD struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Xmlns                     string    `xml:"xmlns,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	AvailabilityStartTime     string    `xml:"availabilityStartTime,attr"`
+	PublishTime               string    `xml:"publishTime,attr"`
+	MinimumUpdatePeriod       string    `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth      string    `xml:"timeShiftBufferDepth,attr,omitempty"`
+	Period                    xmlPeriod `xml:"Period"`
+}
+
+type xmlPeriod struct {
+	ID            string           `xml:"id,attr"`
+	Start         string           `xml:"start,attr"`
+	AdaptationSet xmlAdaptationSet `xml:"AdaptationSet"`
+}
+
+type xmlAdaptationSet struct {
+	MimeType         string             `xml:"mimeType,attr"`
+	SegmentAlignment bool               `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                `xml:"startWithSAP,attr"`
+	SegmentTemplate  xmlSegmentTemplate `xml:"SegmentTemplate"`
+	Representation   xmlRepresentation  `xml:"Representation"`
+}
+
+type xmlSegmentTemplate struct {
+	Timescale              uint64 `xml:"timescale,attr"`
+	PresentationTimeOffset uint64 `xml:"presentationTimeOffset,attr"`
+	Initialization         string `xml:"initialization,attr"`
+	Media                  string `xml:"media,attr"`
+	StartNumber            int    `xml:"startNumber,attr"`
+	SegmentTimeline        []xmlS `xml:"SegmentTimeline>S"`
+}
+
+type xmlS struct {
+	T uint64 `xml:"t,attr,omitempty"`
+	D uint64 `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+type xmlRepresentation struct {
+	ID        string `xml:"id,attr"`
+	Bandwidth int    `xml:"bandwidth,attr"`
+	Codecs    string `xml:"codecs,attr,omitempty"`
+	Width     int    `xml:"width,attr,omitempty"`
+	Height    int    `xml:"height,attr,omitempty"`
+}
+
+// 生成MPD的内容
+func (this *MPD) Encode() []byte {
+	m := xmlMPD{
+		Xmlns:                 DASH_MPD_XMLNS,
+		Profiles:              DASH_PROFILE_LIVE,
+		Type:                  DASH_MPD_TYPE_DYNAMIC,
+		AvailabilityStartTime: this.AvailabilityStartTime.UTC().Format(DASH_DATE_TIME_FORMAT),
+		PublishTime:           this.PublishTime.UTC().Format(DASH_DATE_TIME_FORMAT),
+		MinBufferTime:         FormatDuration(this.MinBufferTime),
+		TimeShiftBufferDepth:  FormatDuration(this.TimeShiftBufferDepth),
+		Period: xmlPeriod{
+			ID:    "0",
+			Start: "PT0S",
+			AdaptationSet: xmlAdaptationSet{
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				SegmentTemplate: xmlSegmentTemplate{
+					Timescale:              this.Timescale,
+					PresentationTimeOffset: this.PresentationTimeOffset,
+					Initialization:         this.Initialization,
+					Media:                  this.Media,
+					StartNumber:            this.StartNumber,
+				},
+				Representation: xmlRepresentation{
+					ID:        "0",
+					Bandwidth: this.Bandwidth,
+					Codecs:    this.Codecs,
+					Width:     this.Width,
+					Height:    this.Height,
+				},
+			},
+		},
+	}
+
+	// 直播结束之后有mediaPresentationDuration,不再需要更新MPD
+	if this.MediaPresentationDuration > 0 {
+		m.MediaPresentationDuration = FormatDuration(this.MediaPresentationDuration)
+	} else {
+		m.MinimumUpdatePeriod = FormatDuration(this.MinimumUpdatePeriod)
+	}
+
+	// 第一个S写开始时间t,之后和前一个切片连续的时候省略t;时长相同的连续切片合并,r是重复的次数
+	timeline := &m.Period.AdaptationSet.SegmentTemplate.SegmentTimeline
+	var next uint64
+	for i, seg := range this.Segments {
+		if n := len(*timeline); n > 0 && seg.Time == next && (*timeline)[n-1].D == seg.Duration {
+			(*timeline)[n-1].R++
+		} else {
+			s := xmlS{D: seg.Duration}
+			if i == 0 || seg.Time != next {
+				s.T = seg.Time
+			}
+
+			*timeline = append(*timeline, s)
+		}
+
+		next = seg.Time + seg.Duration
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+
+	data, _ := xml.MarshalIndent(&m, "", "  ")
+	b.Write(data)
+	b.WriteString("\n")
+
+	return b.Bytes()
+}
+
+// 先写到 filename.tmp, 再改名为filename, 播放器不会读到写了一半的MPD
+func (this *MPD) WriteFile(filename string) (err error) {
+	tmpFilename := filename + ".tmp"
+
+	if err = ioutil.WriteFile(tmpFilename, this.Encode(), 0644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return
+	}
+
+	return
+}
+
+// xs:duration, 例如 PT2S, PT1.5S, PT1M30S
+func FormatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	ms := int64(d / time.Millisecond)
+
+	var b strings.Builder
+	b.WriteString("PT")
+
+	if h := ms / 3600000; h > 0 {
+		b.WriteString(strconv.FormatInt(h, 10) + "H")
+		ms %= 3600000
+	}
+
+	if m := ms / 60000; m > 0 {
+		b.WriteString(strconv.FormatInt(m, 10) + "M")
+		ms %= 60000
+	}
+
+	if ms%1000 == 0 {
+		b.WriteString(strconv.FormatInt(ms/1000, 10) + "S")
+	} else {
+		b.WriteString(strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64) + "S")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// AES-128加密的切片(RFC 8216 4.3.2.4).
+// 整个切片(ts)使用AES-128 CBC加密,PKCS7填充,密钥和IV都是16字节.
+
+// 生成一个随机的16字节的密钥或者IV
+func NewAES128Key() ([]byte, error) {
+	key := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// AES-128 CBC加密,PKCS7填充
+func EncryptSegment(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("hls: iv must be 16 bytes")
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+padding)
+	copy(out, data)
+	copy(out[len(data):], bytes.Repeat([]byte{byte(padding)}, padding))
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+// AES-128 CBC解密,去掉PKCS7填充
+func DecryptSegment(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("hls: iv must be 16 bytes")
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("hls: encrypted segment is not a multiple of the block size")
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	padding := int(out[len(out)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("hls: invalid padding")
+	}
+
+	return out[:len(out)-padding], nil
+}
@@ -0,0 +1,84 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+)
+
+// n个ts包,每个包188字节,以0x47开始
+func testTsSegment(n int) []byte {
+	data := make([]byte, 0, n*188)
+	for i := 0; i < n; i++ {
+		pkt := bytes.Repeat([]byte{byte(i)}, 188)
+		pkt[0] = 0x47
+		data = append(data, pkt...)
+	}
+
+	return data
+}
+
+func TestEncryptSegment(t *testing.T) {
+	key, err := NewAES128Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv, err := NewAES128Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment := testTsSegment(10)
+
+	encrypted, err := EncryptSegment(segment, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PKCS7填充之后是块大小的整数倍,长度正好是整数倍的时候多一个块
+	if len(encrypted)%16 != 0 || len(encrypted) <= len(segment) {
+		t.Fatalf("encrypted length = %d, segment length = %d", len(encrypted), len(segment))
+	}
+
+	if bytes.Contains(encrypted, segment[:188]) {
+		t.Fatal("encrypted segment contains plaintext")
+	}
+
+	decrypted, err := DecryptSegment(encrypted, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decrypted, segment) {
+		t.Fatal("decrypted segment differs from the original")
+	}
+
+	for i := 0; i < len(decrypted); i += 188 {
+		if decrypted[i] != 0x47 {
+			t.Fatalf("sync byte at %d = %#x", i, decrypted[i])
+		}
+	}
+
+	// 错误的密钥解密之后的填充一般不正确,就算正确也不会是原来的切片
+	wrong := append([]byte(nil), key...)
+	wrong[0] ^= 0xFF
+	if d, err := DecryptSegment(encrypted, wrong, iv); err == nil && bytes.Equal(d, segment) {
+		t.Fatal("decrypted with the wrong key")
+	}
+}
+
+func TestDecryptSegmentErrors(t *testing.T) {
+	key := make([]byte, 16)
+
+	if _, err := DecryptSegment(make([]byte, 15), key, make([]byte, 16)); err == nil {
+		t.Error("not a multiple of the block size: want error")
+	}
+
+	if _, err := DecryptSegment(make([]byte, 16), key, make([]byte, 8)); err == nil {
+		t.Error("short iv: want error")
+	}
+
+	if _, err := EncryptSegment(nil, make([]byte, 5), make([]byte, 16)); err == nil {
+		t.Error("invalid key: want error")
+	}
+}
@@ -1,31 +1,50 @@
 package hls
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"github.com/onedss/gortmp/util"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	HLS_KEY_METHOD_AES_128 = "AES-128"
 )
 
+// #EXT-X-PLAYLIST-TYPE
+const (
+	HLS_PLAYLIST_TYPE_EVENT = "EVENT"
+	HLS_PLAYLIST_TYPE_VOD   = "VOD"
+)
+
+// #EXT-X-PROGRAM-DATE-TIME 的格式, ISO/IEC 8601, 精确到毫秒
+const HLS_PROGRAM_DATE_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
 // https://datatracker.ietf.org/doc/draft-pantos-http-live-streaming/
 
+// 媒体播放列表(Media Playlist)在内存中的模型.
+// 每次更新之后用Encode重新生成整个播放列表,用WriteFile写到文件中(先写临时文件再改名),
+// Parse/ReadFile解析Encode生成的播放列表,得到同样的模型.
 // 以”#EXT“开头的表示一个”tag“,否则表示注释,直接忽略
 type Playlist struct {
-	ExtM3U         string      // indicates that the file is an Extended M3U [M3U] Playlist file. (4.3.3.1) -- 每个M3U文件第一行必须是这个tag.
-	Version        int         // indicates the compatibility version of the Playlist file. (4.3.1.2) -- 协议版本号.
-	Sequence       int         // indicates the Media Sequence Number of the first Media Segment that appears in a Playlist file. (4.3.3.2) -- 第一个媒体段的序列号.
-	Targetduration int         // specifies the maximum Media Segment duration. (4.3.3.1) -- 每个视频分段最大的时长(单位秒).
-	PlaylistType   int         // rovides mutability information about the Media Playlist file. (4.3.3.5) -- 提供关于PlayList的可变性的信息.
-	Discontinuity  int         // indicates a discontinuity between theMedia Segment that follows it and the one that preceded it. (4.3.2.3) -- 该标签后边的媒体文件和之前的媒体文件之间的编码不连贯(即发生改变)(场景用于插播广告等等).
-	Key            PlaylistKey // specifies how to decrypt them. (4.3.2.4) -- 解密媒体文件的必要信息(表示怎么对media segments进行解码).
-	EndList        string      // indicates that no more Media Segments will be added to the Media Playlist file. (4.3.3.4) -- 标示没有更多媒体文件将会加入到播放列表中,它可能会出现在播放列表文件的任何地方,但是不能出现两次或以上.
-	Inf            PlaylistInf // specifies the duration of a Media Segment. (4.3.2.1) -- 指定每个媒体段(ts)的持续时间.
+	Version               int           // indicates the compatibility version of the Playlist file. (4.3.1.2) -- 协议版本号.
+	Sequence              int           // indicates the Media Sequence Number of the first Media Segment that appears in a Playlist file. (4.3.3.2) -- 第一个媒体段的序列号.
+	DiscontinuitySequence int           // allows synchronization between different Renditions of the same Variant Stream. (4.3.3.3) -- 第一个媒体段之前的不连续的个数.
+	Targetduration        int           // specifies the maximum Media Segment duration. (4.3.3.1) -- 每个视频分段最大的时长(单位秒).
+	PlaylistType          string        // provides mutability information about the Media Playlist file. (4.3.3.5) -- 提供关于PlayList的可变性的信息, EVENT或者VOD,为空表示直播.
+	EndList               bool          // indicates that no more Media Segments will be added to the Media Playlist file. (4.3.3.4) -- 标示没有更多媒体文件将会加入到播放列表中.
+	Segments              []PlaylistInf // 播放列表中的媒体段
+	PartTarget            float64       // #EXT-X-PART-INF:PART-TARGET, 分片(Partial Segment)的目标时长(秒),0表示不是低延迟HLS.
+	CanBlockReload        bool          // #EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES, 支持_HLS_msn/_HLS_part阻塞请求播放列表.
+	PartHoldBack          float64       // #EXT-X-SERVER-CONTROL:PART-HOLD-BACK, 播放器离直播边缘的最小距离(秒),至少是PartTarget的2倍.
+	Partial               *PlaylistInf  // 正在生成的媒体段,只有已经生成的分片,没有#EXTINF.
+	PreloadHint           string        // #EXT-X-PRELOAD-HINT:TYPE=PART, 下一个分片的URI,为空表示不写.
+	Map                   string        // #EXT-X-MAP:URI, fMP4切片的初始化段(Media Initialization Section)的URI,为空表示不写. (4.3.2.5)
 }
 
 // Discontinuity :
@@ -41,166 +60,387 @@ type PlaylistKey struct {
 	IV     string // key iv. (4.3.2.4)
 }
 
+// 低延迟HLS的分片(Partial Segment), #EXT-X-PART
+type PlaylistPart struct {
+	Duration    float64 // 分片的时长(秒)
+	Uri         string  // 分片的URI
+	Independent bool    // 分片从关键帧开始, INDEPENDENT=YES
+}
+
+// 一个媒体段
 type PlaylistInf struct {
-	Duration float64
-	Title    string
+	Duration        float64        // specifies the duration of a Media Segment. (4.3.2.1) -- 媒体段(ts)的持续时间(秒).
+	Title           string         // 媒体段的URI
+	Key             *PlaylistKey   // 切片的密钥,nil表示不加密.和前一个切片的密钥不同的时候,在切片前面写#EXT-X-KEY
+	Discontinuity   bool           // indicates a discontinuity between the Media Segment that follows it and the one that preceded it. (4.3.2.3) -- 在切片前面写#EXT-X-DISCONTINUITY.
+	ProgramDateTime time.Time      // associates the first sample of a Media Segment with an absolute date and/or time. (4.3.2.6) -- 不为零的时候在切片前面写#EXT-X-PROGRAM-DATE-TIME.
+	Map             string         // #EXT-X-MAP:URI, 从这个媒体段开始使用的初始化段,为空表示和前一个媒体段相同. (4.3.2.5)
+	Parts           []PlaylistPart // 低延迟HLS,组成这个媒体段的分片,离直播边缘较远之后可以删除
+}
+
+// #EXT-X-KEY:METHOD=AES-128,URI="...",IV=0x...
+func (this *PlaylistKey) String() string {
+	if this == nil || this.Method == "" {
+		return "#EXT-X-KEY:METHOD=NONE"
+	}
+
+	ss := "#EXT-X-KEY:METHOD=" + this.Method + ",URI=\"" + this.Uri + "\""
+	if this.IV != "" {
+		ss += ",IV=" + this.IV
+	}
+
+	return ss
+}
+
+// 在播放列表的最后添加一个媒体段.
+// 目标时长在开始的时候设置,之后不能改变(6.2.1),每个媒体段的时长四舍五入之后必须不大于目标时长(4.3.3.1)
+func (this *Playlist) Append(inf PlaylistInf) {
+	this.Segments = append(this.Segments, inf)
 }
 
-func (this *Playlist) Init(filename string) (err error) {
-	defer this.handleError()
+// 只保留最后window个媒体段,返回删除的媒体段.
+// 每删除一个媒体段,媒体序列号加1;删除的媒体段前面有#EXT-X-DISCONTINUITY的时候,不连续序列号加1 (6.2.2)
+func (this *Playlist) Slide(window int) (removed []PlaylistInf) {
+	if window < 0 || len(this.Segments) <= window {
+		return nil
+	}
+
+	n := len(this.Segments) - window
+	removed = append(removed, this.Segments[:n]...)
+	this.Segments = append(this.Segments[:0:0], this.Segments[n:]...)
 
-	if util.Exist(filename) {
-		if err = os.Remove(filename); err != nil {
-			return
+	for _, inf := range removed {
+		this.Sequence++
+		if inf.Discontinuity {
+			this.DiscontinuitySequence++
 		}
 	}
 
-	var file *os.File
-	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return
+	return removed
+}
+
+// 删除离直播边缘(最后一个媒体段的结尾)超过age秒的媒体段的分片,返回删除的分片.
+// 分片只用于直播边缘附近的播放器,较早的媒体段只需要完整的切片
+func (this *Playlist) TrimParts(age float64) (removed []PlaylistPart) {
+	var end float64
+	for i := len(this.Segments) - 1; i >= 0; i-- {
+		if end > age {
+			removed = append(removed, this.Segments[i].Parts...)
+			this.Segments[i].Parts = nil
+		}
+
+		end += this.Segments[i].Duration
 	}
-	defer file.Close()
 
-	// ss := fmt.Sprintf("#EXTM3U\n"+
-	// 	"#EXT-X-VERSION:%d\n"+
-	// 	"#EXT-X-MEDIA-SEQUENCE:%d\n"+
-	// 	"#EXT-X-TARGETDURATION:%d\n"+
-	// 	"#EXT-X-PLAYLIST-TYPE:%d\n"+
-	// 	"#EXT-X-DISCONTINUITY:%d\n"+
-	// 	"#EXT-X-KEY:METHOD=%s,URI=%s,IV=%s\n"+
-	// 	"#EXT-X-ENDLIST", hls.Version, hls.Sequence, hls.Targetduration, hls.PlaylistType, hls.Discontinuity, hls.Key.Method, hls.Key.Uri, hls.Key.IV)
+	return removed
+}
+
+// 生成播放列表的内容
+func (this *Playlist) Encode() []byte {
+	var b bytes.Buffer
 
-	ss := fmt.Sprintf("#EXTM3U\n"+
+	fmt.Fprintf(&b, "#EXTM3U\n"+
 		"#EXT-X-VERSION:%d\n"+
-		"#EXT-X-MEDIA-SEQUENCE:%d\n"+
-		"#EXT-X-TARGETDURATION:%d\n", this.Version, this.Sequence, this.Targetduration)
+		"#EXT-X-MEDIA-SEQUENCE:%d\n", this.Version, this.Sequence)
 
-	if _, err = file.WriteString(ss); err != nil {
-		return
+	if this.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", this.DiscontinuitySequence)
 	}
 
-	file.Close()
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", this.Targetduration)
 
-	return
+	if this.PlaylistType != "" {
+		fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:%s\n", this.PlaylistType)
+	}
+
+	if this.CanBlockReload || this.PartHoldBack > 0 {
+		b.WriteString("#EXT-X-SERVER-CONTROL:")
+		if this.CanBlockReload {
+			b.WriteString("CAN-BLOCK-RELOAD=YES")
+		}
+
+		if this.PartHoldBack > 0 {
+			if this.CanBlockReload {
+				b.WriteString(",")
+			}
+
+			fmt.Fprintf(&b, "PART-HOLD-BACK=%.3f", this.PartHoldBack)
+		}
+
+		b.WriteString("\n")
+	}
+
+	if this.PartTarget > 0 {
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", this.PartTarget)
+	}
+
+	// 在所有的#EXT-X-KEY之前,初始化段不加密
+	if this.Map != "" {
+		b.WriteString("#EXT-X-MAP:URI=\"" + this.Map + "\"\n")
+	}
+
+	var key *PlaylistKey
+	for _, inf := range this.Segments {
+		encodeSegmentTags(&b, &inf, &key)
+
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n"+
+			"%s\n", inf.Duration, inf.Title)
+	}
+
+	if this.Partial != nil {
+		encodeSegmentTags(&b, this.Partial, &key)
+	}
+
+	if this.PreloadHint != "" {
+		b.WriteString("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + this.PreloadHint + "\"\n")
+	}
+
+	if this.EndList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return b.Bytes()
 }
 
-func (this *Playlist) WriteInf(filename string, inf PlaylistInf) (err error) {
-	defer this.handleError()
+// 媒体段的#EXTINF前面的tag,key是前一个媒体段的密钥
+func encodeSegmentTags(b *bytes.Buffer, inf *PlaylistInf, key **PlaylistKey) {
+	if inf.Discontinuity {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
 
-	var file *os.File
-	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return
+	// 初始化段不加密,#EXT-X-MAP之前先停止使用前一个媒体段的密钥
+	if inf.Map != "" {
+		if *key != nil {
+			b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			*key = nil
+		}
+
+		b.WriteString("#EXT-X-MAP:URI=\"" + inf.Map + "\"\n")
 	}
-	defer file.Close()
 
-	ss := fmt.Sprintf("#EXTINF:%.3f,\n"+
-		"%s\n", inf.Duration, inf.Title)
+	if inf.Key != *key {
+		b.WriteString(inf.Key.String() + "\n")
+		*key = inf.Key
+	}
 
-	if _, err = file.WriteString(ss); err != nil {
-		return
+	if !inf.ProgramDateTime.IsZero() {
+		b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + inf.ProgramDateTime.Format(HLS_PROGRAM_DATE_TIME_FORMAT) + "\n")
 	}
 
-	file.Close()
+	for _, part := range inf.Parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration, part.Uri)
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
 
-	return
+		b.WriteString("\n")
+	}
 }
 
-func (this *Playlist) UpdateInf(filename string, tmpFilename string, inf PlaylistInf) (err error) {
-	var oldContent []string
-	var newContent string
+// 先写到 filename.tmp, 再改名为filename, 播放器不会读到写了一半的播放列表
+func (this *Playlist) WriteFile(filename string) (err error) {
+	tmpFilename := filename + ".tmp"
 
-	var tmpFile *os.File
-	tmpFile, err = os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
+	if err = ioutil.WriteFile(tmpFilename, this.Encode(), 0644); err != nil {
 		return
 	}
-	defer tmpFile.Close()
 
-	var ls []string
-	if ls, err = util.ReadFileLines(filename); err != nil {
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
 		return
 	}
 
-	for i, v := range ls {
-		if strings.Contains(v, "#EXT-X-MEDIA-SEQUENCE") {
-			var index, seqNum int
-			var oldStrNum, newStrNum, newSeqStr string
+	return
+}
 
-			if index = strings.Index(v, ":"); index == -1 {
-				err = errors.New("#EXT-X-MEDIA-SEQUENCE not found.")
-				return
-			}
+// 读取并解析播放列表文件
+func ReadFile(filename string) (*Playlist, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// 解析媒体播放列表.
+// 不认识的tag和注释忽略,媒体段的tag(#EXTINF, #EXT-X-KEY...)作用于后面的第一个URI,
+// 最后一个URI后面的分片是正在生成的媒体段(Partial)
+func Parse(data []byte) (*Playlist, error) {
+	this := &Playlist{}
 
-			oldStrNum = v[index+1:]
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	var inf PlaylistInf
+	var key *PlaylistKey
+	var hasInf, hasTags bool
+	var first = true
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-			seqNum, err = strconv.Atoi(oldStrNum)
-			if err != nil {
-				return
+		// 第一行必须是#EXTM3U (4.3.1.1)
+		if first {
+			if line != "#EXTM3U" {
+				return nil, errors.New("hls: playlist does not start with #EXTM3U")
 			}
 
-			seqNum++
+			first = false
+			continue
+		}
 
-			newStrNum = strconv.Itoa(seqNum)
+		if !strings.HasPrefix(line, "#") {
+			if !hasInf {
+				return nil, errors.New("hls: segment without #EXTINF : " + line)
+			}
 
-			newSeqStr = strings.Replace(v, oldStrNum, newStrNum, 1)
+			inf.Title = line
+			inf.Key = key
+			this.Segments = append(this.Segments, inf)
 
-			ls[i] = newSeqStr
+			inf = PlaylistInf{}
+			hasInf, hasTags = false, false
+			continue
 		}
 
-		if strings.Contains(v, "#EXTINF") {
-			oldContent = append(ls[0:i], ls[i+2:]...)
-			break
+		if !strings.HasPrefix(line, "#EXT") {
+			continue
 		}
-	}
 
-	for _, v := range oldContent {
-		newContent += v + "\n"
-	}
+		tag, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			tag, value = line[:i], line[i+1:]
+		}
 
-	ss := fmt.Sprintf("#EXTINF:%.3f,\n"+
-		"%s\n", inf.Duration, inf.Title)
+		var err error
+		switch tag {
+		case "#EXT-X-VERSION":
+			this.Version, err = strconv.Atoi(value)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			this.Sequence, err = strconv.Atoi(value)
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			this.DiscontinuitySequence, err = strconv.Atoi(value)
+		case "#EXT-X-TARGETDURATION":
+			this.Targetduration, err = strconv.Atoi(value)
+		case "#EXT-X-PLAYLIST-TYPE":
+			this.PlaylistType = value
+		case "#EXT-X-ENDLIST":
+			this.EndList = true
+		case "#EXT-X-DISCONTINUITY":
+			inf.Discontinuity = true
+			hasTags = true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			inf.ProgramDateTime, err = time.Parse(time.RFC3339Nano, value)
+			hasTags = true
+		case "#EXT-X-KEY":
+			key = parseKey(value)
+		case "#EXT-X-PART-INF":
+			this.PartTarget, err = strconv.ParseFloat(ParseAttributes(value)["PART-TARGET"], 64)
+		case "#EXT-X-SERVER-CONTROL":
+			attrs := ParseAttributes(value)
+			this.CanBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+			if attrs["PART-HOLD-BACK"] != "" {
+				this.PartHoldBack, err = strconv.ParseFloat(attrs["PART-HOLD-BACK"], 64)
+			}
+		case "#EXT-X-PART":
+			attrs := ParseAttributes(value)
+			part := PlaylistPart{Uri: attrs["URI"], Independent: attrs["INDEPENDENT"] == "YES"}
+			part.Duration, err = strconv.ParseFloat(attrs["DURATION"], 64)
+			inf.Parts = append(inf.Parts, part)
+			hasTags = true
+		case "#EXT-X-MAP":
+			// 第一个媒体段之前的是整个播放列表的初始化段,之后的是从下一个媒体段开始使用的初始化段
+			if uri := ParseAttributes(value)["URI"]; this.Map == "" && len(this.Segments) == 0 && !hasTags {
+				this.Map = uri
+			} else {
+				inf.Map = uri
+				hasTags = true
+			}
+		case "#EXT-X-PRELOAD-HINT":
+			if attrs := ParseAttributes(value); attrs["TYPE"] == "PART" {
+				this.PreloadHint = attrs["URI"]
+			}
+		case "#EXTINF":
+			// #EXTINF:<duration>,[<title>]
+			if i := strings.Index(value, ","); i != -1 {
+				value = value[:i]
+			}
 
-	newContent += ss
+			inf.Duration, err = strconv.ParseFloat(value, 64)
+			hasInf = true
+		}
 
-	if _, err = tmpFile.WriteString(newContent); err != nil {
-		return
+		if err != nil {
+			return nil, errors.New("hls: invalid " + tag + " : " + err.Error())
+		}
 	}
 
-	if err = tmpFile.Close(); err != nil {
-		return
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
 
-	if err = os.Remove(filename); err != nil {
-		return
+	if first {
+		return nil, errors.New("hls: empty playlist")
 	}
 
-	if err = os.Rename(tmpFilename, filename); err != nil {
-		return
+	if hasTags {
+		inf.Key = key
+		this.Partial = &inf
 	}
 
-	return
+	return this, nil
 }
 
-func (this *Playlist) GetInfCount(filename string) (num int, err error) {
-	var ls []string
-	if ls, err = util.ReadFileLines(filename); err != nil {
-		return
+// METHOD=AES-128,URI="...",IV=0x..., METHOD=NONE的时候返回nil
+func parseKey(value string) *PlaylistKey {
+	attrs := ParseAttributes(value)
+	if attrs["METHOD"] == "" || attrs["METHOD"] == "NONE" {
+		return nil
 	}
 
-	num = 0
-	for _, v := range ls {
-		if strings.Contains(v, "#EXTINF") {
-			num++
-		}
+	return &PlaylistKey{
+		Method: attrs["METHOD"],
+		Uri:    attrs["URI"],
+		IV:     attrs["IV"],
 	}
-
-	return
 }
 
-func (this *Playlist) handleError() {
-	if err := recover(); err != nil {
-		fmt.Println(err)
+// 解析属性列表(4.2), NAME=VALUE,NAME="VALUE",..., 引号中可以有逗号,返回的值去掉了引号
+func ParseAttributes(value string) map[string]string {
+	attrs := make(map[string]string)
+
+	for value != "" {
+		i := strings.Index(value, "=")
+		if i == -1 {
+			break
+		}
+
+		name := strings.TrimSpace(value[:i])
+		value = value[i+1:]
+
+		var v string
+		if strings.HasPrefix(value, "\"") {
+			j := strings.Index(value[1:], "\"")
+			if j == -1 {
+				v, value = value[1:], ""
+			} else {
+				v, value = value[1:j+1], value[j+2:]
+			}
+		} else {
+			j := strings.Index(value, ",")
+			if j == -1 {
+				v, value = value, ""
+			} else {
+				v, value = value[:j], value[j:]
+			}
+		}
+
+		attrs[name] = v
+		value = strings.TrimPrefix(value, ",")
 	}
+
+	return attrs
 }
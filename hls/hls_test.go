@@ -0,0 +1,183 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPlaylist() *Playlist {
+	loc := time.FixedZone("", 8*3600)
+	keyA := &PlaylistKey{Method: HLS_KEY_METHOD_AES_128, Uri: "key-0.key", IV: "0x000102030405060708090a0b0c0d0e0f"}
+	keyB := &PlaylistKey{Method: HLS_KEY_METHOD_AES_128, Uri: "https://keys.example.com/key-1.key"}
+
+	return &Playlist{
+		Version:               7,
+		Sequence:              5,
+		DiscontinuitySequence: 1,
+		Targetduration:        6,
+		PlaylistType:          HLS_PLAYLIST_TYPE_EVENT,
+		PartTarget:            0.2,
+		CanBlockReload:        true,
+		PartHoldBack:          0.6,
+		Map:                   "init.mp4",
+		Segments: []PlaylistInf{
+			{
+				Duration:        5.005,
+				Title:           "test-5.m4s",
+				Key:             keyA,
+				ProgramDateTime: time.Date(2020, 1, 2, 15, 4, 5, 123e6, loc),
+			},
+			{
+				Duration:        4.96,
+				Title:           "test-6.m4s",
+				Key:             keyA,
+				ProgramDateTime: time.Date(2020, 1, 2, 15, 4, 10, 128e6, loc),
+			},
+			{
+				Duration:      2,
+				Title:         "test-7.m4s",
+				Key:           keyB,
+				Discontinuity: true,
+				Map:           "init-7.mp4",
+				Parts: []PlaylistPart{
+					{Duration: 1, Uri: "test-7.0.m4s", Independent: true},
+					{Duration: 1, Uri: "test-7.1.m4s"},
+				},
+			},
+			{
+				Duration: 1.5,
+				Title:    "test-8.m4s",
+			},
+		},
+		Partial: &PlaylistInf{
+			Parts: []PlaylistPart{
+				{Duration: 0.2, Uri: "test-9.0.m4s", Independent: true},
+			},
+		},
+		PreloadHint: "test-9.1.m4s",
+	}
+}
+
+func TestPlaylistRoundTrip(t *testing.T) {
+	p := testPlaylist()
+	data := string(p.Encode())
+
+	for _, tag := range []string{
+		"#EXT-X-VERSION:7\n",
+		"#EXT-X-MEDIA-SEQUENCE:5\n",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:1\n",
+		"#EXT-X-TARGETDURATION:6\n",
+		"#EXT-X-PLAYLIST-TYPE:EVENT\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.600\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.200\n",
+		"#EXT-X-MAP:URI=\"init.mp4\"\n",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"key-0.key\",IV=0x000102030405060708090a0b0c0d0e0f\n",
+		"#EXT-X-PROGRAM-DATE-TIME:2020-01-02T15:04:05.123+08:00\n",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-KEY:METHOD=NONE\n#EXT-X-MAP:URI=\"init-7.mp4\"\n",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/key-1.key\"\n",
+		"#EXT-X-PART:DURATION=1.000,URI=\"test-7.0.m4s\",INDEPENDENT=YES\n",
+		"#EXT-X-KEY:METHOD=NONE\n",
+		"#EXTINF:5.005,\ntest-5.m4s\n",
+		"#EXT-X-PART:DURATION=0.200,URI=\"test-9.0.m4s\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"test-9.1.m4s\"\n",
+	} {
+		if !strings.Contains(data, tag) {
+			t.Errorf("encoded playlist has no %q", tag)
+		}
+	}
+
+	// 同一个密钥只写一次
+	if n := strings.Count(data, "key-0.key"); n != 1 {
+		t.Errorf("key-0.key written %d times", n)
+	}
+
+	parsed, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again := string(parsed.Encode()); again != data {
+		t.Fatalf("Encode(Parse(Encode(p))) differs:\n%s\nwant:\n%s", again, data)
+	}
+
+	if len(parsed.Segments) != len(p.Segments) {
+		t.Fatalf("segments = %d, want %d", len(parsed.Segments), len(p.Segments))
+	}
+
+	for i, inf := range parsed.Segments {
+		want := p.Segments[i]
+		if inf.Title != want.Title || inf.Duration != want.Duration || inf.Discontinuity != want.Discontinuity || inf.Map != want.Map {
+			t.Errorf("segment %d = %+v, want %+v", i, inf, want)
+		}
+
+		if !inf.ProgramDateTime.Equal(want.ProgramDateTime) {
+			t.Errorf("segment %d: program date time = %v, want %v", i, inf.ProgramDateTime, want.ProgramDateTime)
+		}
+
+		if (inf.Key == nil) != (want.Key == nil) || (inf.Key != nil && *inf.Key != *want.Key) {
+			t.Errorf("segment %d: key = %+v, want %+v", i, inf.Key, want.Key)
+		}
+
+		if len(inf.Parts) != len(want.Parts) {
+			t.Errorf("segment %d: parts = %d, want %d", i, len(inf.Parts), len(want.Parts))
+		}
+	}
+
+	if parsed.Segments[0].Key != parsed.Segments[1].Key {
+		t.Error("segments with the same #EXT-X-KEY should share the key")
+	}
+
+	if parsed.Partial == nil || len(parsed.Partial.Parts) != 1 || parsed.PreloadHint != p.PreloadHint || parsed.Map != p.Map {
+		t.Errorf("partial = %+v, preload hint = %q, map = %q", parsed.Partial, parsed.PreloadHint, parsed.Map)
+	}
+}
+
+func TestPlaylistRoundTripVOD(t *testing.T) {
+	p := testPlaylist()
+	p.PlaylistType = HLS_PLAYLIST_TYPE_VOD
+	p.Partial = nil
+	p.PreloadHint = ""
+	p.EndList = true
+
+	data := p.Encode()
+	if !strings.HasSuffix(string(data), "test-8.m4s\n#EXT-X-ENDLIST\n") {
+		t.Errorf("VOD playlist does not end with #EXT-X-ENDLIST:\n%s", data)
+	}
+
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !parsed.EndList || parsed.PlaylistType != HLS_PLAYLIST_TYPE_VOD || parsed.Partial != nil {
+		t.Errorf("end list = %v, playlist type = %q, partial = %+v", parsed.EndList, parsed.PlaylistType, parsed.Partial)
+	}
+
+	if string(parsed.Encode()) != string(data) {
+		t.Errorf("Encode(Parse(Encode(p))) differs:\n%s\nwant:\n%s", parsed.Encode(), data)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"#EXT-X-VERSION:3\n",
+		"#EXTM3U\n#EXT-X-TARGETDURATION:x\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%q): want error", data)
+		}
+	}
+}
+
+func TestPlaylistAppend(t *testing.T) {
+	p := &Playlist{Version: 3, Targetduration: 4}
+	p.Append(PlaylistInf{Duration: 3.9, Title: "test-0.ts"})
+	p.Append(PlaylistInf{Duration: 4.2, Title: "test-1.ts"})
+
+	// 目标时长不随媒体段改变
+	if p.Targetduration != 4 || len(p.Segments) != 2 {
+		t.Errorf("target duration = %d, segments = %d", p.Targetduration, len(p.Segments))
+	}
+}
@@ -0,0 +1,128 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 主播放列表(Master Playlist),列出同一个内容不同码率的版本(Variant Stream),播放器根据带宽选择 (4.3.4)
+type MasterPlaylist struct {
+	Version  int             // 协议版本号 (4.3.1.2)
+	Variants []VariantStream // 每个版本一个#EXT-X-STREAM-INF
+}
+
+// #EXT-X-STREAM-INF (4.3.4.2)
+type VariantStream struct {
+	Bandwidth        int    // 峰值码率(bit/s),必须有
+	AverageBandwidth int    // 平均码率(bit/s),0表示不写
+	Resolution       string // 宽x高,例如 1280x720,为空表示不写
+	Codecs           string // 例如 avc1.64001f,mp4a.40.2,为空表示不写
+	Uri              string // 这个版本的媒体播放列表的URI
+}
+
+// 生成主播放列表的内容
+func (this *MasterPlaylist) Encode() []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "#EXTM3U\n"+
+		"#EXT-X-VERSION:%d\n", this.Version)
+
+	for _, v := range this.Variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+
+		if v.AverageBandwidth > 0 {
+			fmt.Fprintf(&b, ",AVERAGE-BANDWIDTH=%d", v.AverageBandwidth)
+		}
+
+		if v.Resolution != "" {
+			b.WriteString(",RESOLUTION=" + v.Resolution)
+		}
+
+		if v.Codecs != "" {
+			b.WriteString(",CODECS=\"" + v.Codecs + "\"")
+		}
+
+		b.WriteString("\n" + v.Uri + "\n")
+	}
+
+	return b.Bytes()
+}
+
+// 解析主播放列表,只解析#EXT-X-VERSION和#EXT-X-STREAM-INF
+func ParseMaster(data []byte) (*MasterPlaylist, error) {
+	this := &MasterPlaylist{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	var v VariantStream
+	var hasStreamInf bool
+	var first = true
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if first {
+			if line != "#EXTM3U" {
+				return nil, errors.New("hls: playlist does not start with #EXTM3U")
+			}
+
+			first = false
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			if !hasStreamInf {
+				return nil, errors.New("hls: variant without #EXT-X-STREAM-INF : " + line)
+			}
+
+			v.Uri = line
+			this.Variants = append(this.Variants, v)
+
+			v = VariantStream{}
+			hasStreamInf = false
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-VERSION:"):
+			this.Version, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:"))
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := ParseAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			if v.Bandwidth, err = strconv.Atoi(attrs["BANDWIDTH"]); err != nil {
+				break
+			}
+
+			if attrs["AVERAGE-BANDWIDTH"] != "" {
+				if v.AverageBandwidth, err = strconv.Atoi(attrs["AVERAGE-BANDWIDTH"]); err != nil {
+					break
+				}
+			}
+
+			v.Resolution = attrs["RESOLUTION"]
+			v.Codecs = attrs["CODECS"]
+			hasStreamInf = true
+		}
+
+		if err != nil {
+			return nil, errors.New("hls: invalid " + line + " : " + err.Error())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if first {
+		return nil, errors.New("hls: empty playlist")
+	}
+
+	return this, nil
+}
@@ -6,7 +6,11 @@ import (
 	//"fmt"
 	//"os"
 	//"./avformat"
+	"context"
 	"github.com/onedss/gortmp/config"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -16,14 +20,20 @@ func main() {
 		return
 	}
 
+	// 收到 SIGINT/SIGTERM 之后优雅地关闭服务器
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		cancel()
+	}()
+
 	l := ":1935"
-	err = rtmp.ListenAndServe(l)
-	if err != nil {
+	err = rtmp.NewServer(l).Serve(ctx)
+	if err != nil && err != rtmp.ErrServerClosed {
 		panic(err)
 	}
-
-	select {}
-
 }
 
 func InitAppConfig() (err error) {
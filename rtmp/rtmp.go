@@ -54,5 +54,5 @@ const (
 	RTMP_CSID_COMMAND = 0x03
 	RTMP_CSID_AUDIO   = 0x06
 	RTMP_CSID_DATA    = 0x05
-	RTMP_CSID_VIDEO   = 0x05
+	RTMP_CSID_VIDEO   = 0x07
 )
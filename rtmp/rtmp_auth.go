@@ -0,0 +1,104 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// 鉴权.
+// 客户端connect,发布,播放的时候,服务器调用Authenticator检查客户端是否有权限,返回错误表示拒绝.
+// connect被拒绝回复 NetConnection.Connect.Rejected,发布被拒绝回复 NetStream.Publish.BadName,播放被拒绝回复 NetStream.Play.Failed.
+// 鉴权需要的信息(tcUrl,应用名和流名称后面的参数)可以通过 RtmpNetConnection 和 RtmpNetStream 的方法得到.
+type Authenticator interface {
+	Connect(c *RtmpNetConnection) error // 客户端connect
+	Publish(s *RtmpNetStream) error     // 发布流
+	Play(s *RtmpNetStream) error        // 播放流
+}
+
+// 发布,播放失败的时候,回复给客户端的状态
+type StatusError struct {
+	Code        string // 例如 NetStream.Publish.BadName
+	Description string // 失败的原因
+}
+
+func newStatusError(code, description string) *StatusError {
+	return &StatusError{Code: code, Description: description}
+}
+
+func (e *StatusError) Error() string {
+	return e.Code + " : " + e.Description
+}
+
+// 错误对应的状态, 不是StatusError的时候使用默认的状态码
+func errorStatus(err error, code string) (string, string) {
+	if e, ok := err.(*StatusError); ok {
+		return e.Code, e.Description
+	}
+
+	return code, err.Error()
+}
+
+// HMAC签名鉴权.
+// 推流(或者播放)地址带上过期时间和签名: rtmp://host/app/stream?expires=过期时间(unix秒)&sign=签名
+// 签名 = hex(HMAC-SHA256(密钥, 流路径 + ":" + 过期时间)), 流路径是 app/stream.
+// 参数也可以放在应用名的后面: rtmp://host/app?expires=...&sign=.../stream
+type HMACAuthenticator struct {
+	Secret    []byte // 密钥
+	CheckPlay bool   // 播放是否也需要签名
+}
+
+func NewHMACAuthenticator(secret string, checkPlay bool) *HMACAuthenticator {
+	return &HMACAuthenticator{
+		Secret:    []byte(secret),
+		CheckPlay: checkPlay}
+}
+
+// 生成流路径的签名
+func (a *HMACAuthenticator) Sign(streamPath string, expires int64) string {
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(streamPath + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *HMACAuthenticator) Connect(c *RtmpNetConnection) error {
+	return nil
+}
+
+func (a *HMACAuthenticator) Publish(s *RtmpNetStream) error {
+	return a.verify(s)
+}
+
+func (a *HMACAuthenticator) Play(s *RtmpNetStream) error {
+	if !a.CheckPlay {
+		return nil
+	}
+
+	return a.verify(s)
+}
+
+func (a *HMACAuthenticator) verify(s *RtmpNetStream) error {
+	expires, err := strconv.ParseInt(s.Query("expires"), 10, 64)
+	if err != nil {
+		return errors.New("invalid expires")
+	}
+
+	if time.Now().Unix() > expires {
+		return errors.New("token expired")
+	}
+
+	sign, err := hex.DecodeString(s.Query("sign"))
+	if err != nil {
+		return errors.New("invalid sign")
+	}
+
+	expected, _ := hex.DecodeString(a.Sign(s.streamPath, expires))
+	if !hmac.Equal(sign, expected) {
+		return errors.New("invalid sign")
+	}
+
+	return nil
+}
@@ -1,82 +1,198 @@
 package rtmp
 
 import (
-	//"../config"
+	"github.com/onedss/gortmp/config"
 	//"../util"
 	"fmt"
 	//"strings"
 	//"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	broadcasts = make(map[string]*Broadcast)
-)
-
 // 一个Broadcast代表着服务器已经在发布一个流,如果有多个客户端推流上来,那么服务器会有多个Broadcast.
 // 客户端订阅的时候,会选择订阅哪个Broadcast.然后通过Broadcast将订阅者和发布者联系起来.
 
 type Broadcast struct {
-	lock       *sync.Mutex               // lock
-	publisher  *RtmpNetStream            // 发布者
-	subscriber map[string]*RtmpNetStream // 订阅者
-	streamPath string                    // 发布者发布的流路径
-	control    chan interface{}          // 订阅者的控制,包括play,stop...
+	lock       *sync.Mutex            // guards stopped
+	stopped    bool                   // 广播的goroutine已经退出,不再接受新的订阅者
+	publisher  *RtmpNetStream         // 发布者
+	subscriber map[string]*Subscriber // 订阅者
+	streamPath string                 // 发布者发布的流路径
+	control    chan interface{}       // 订阅者的控制,包括play,stop...
+	gop        *GopCache              // 最近的GOP缓存,新的订阅者先收到缓存的GOP
+	metaData   *AVPacket              // 发布者最新的onMetaData,新的订阅者先收到元数据
+	registry   *StreamRegistry        // 广播所在的注册表
+	relays     []*Relay               // 转推到上游服务器,启动之后不再改变
+	done       chan struct{}          // 广播的goroutine退出之后关闭
+	idle       time.Duration          // 收不到音视频包的超时时间,超时之后停止广播,0表示不超时
+}
+
+// 订阅者加入广播的请求.广播的goroutine添加订阅者之后回复true,广播已经结束的时候回复false
+type joinRequest struct {
+	sink   subscriberSink
+	joined chan bool
 }
 
 type AVChannel struct {
 	id    string
 	audio chan *AVPacket
 	video chan *AVPacket
+	data  chan *AVPacket
 }
 
-func find_broadcast(path string) (*Broadcast, bool) {
-	v, ok := broadcasts[path]
-	return v, ok
+func find_broadcast(registry *StreamRegistry, path string) (*Broadcast, bool) {
+	return registry.Find(path)
 }
 
-func start_broadcast(publisher *RtmpNetStream, vl, al int) {
+// 在注册表中注册广播并启动,流路径已经存在的时候返回错误
+func start_broadcast(registry *StreamRegistry, publisher *RtmpNetStream, vl, al int) error {
 	av := &AVChannel{
 		id:    publisher.conn.remoteAddr,
 		audio: make(chan *AVPacket, al), // 开辟一个音频通道
-		video: make(chan *AVPacket, vl)} // 开辟一个视频通道
+		video: make(chan *AVPacket, vl), // 开辟一个视频通道
+		data:  make(chan *AVPacket, 5)}  // 开辟一个数据通道
+
+	b := &Broadcast{
+		streamPath: publisher.streamPath,            // 发布者的流路径
+		lock:       new(sync.Mutex),                 // lock
+		publisher:  publisher,                       // 发布者信息, *RtmpNetStream
+		subscriber: make(map[string]*Subscriber, 0), // 订阅者信息, map[string]*Subscriber
+		control:    make(chan interface{}, 10),      // 订阅者的控制
+		gop:        newGopCache(config.GopCacheNum), // GOP缓存
+		metaData:   publisher.metaData,              // 元数据
+		registry:   registry,                        // 注册表
+		done:       make(chan struct{})}             // 广播结束
+
+	if publisher.conn.server != nil {
+		b.idle = publisher.conn.server.IdleTimeout // 空闲超时
+	}
+
+	// 应用配置了转推,每个上游服务器一个转推.边缘模式从源站拉的流不转推.
+	app := strings.Trim(publisher.conn.appName, "/")
+	if publisher.edge == nil {
+		for _, target := range config.RelayTargets[app] {
+			b.relays = append(b.relays, newRelay(b, relayURL(target, strings.TrimPrefix(b.streamPath, app+"/"))))
+		}
+	}
+
+	if err := registry.Register(b); err != nil { // 添加广播
+		return err
+	}
 
 	publisher.AttachAudio(av.audio) // 发布者发布的音频全部流入这个通道
 	publisher.AttachVideo(av.video) // 发布者发布的视频全部流入这个通道
+	publisher.AttachData(av.data)   // 发布者发布的数据消息全部流入这个通道
+	publisher.broadcast = b         // 广播结束之后,发布者不再阻塞在通道上
 
-	b := &Broadcast{
-		streamPath: publisher.streamPath,               // 发布者的流路径
-		lock:       new(sync.Mutex),                    // lock
-		publisher:  publisher,                          // 发布者信息, *RtmpNetStream
-		subscriber: make(map[string]*RtmpNetStream, 0), // 订阅者信息, map[string]*RtmpNetStream
-		control:    make(chan interface{}, 10)}         // 订阅者的控制
+	b.start()
 
-	broadcasts[publisher.streamPath] = b // 添加广播
+	for _, r := range b.relays {
+		r.start()
+	}
 
-	b.start()
+	return nil
 }
 
-func (b *Broadcast) addSubscriber(s *RtmpNetStream) {
+func (b *Broadcast) addSubscriber(s *RtmpNetStream) bool {
 	// Broadcast 其实就是一个发布者发布的广播.
 	// RtmpNetStream 其实就是一个订阅者.
-	// broadcasts 就是装载着所有发布的广播.
+	// StreamRegistry 就是装载着所有发布的广播.
 	// 有可能有多个订阅者订阅同一个广播.因此将订阅者和发布者的信息相关联起来.在后面发送数据给订阅者的时候,需要拿出发布者数据Tag.
 
 	// 订阅者s订阅的广播是b
 	// 广播b接受订阅者s的控制
 	s.broadcast = b
-	b.control <- s // 这里会添加订阅者
+	return b.join(s) // 这里会添加订阅者
+}
+
+// 加入广播,返回是否加入成功.
+// 广播已经结束的时候返回false(例如边缘模式最后一个订阅者刚刚离开,停止了拉流),订阅者不会收到音视频,需要重新查找广播
+func (b *Broadcast) join(c subscriberSink) bool {
+	req := &joinRequest{sink: c, joined: make(chan bool, 1)}
+
+	// 广播的goroutine退出之后在同一个锁里面设置stopped,并回复控制通道中剩下的加入请求,加入请求不会丢失
+	b.lock.Lock()
+	if b.stopped {
+		b.lock.Unlock()
+		return false
+	}
+
+	select {
+	case b.control <- req:
+	case <-b.done:
+		b.lock.Unlock()
+		return false
+	}
+	b.lock.Unlock()
+
+	return <-req.joined
 }
 
 func (b *Broadcast) removeSubscriber(s *RtmpNetStream) {
 	s.closed = true
-	b.control <- s
+	b.send(s)
+}
+
+// 发送控制消息给广播的goroutine,广播已经结束的时候直接返回
+func (b *Broadcast) send(obj interface{}) {
+	select {
+	case b.control <- obj:
+	case <-b.done:
+	}
+}
+
+// 所有上游服务器的转推状态
+func (b *Broadcast) RelayStatus() []RelayStatus {
+	status := make([]RelayStatus, 0, len(b.relays))
+	for _, r := range b.relays {
+		status = append(status, r.Status())
+	}
+
+	return status
+}
+
+func (b *Broadcast) stopRelays() {
+	for _, r := range b.relays {
+		r.stop()
+	}
 }
 
 func (b *Broadcast) stop() {
-	delete(broadcasts, b.streamPath)
-	b.control <- "stop"
+	b.registry.Unregister(b)
+	b.send("stop")
+}
+
+// 服务器关闭,通知订阅者播放结束(NetStream.Play.Stop),通知发布者取消发布(NetStream.Unpublish.Success),然后关闭连接.
+// 边缘模式从源站拉的流只关闭到源站的连接
+func (b *Broadcast) shutdown() {
+	b.send("shutdown")
+}
+
+// 关闭所有的订阅者,notify为true的时候,等订阅者发送完队列中的包之后,发送NetStream.Play.Stop
+func (b *Broadcast) closeSubscribers(notify bool) {
+	for k, ss := range b.subscriber { // k == string, ss = Subscriber
+		delete(b.subscriber, k) // 删除订阅者
+		ss.stop()               // 停止发送
+
+		if notify {
+			<-ss.exited
+		}
+
+		ss.sink.closeSubscriber(notify)
+	}
+}
+
+// 新的订阅者加入时,先发送元数据,再发送缓存的GOP.
+// SendVideo()会在发送第一个关键帧之前发送AVC sequence header,SendAudio()也会先发送AAC sequence header.
+func (b *Broadcast) snapshot() []*AVPacket {
+	var pkts []*AVPacket
+	if b.metaData != nil {
+		pkts = append(pkts, b.metaData)
+	}
+
+	return append(pkts, b.gop.packets()...)
 }
 
 func (b *Broadcast) start() {
@@ -86,11 +202,39 @@ func (b *Broadcast) start() {
 				fmt.Println(e)
 			}
 
+			b.stopRelays()
+			b.gop.clear()
+
+			// 写完最后一个HLS切片,结束播放列表
+			if err := b.publisher.closeFile(); err != nil {
+				fmt.Println("close file error :", err)
+			} else if h, ok := b.publisher.serverHandler.(RecordHandler); ok && b.publisher.rtmpFile != nil && b.publisher.rtmpFile.hls_m3u8_name != "" {
+				h.OnRecordDone(b.publisher, b.publisher.rtmpFile.hls_m3u8_name)
+			}
+
+			close(b.done)
+
+			b.lock.Lock()
+			b.stopped = true
+			b.lock.Unlock()
+
+			// 广播结束之前已经发送的加入请求,回复加入失败
+			for drained := false; !drained; {
+				select {
+				case obj := <-b.control:
+					if req, ok := obj.(*joinRequest); ok {
+						req.joined <- false
+					}
+				default:
+					drained = true
+				}
+			}
+
 			fmt.Println("Broadcast :" + b.streamPath + " stopped")
 		}()
 
-		// begintime --> server.go
-		d := time.Now().Sub(begintime)
+		// 发布者的连接建立到开始广播的间隔
+		d := time.Now().Sub(b.publisher.conn.beginTime)
 		fmt.Printf("------------Intreval Time :%v ------------\n", d)
 
 		// Implement io.Writer. Write the specified file format.
@@ -114,19 +258,28 @@ func (b *Broadcast) start() {
 		b.publisher.vstreamToFile = true
 		b.publisher.rtmpFile = newRtmpFile()
 
+		// 音视频包放入每个订阅者的发送队列,由订阅者自己的goroutine发送,发送之前会拷贝一份.
 		// SendAudio(),函数接收的参数是(audio *AVPacket)
 		// 如果不拷贝一份数据传递过去,那么如果在SendAudio()函数内部,如果改变了audio这个参数的值,将会影响数据的正确性
 		for {
+			var idle <-chan time.Time
+			if b.idle > 0 {
+				idle = time.After(b.idle)
+			}
+
 			select {
 			case amsg := <-b.publisher.audiochan: // 取出发布者中的音频数据
 				{
-					for _, s := range b.subscriber { // 订阅者
-						err := s.SendAudio(amsg.Clone()) // 给订阅者发送音频数据
-						if err != nil {
-							s.serverHandler.OnError(s, err)
-						}
+					for _, sub := range b.subscriber { // 订阅者
+						sub.push(amsg) // 放入订阅者的发送队列
 					}
 
+					for _, r := range b.relays { // 上游服务器
+						r.push(amsg) // 放入转推的发送队列
+					}
+
+					b.gop.push(amsg)
+
 					// write file
 					if b.publisher.astreamToFile {
 						err := b.publisher.WriteAudio(nil, amsg.Clone(), RTMP_FILE_TYPE_HLS_TS)
@@ -138,13 +291,16 @@ func (b *Broadcast) start() {
 				}
 			case vmsg := <-b.publisher.videochan: // 取出发布者中的视频数据
 				{
-					for _, s := range b.subscriber { // 订阅者
-						err := s.SendVideo(vmsg.Clone()) // 给订阅者发送视频数据
-						if err != nil {
-							s.serverHandler.OnError(s, err)
-						}
+					for _, sub := range b.subscriber { // 订阅者
+						sub.push(vmsg) // 放入订阅者的发送队列
+					}
+
+					for _, r := range b.relays { // 上游服务器
+						r.push(vmsg) // 放入转推的发送队列
 					}
 
+					b.gop.push(vmsg)
+
 					// write file
 					if b.publisher.vstreamToFile {
 						err := b.publisher.WriteVideo(nil, vmsg.Clone(), RTMP_FILE_TYPE_HLS_TS)
@@ -154,27 +310,70 @@ func (b *Broadcast) start() {
 						}
 					}
 				}
+			case dmsg := <-b.publisher.datachan: // 取出发布者中的数据消息(onMetaData, onTextData, onCuePoint...)
+				{
+					if dataMessageName(dmsg.Payload) == "onMetaData" {
+						b.metaData = dmsg // 更新元数据,之后加入的订阅者收到的是最新的元数据
+					}
+
+					for _, sub := range b.subscriber { // 订阅者
+						sub.push(dmsg) // 放入订阅者的发送队列
+					}
+
+					for _, r := range b.relays { // 上游服务器
+						r.push(dmsg) // 放入转推的发送队列
+					}
+				}
 			case obj := <-b.control: // 订阅者的控制.例如订阅者开始播放,或者取消播放都会到这里先处理.会打印消费者信息.
 				{
-					if c, ok := obj.(*RtmpNetStream); ok {
-						if c.closed {
-							delete(b.subscriber, c.conn.remoteAddr)
-							fmt.Println("Subscriber Closed, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber))
-						} else {
-							b.subscriber[c.conn.remoteAddr] = c                                                           // 添加订阅者
-							fmt.Println("Subscriber Open, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber)) // 打印信息
+					if req, ok := obj.(*joinRequest); ok {
+						sub := newSubscriber(req.sink, config.SubscriberQueueSize, config.SubscriberOverflowPolicy, b.snapshot())
+						b.subscriber[req.sink.subscriberID()] = sub                                                   // 添加订阅者
+						fmt.Println("Subscriber Open, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber)) // 打印信息
+						sub.start()                                                                                   // 先发送缓存的GOP,再发送发送队列中的包
+						req.joined <- true
+					} else if c, ok := obj.(subscriberSink); ok && c.subscriberClosed() {
+						if sub, ok := b.subscriber[c.subscriberID()]; ok && sub.sink == c {
+							sub.stop()
+							delete(b.subscriber, c.subscriberID())
+							fmt.Println("Subscriber Closed, Broadcast :", b.streamPath, "\nSubscribe :", len(b.subscriber), "\nDropped :", sub.Dropped())
+						}
+
+						// 边缘模式,最后一个订阅者离开之后停止拉流,广播结束.之后的订阅者会重新从源站拉流.
+						// 拉流的订阅者在加入广播之前就关闭的时候,也是在这里停止拉流.
+						// 注销和退出之后,正在加入的订阅者join()返回false,重新查找广播
+						if len(b.subscriber) == 0 && b.publisher.edge != nil {
+							b.registry.Unregister(b)
+							b.publisher.edge.Close()
+							return
 						}
 					} else if v, ok := obj.(string); ok && "stop" == v {
-						for k, ss := range b.subscriber { // k == string, ss = RtmpNetStream
-							delete(b.subscriber, k) // 删除订阅者
-							ss.Close()              // 关闭RtmpNetStream
+						b.closeSubscribers(false)
+						return
+					} else if ok && "shutdown" == v {
+						b.registry.Unregister(b) // 先注销,关闭连接的时候不会再发送控制消息给广播
+						b.closeSubscribers(true)
+
+						// 边缘模式的发布者是连接源站的客户端,不发送取消发布的通知,直接关闭
+						if b.publisher.edge != nil {
+							b.publisher.edge.Close()
+							return
+						}
+
+						prmdUnpublish := newPublishResponseMessageData(b.publisher.conn.streamID, NetStream_Unpublish_Success, Level_Status)
+						if err := sendMessage(b.publisher.conn, SEND_UNPUBLISH_RESPONSE_MESSAGE, prmdUnpublish); err != nil {
+							fmt.Println("send unpublish error :", err)
 						}
+
+						b.publisher.Close()
+						return
 					}
 				}
-			case <-time.After(time.Second * 100):
+			case <-idle:
 				{
-					fmt.Println("Broadcast " + b.streamPath + " Video | Audio Buffer Empty,Timeout 100s")
-					b.stop()
+					fmt.Println("Broadcast "+b.streamPath+" Video | Audio Buffer Empty,Timeout", b.idle)
+					b.registry.Unregister(b)
+					b.closeSubscribers(false)
 					b.publisher.Close()
 					return
 				}
@@ -0,0 +1,175 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/config"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 读出下一个音视频包
+func readTestPacket(t *testing.T, c *RtmpClient) *AVPacket {
+	t.Helper()
+
+	select {
+	case pkt, ok := <-c.ReadChan():
+		if !ok {
+			t.Fatal("player closed :", c.Err())
+		}
+
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a packet")
+	}
+
+	return nil
+}
+
+// 等发布者发布的视频到达广播,广播缓存了GOP
+func waitTestBroadcast(t *testing.T, s *Server, streamPath string) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		if b, ok := s.Streams.Find(streamPath); ok {
+			if v, _ := b.publisher.sequenceHeaders(); v != nil {
+				break
+			}
+		}
+
+		if i == 100 {
+			t.Fatal("timeout waiting for the broadcast")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+}
+
+// 几个播放者同时从缓存的GOP开始播放,每个播放者都收到从0开始的sequence header和关键帧.
+// 之后发布者才开始发布音频,播放者在第一个音频包之前收到AAC sequence header
+func TestBroadcastSequenceHeaders(t *testing.T) {
+	defer func(n int) { config.GopCacheNum = n }(config.GopCacheNum)
+	config.GopCacheNum = 1
+
+	s := &Server{Addr: freeAddr(t)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	writeTestH264(pub, 10)
+	waitTestBroadcast(t, s, "live/test")
+
+	players := make([]*RtmpClient, 4)
+	var wg sync.WaitGroup
+	for i := range players {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			players[i], _ = DialPlay("rtmp://" + s.Addr + "/live/test")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, player := range players {
+		if player == nil {
+			t.Fatalf("player %d: dial failed", i)
+		}
+		defer player.Close()
+
+		seq := readTestPacket(t, player)
+		if seq.Type != RTMP_MSG_VIDEO || seq.Payload[1] != 0 || seq.Timestamp != 0 {
+			t.Fatalf("player %d: first packet type = %d, payload = % x, timestamp = %d", i, seq.Type, seq.Payload[:2], seq.Timestamp)
+		}
+
+		key := readTestPacket(t, player)
+		if !key.isKeyFrame() || key.Payload[1] != 1 || key.Timestamp != 0 {
+			t.Fatalf("player %d: second packet payload = % x, timestamp = %d", i, key.Payload[:2], key.Timestamp)
+		}
+	}
+
+	// AAC sequence header, 然后是一个音频包
+	pub.WritePacket(&AVPacket{Type: RTMP_MSG_AUDIO, Timestamp: 400, Payload: []byte{0xaf, 0, 0x12, 0x10}})
+	pub.WritePacket(&AVPacket{Type: RTMP_MSG_AUDIO, Timestamp: 420, Payload: []byte{0xaf, 1, 0x21, 0x00}})
+
+	for i, player := range players {
+		for {
+			pkt := readTestPacket(t, player)
+			if pkt.Type != RTMP_MSG_AUDIO {
+				continue
+			}
+
+			if pkt.Payload[1] != 0 {
+				t.Fatalf("player %d: first audio packet payload = % x, want AAC sequence header", i, pkt.Payload)
+			}
+
+			if pkt = readTestPacket(t, player); pkt.Type != RTMP_MSG_AUDIO || pkt.Payload[1] != 1 {
+				t.Fatalf("player %d: second audio packet type = %d, payload = % x", i, pkt.Type, pkt.Payload)
+			}
+
+			break
+		}
+	}
+}
+
+// 播放者先收到NetStream.Play.Start,然后才收到缓存的GOP
+func TestPlayStartBeforeMedia(t *testing.T) {
+	defer func(n int) { config.GopCacheNum = n }(config.GopCacheNum)
+	config.GopCacheNum = 1
+
+	s := &Server{Addr: freeAddr(t)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	writeTestH264(pub, 10)
+	waitTestBroadcast(t, s, "live/test")
+
+	// 不启动读消息的goroutine,setup()返回的时候,在NetStream.Play.Start之前收到的音视频包都在pending中
+	nc, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &RtmpClient{
+		conn:       newRtmpNetConnect(nc, nil),
+		tcUrl:      "rtmp://" + s.Addr + "/live",
+		streamName: "test",
+		mode:       RTMP_CLIENT_MODE_PLAY,
+		timestamps: make(map[uint32]uint32)}
+
+	if err = c.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.pending) != 0 {
+		t.Fatalf("%d packets before NetStream.Play.Start", len(c.pending))
+	}
+
+	for {
+		msg, err := recvMessage(c.conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pkt := c.toAVPacket(msg); pkt != nil && pkt.Type == RTMP_MSG_VIDEO {
+			if pkt.Payload[1] != 0 {
+				t.Errorf("first video packet payload = % x, want AVC sequence header", pkt.Payload[:2])
+			}
+
+			break
+		}
+	}
+}
@@ -69,6 +69,24 @@ type ChunkExtendedTimestamp struct {
 	ExtendTimestamp uint32 `json:",omitempty"` // 标识该字段的数据可忽略
 }
 
+// 计算收到的消息的绝对时间戳,timestamps保存每个块流上一个消息的绝对时间戳.
+// 块类型为0的时候是绝对时间戳,其他的是与这个块流上一个消息的时间戳差值.
+func chunkTimestamp(timestamps map[uint32]uint32, head *RtmpHeader) uint32 {
+	timestamp := head.ChunkMessgaeHeader.Timestamp
+	if timestamp == 0xffffff {
+		timestamp = head.ChunkExtendedTimestamp.ExtendTimestamp
+	}
+
+	csid := head.ChunkBasicHeader.ChunkStreamID
+	if head.ChunkBasicHeader.ChunkType == 0 {
+		timestamps[csid] = timestamp
+	} else {
+		timestamps[csid] += timestamp
+	}
+
+	return timestamps[csid]
+}
+
 // ChunkBasicHeader会决定ChunkMessgaeHeader,ChunkMessgaeHeader有4种(0,3,7,11 Bytes),因此可能有4种头.
 
 // 1  -> ChunkBasicHeader(1) + ChunkMessgaeHeader(0)
@@ -101,7 +119,7 @@ func encodeChunk12(head *RtmpHeader, payload []byte, size int) (mark []byte, nee
 
 	if head.ChunkMessgaeHeader.Timestamp == 0xffffff {
 		b := make([]byte, 4)
-		util.LittleEndian.PutUint32(b, head.ChunkExtendedTimestamp.ExtendTimestamp)
+		util.BigEndian.PutUint32(b, head.ChunkExtendedTimestamp.ExtendTimestamp)
 		buf.Write(b)
 	}
 
@@ -0,0 +1,479 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RTMP客户端.
+// 推流: DialPublish("rtmp://host/app/stream") -> 握手 -> connect -> createStream -> publish -> 写音视频包
+// 拉流: DialPlay("rtmp://host/app/stream")    -> 握手 -> connect -> createStream -> play    -> 读音视频包
+// rtmps://host/app/stream 先完成TLS握手,TLS配置见ClientTLSConfig.
+//
+// 音视频包(AVPacket)的时间戳都是绝对时间戳(毫秒),Type为RTMP_MSG_AUDIO, RTMP_MSG_VIDEO或者RTMP_MSG_AMF0_METADATA.
+
+const (
+	RTMP_CLIENT_MODE_PUBLISH = 1 // 推流
+	RTMP_CLIENT_MODE_PLAY    = 2 // 拉流
+
+	RTMP_CLIENT_CHUNK_SIZE = 4096             // 推流时发送的块大小
+	RTMP_CLIENT_TIMEOUT    = time.Second * 10 // 连接,握手,connect,createStream,publish/play的超时时间
+)
+
+type RtmpClient struct {
+	conn       *RtmpNetConnection
+	tcUrl      string            // rtmp://host:port/app
+	streamName string            // stream
+	mode       int               // 推流或者拉流
+	in         chan *AVPacket    // 推流,写入的音视频包
+	out        chan *AVPacket    // 拉流,读出的音视频包
+	pending    []*AVPacket       // 拉流,在收到NetStream.Play.Start之前收到的音视频包
+	timestamps map[uint32]uint32 // 拉流,每个块流上一个消息的绝对时间戳
+	wlock      sync.Mutex        // guards the following
+	sendTimes  map[uint32]uint32 // 推流,每个块流上一个音视频包的绝对时间戳,还没有发送过的块流没有记录
+	once       sync.Once         // 只关闭一次
+	done       chan struct{}     // 关闭
+	err        error             // 关闭的原因
+}
+
+// 连接服务器并推流
+func DialPublish(rawurl string) (*RtmpClient, error) {
+	return dial(rawurl, RTMP_CLIENT_MODE_PUBLISH)
+}
+
+// 连接服务器并拉流
+func DialPlay(rawurl string) (*RtmpClient, error) {
+	return dial(rawurl, RTMP_CLIENT_MODE_PLAY)
+}
+
+func dial(rawurl string, mode int) (c *RtmpClient, err error) {
+	host, tcUrl, streamName, err := parseRtmpURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	var nc net.Conn
+	if strings.HasPrefix(tcUrl, "rtmps://") {
+		config := &tls.Config{}
+		if ClientTLSConfig != nil {
+			config = ClientTLSConfig.Clone()
+		}
+
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(host)
+		}
+
+		nc, err = tls.DialWithDialer(&net.Dialer{Timeout: RTMP_CLIENT_TIMEOUT}, "tcp", host, config)
+	} else {
+		nc, err = net.DialTimeout("tcp", host, RTMP_CLIENT_TIMEOUT)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c = &RtmpClient{
+		conn:       newRtmpNetConnect(nc, nil),
+		tcUrl:      tcUrl,
+		streamName: streamName,
+		mode:       mode,
+		in:         make(chan *AVPacket, 64),
+		out:        make(chan *AVPacket, 64),
+		timestamps: make(map[uint32]uint32),
+		sendTimes:  make(map[uint32]uint32),
+		done:       make(chan struct{})}
+
+	nc.SetDeadline(time.Now().Add(RTMP_CLIENT_TIMEOUT))
+
+	if err = c.setup(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+
+	// 之后每写一个块都设置写超时,服务器不再读数据的时候,发送音视频的goroutine不会一直阻塞
+	c.conn.writeTimeout = RTMP_CLIENT_TIMEOUT
+
+	go c.readLoop()
+
+	if mode == RTMP_CLIENT_MODE_PUBLISH {
+		go c.writeLoop()
+	}
+
+	return c, nil
+}
+
+func (c *RtmpClient) setup() error {
+	if err := client_handshake(c.conn.brw); err != nil {
+		return errors.New("rtmp client handshake error : " + err.Error())
+	}
+
+	if err := c.conn.Connect(c.tcUrl); err != nil {
+		return err
+	}
+
+	if c.mode == RTMP_CLIENT_MODE_PUBLISH {
+		if err := sendMessage(c.conn, SEND_CHUNK_SIZE_MESSAGE, uint32(RTMP_CLIENT_CHUNK_SIZE)); err != nil {
+			return err
+		}
+
+		c.conn.writeChunkSize = RTMP_CLIENT_CHUNK_SIZE
+	}
+
+	// createStream, 服务器响应的 _result 中带着流ID
+	tid := c.conn.nextTransactionID()
+	if err := sendMessage(c.conn, SEND_CREATE_STREAM_MESSAGE, tid); err != nil {
+		return err
+	}
+
+	res, err := recvResponse(c.conn, func(r *ResponseMessage) bool {
+		return r.TransactionId == tid && (r.CommandName == Response_Result || r.CommandName == Response_Error)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	streamID, ok := res.Infomation.(float64)
+	if res.CommandName != Response_Result || !ok {
+		return errors.New("rtmp client createStream error : " + responseError(res))
+	}
+
+	c.conn.streamID = uint32(streamID)
+
+	if c.mode == RTMP_CLIENT_MODE_PUBLISH {
+		return c.publish()
+	}
+
+	return c.play()
+}
+
+func (c *RtmpClient) publish() error {
+	err := sendMessage(c.conn, SEND_PUBLISH_MESSAGE, map[interface{}]interface{}{"PublishingName": c.streamName, "PublishingType": "live"})
+	if err != nil {
+		return err
+	}
+
+	res, err := recvResponse(c.conn, func(r *ResponseMessage) bool {
+		return r.CommandName == Response_OnStatus || r.CommandName == Response_Error
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if code, _, _ := responseStatus(res); code != NetStream_Publish_Start {
+		return errors.New("rtmp client publish error : " + responseError(res))
+	}
+
+	return nil
+}
+
+func (c *RtmpClient) play() error {
+	err := sendMessage(c.conn, SEND_PLAY_MESSAGE, map[interface{}]interface{}{"StreamName": c.streamName})
+	if err != nil {
+		return err
+	}
+
+	if err = sendMessage(c.conn, SEND_SET_BUFFER_LENGTH_MESSAGE, nil); err != nil {
+		return err
+	}
+
+	// 本服务器在 NetStream.Play.Start 之后才开始发送音视频,其他的服务器可能在之前就开始发送了,先保存起来
+	res, err := recvResponse(c.conn, func(r *ResponseMessage) bool {
+		if r.CommandName == Response_Error {
+			return true
+		}
+
+		code, _, _ := responseStatus(r)
+		return r.CommandName == Response_OnStatus && code != NetStream_Play_Reset
+	}, func(msg RtmpMessage) {
+		if pkt := c.toAVPacket(msg); pkt != nil {
+			c.pending = append(c.pending, pkt)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if code, _, _ := responseStatus(res); code != NetStream_Play_Start {
+		return errors.New("rtmp client play error : " + responseError(res))
+	}
+
+	return nil
+}
+
+// 推流时写入音视频包的通道.关闭这个通道就会关闭客户端.
+func (c *RtmpClient) WriteChan() chan<- *AVPacket {
+	return c.in
+}
+
+// 拉流时读出音视频包的通道.客户端关闭之后,这个通道会被关闭.
+func (c *RtmpClient) ReadChan() <-chan *AVPacket {
+	return c.out
+}
+
+// 客户端关闭之后,这个通道会被关闭
+func (c *RtmpClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// 客户端关闭的原因
+func (c *RtmpClient) Err() error {
+	<-c.done
+	return c.err
+}
+
+func (c *RtmpClient) Close() {
+	c.close(nil)
+}
+
+func (c *RtmpClient) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// 推流,发送一个音视频包.
+// 音频和视频在不同的块流上发送,块流上的第一个包是绝对时间戳(Chunk12),后面的都是与这个块流上一个包的时间戳差值(Chunk8).
+// 时间戳比这个块流上一个包小的时候,不能用差值表示,重新发送绝对时间戳.
+func (c *RtmpClient) WritePacket(pkt *AVPacket) error {
+	if c.mode != RTMP_CLIENT_MODE_PUBLISH {
+		return errors.New("rtmp client is not publishing")
+	}
+
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	switch pkt.Type {
+	case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+		{
+			csid := uint32(RTMP_CSID_VIDEO)
+			if pkt.Type == RTMP_MSG_AUDIO {
+				csid = RTMP_CSID_AUDIO
+			}
+
+			last, sended := c.sendTimes[csid]
+			c.sendTimes[csid] = pkt.Timestamp
+
+			if !sended || pkt.Timestamp < last {
+				head := newRtmpHeader(csid, pkt.Timestamp, uint32(len(pkt.Payload)), pkt.Type, c.conn.streamID, 0)
+				return writeChunks(c.conn, head, pkt.Payload, true)
+			}
+
+			head := newRtmpHeader(csid, pkt.Timestamp-last, uint32(len(pkt.Payload)), pkt.Type, c.conn.streamID, 0)
+			return writeChunks(c.conn, head, pkt.Payload, false)
+		}
+	case RTMP_MSG_AMF0_METADATA:
+		{
+			return sendMessage(c.conn, SEND_DATA_MESSAGE, pkt)
+		}
+	}
+
+	return errors.New("rtmp client unknow packet type")
+}
+
+func (c *RtmpClient) writeLoop() {
+	for {
+		select {
+		case pkt, ok := <-c.in:
+			{
+				if !ok {
+					c.close(nil)
+					return
+				}
+
+				if err := c.WritePacket(pkt); err != nil {
+					c.close(err)
+					return
+				}
+			}
+		case <-c.done:
+			{
+				return
+			}
+		}
+	}
+}
+
+func (c *RtmpClient) readLoop() {
+	defer close(c.out)
+
+	for _, pkt := range c.pending {
+		select {
+		case c.out <- pkt:
+		case <-c.done:
+			return
+		}
+	}
+
+	c.pending = nil
+
+	for {
+		msg, err := recvMessage(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch v := msg.(type) {
+		case *ResponseMessage:
+			{
+				// 流结束或者出错了
+				code, level, _ := responseStatus(v)
+				if code == NetStream_Play_Stop || code == NetStream_Play_UnpublishNotify || level == Level_Error {
+					c.close(errors.New("rtmp client stopped : " + responseError(v)))
+					return
+				}
+			}
+		case *StreamEOFMessage:
+			{
+				c.close(nil)
+				return
+			}
+		default:
+			{
+				if c.mode != RTMP_CLIENT_MODE_PLAY {
+					continue
+				}
+
+				if pkt := c.toAVPacket(msg); pkt != nil {
+					select {
+					case c.out <- pkt:
+					case <-c.done:
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// 将收到的音视频消息转换成音视频包,时间戳转换为绝对时间戳.
+func (c *RtmpClient) toAVPacket(msg RtmpMessage) *AVPacket {
+	head := msg.Header()
+	payload := msg.Body().Payload
+
+	switch head.ChunkMessgaeHeader.MessageTypeID {
+	case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO, RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF3_METADATA:
+	default:
+		return nil
+	}
+
+	pkt := new(AVPacket)
+	pkt.Timestamp = chunkTimestamp(c.timestamps, head)
+	pkt.Type = head.ChunkMessgaeHeader.MessageTypeID
+	pkt.Payload = payload
+
+	if len(payload) == 0 {
+		return pkt
+	}
+
+	switch pkt.Type {
+	case RTMP_MSG_AUDIO:
+		{
+			pkt.SoundFormat = payload[0] >> 4
+			pkt.SoundRate = (payload[0] & 0x0c) >> 2
+			pkt.SoundSize = (payload[0] & 0x02) >> 1
+			pkt.SoundType = payload[0] & 0x01
+		}
+	case RTMP_MSG_VIDEO:
+		{
+			pkt.VideoFrameType = payload[0] >> 4
+			pkt.VideoCodecID = payload[0] & 0x0f
+		}
+	case RTMP_MSG_AMF3_METADATA:
+		{
+			pkt.Type = RTMP_MSG_AMF0_METADATA
+			pkt.Payload = payload[1:]
+		}
+	}
+
+	return pkt
+}
+
+// 读取消息,直到 match 返回 true (收到了需要的命令响应).
+// 其他的消息交给 other 处理, other 为 nil 的时候直接丢弃.
+func recvResponse(conn *RtmpNetConnection, match func(*ResponseMessage) bool, other func(RtmpMessage)) (*ResponseMessage, error) {
+	for {
+		msg, err := recvMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if res, ok := msg.(*ResponseMessage); ok && match(res) {
+			return res, nil
+		}
+
+		if other != nil {
+			other(msg)
+		}
+	}
+}
+
+// 响应消息中的 code, level, description
+func responseStatus(res *ResponseMessage) (code, level, description string) {
+	info, ok := res.Infomation.(AMFObjects)
+	if !ok {
+		return
+	}
+
+	code, _ = info["code"].(string)
+	level, _ = info["level"].(string)
+	description, _ = info["description"].(string)
+	return
+}
+
+func responseError(res *ResponseMessage) string {
+	code, level, description := responseStatus(res)
+	return strings.TrimSpace(res.CommandName + " " + code + " " + level + " " + description)
+}
+
+// rtmp://host[:port]/app[/...]/stream[?query], rtmps的默认端口是443
+// 最后一段路径是流名字(带着query),前面的是应用名.
+func parseRtmpURL(rawurl string) (host, tcUrl, streamName string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+
+	port := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		port = "443"
+	default:
+		err = errors.New("unsupported scheme : " + u.Scheme)
+		return
+	}
+
+	host = u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		err = errors.New("rtmp url must be rtmp://host[:port]/app/stream : " + rawurl)
+		return
+	}
+
+	tcUrl = u.Scheme + "://" + u.Host + "/" + path[:i]
+	streamName = path[i+1:]
+	if u.RawQuery != "" {
+		streamName += "?" + u.RawQuery
+	}
+
+	return
+}
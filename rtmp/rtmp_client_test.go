@@ -0,0 +1,65 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+)
+
+// 推流的时候音视频交错,音频的时间戳比上一个视频包小.
+// 服务器按块流计算出来的绝对时间戳和推流的时间戳相同
+func TestClientWritePacketTimestamps(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := &RtmpClient{
+		conn:      newRtmpNetConnect(a, nil),
+		mode:      RTMP_CLIENT_MODE_PUBLISH,
+		sendTimes: make(map[uint32]uint32)}
+
+	packets := []*AVPacket{
+		{Type: RTMP_MSG_VIDEO, Timestamp: 0, Payload: []byte{0x17, 0}},
+		{Type: RTMP_MSG_VIDEO, Timestamp: 40, Payload: []byte{0x17, 1}},
+		{Type: RTMP_MSG_AUDIO, Timestamp: 20, Payload: []byte{0xaf, 0}},
+		{Type: RTMP_MSG_AUDIO, Timestamp: 43, Payload: []byte{0xaf, 1}},
+		{Type: RTMP_MSG_VIDEO, Timestamp: 80, Payload: []byte{0x27, 1}},
+		{Type: RTMP_MSG_AUDIO, Timestamp: 66, Payload: []byte{0xaf, 1}},
+		{Type: RTMP_MSG_VIDEO, Timestamp: 70, Payload: []byte{0x27, 1}},
+		{Type: RTMP_MSG_VIDEO, Timestamp: 120, Payload: []byte{0x27, 1}},
+	}
+
+	go func() {
+		for _, pkt := range packets {
+			if err := c.WritePacket(pkt); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := newRtmpNetConnect(b, nil)
+	timestamps := make(map[uint32]uint32)
+	for i, want := range packets {
+		msg, err := recvMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		head := msg.Header()
+		if head.ChunkMessgaeHeader.MessageTypeID != want.Type {
+			t.Fatalf("packet %d: type = %d, want %d", i, head.ChunkMessgaeHeader.MessageTypeID, want.Type)
+		}
+
+		csid := uint32(RTMP_CSID_VIDEO)
+		if want.Type == RTMP_MSG_AUDIO {
+			csid = RTMP_CSID_AUDIO
+		}
+
+		if head.ChunkBasicHeader.ChunkStreamID != csid {
+			t.Errorf("packet %d: chunk stream id = %d, want %d", i, head.ChunkBasicHeader.ChunkStreamID, csid)
+		}
+
+		if ts := chunkTimestamp(timestamps, head); ts != want.Timestamp {
+			t.Errorf("packet %d: timestamp = %d, want %d", i, ts, want.Timestamp)
+		}
+	}
+}
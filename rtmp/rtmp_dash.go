@@ -0,0 +1,145 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/avformat"
+	"github.com/onedss/gortmp/dash"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// MPEG-DASH直播.
+// HLSStore.DASH为true的时候,fMP4切片(见 HLSStore.SegmentTypes)的流同时输出MPD,和HLS使用同样的初始化段和切片:
+//
+// GET /dash/app/stream.mpd 重定向到 /dash/app/stream/index.mpd
+// GET /dash/app/stream/init.mp4, /dash/app/stream/stream-序号.m4s
+//
+// MPD中的切片就是HLS播放列表的滑动窗口中的切片,离开窗口之后一样在HLSStore.Grace之后删除,
+// 广播结束之后MPD写上mediaPresentationDuration,在HLSStore.PurgeDelay之后和这个流的HLS文件一起删除.
+//
+// HLSStore.Encrypt为true的时候切片是AES-128加密的,DASH的播放器不能解密,不输出DASH.
+
+// 每个流的MPD的文件名,和HLS的播放列表在同一个目录下
+const DASH_MPD_NAME = "index.mpd"
+
+// MPD的时间刻度,和RTMP的时间戳一样是毫秒
+const DASH_TIMESCALE = 1000
+
+// fMP4切片的流输出DASH,加密的切片不输出
+func (s *RtmpNetStream) dashEnabled() bool {
+	return s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.dashEnabled() && s.rtmpFile.hls_fmp4 != nil
+}
+
+// 开启了DASH并且切片没有加密
+func (h *HLSStore) dashEnabled() bool {
+	return h.DASH && !h.Encrypt
+}
+
+// 切片写完之后更新MPD. start是切片开始的时间戳, end是切片结束的时间戳.
+// 第一个切片的开始时间对应availabilityStartTime,之后切片在它结束的时候可以下载
+func (s *RtmpNetStream) writeDashSegment(start, end uint32) error {
+	if s.rtmpFile.dash_start.IsZero() {
+		s.rtmpFile.dash_start = time.Now().Add(-time.Duration(end-start) * time.Millisecond)
+		s.rtmpFile.dash_offset = start
+	}
+
+	// $Number$是切片文件名中的序号.继续存档的时候播放列表中还有存档的切片,媒体序列号和文件名中的序号不一样
+	if len(s.rtmpFile.dash_segments) == 0 {
+		s.rtmpFile.dash_number = s.rtmpFile.hls_segment_count
+	}
+
+	s.rtmpFile.dash_segments = append(s.rtmpFile.dash_segments, dash.Segment{Time: uint64(start), Duration: uint64(end - start)})
+
+	// 和播放列表的滑动窗口一样
+	if n := len(s.rtmpFile.dash_segments) - len(s.rtmpFile.hls_playlist.Segments); n > 0 {
+		s.rtmpFile.dash_segments = append(s.rtmpFile.dash_segments[:0:0], s.rtmpFile.dash_segments[n:]...)
+		s.rtmpFile.dash_number += uint32(n)
+	}
+
+	return s.writeDashMPD(false)
+}
+
+// 重新生成MPD, ended为true表示广播已经结束
+func (s *RtmpNetStream) writeDashMPD(ended bool) error {
+	playlist := &s.rtmpFile.hls_playlist
+	target := time.Duration(playlist.Targetduration) * time.Second
+
+	mpd := dash.MPD{
+		AvailabilityStartTime:  s.rtmpFile.dash_start,
+		PublishTime:            time.Now(),
+		MinimumUpdatePeriod:    target,
+		MinBufferTime:          target,
+		Bandwidth:              s.rtmpFile.hls_bandwidth,
+		Codecs:                 s.hlsCodecs(),
+		Timescale:              DASH_TIMESCALE,
+		PresentationTimeOffset: uint64(s.rtmpFile.dash_offset),
+		Initialization:         s.rtmpFile.hls_init_name,
+		Media:                  path.Base(s.streamPath) + "-$Number$" + s.hlsSegmentExt(),
+		StartNumber:            int(s.rtmpFile.dash_number),
+		Segments:               s.rtmpFile.dash_segments,
+	}
+
+	if width, height, err := avformat.ParseSPSResolution(s.rtmpFile.avc.SequenceParameterSetNALUnit); err == nil {
+		mpd.Width, mpd.Height = width, height
+	}
+
+	// 可以回看的是窗口中所有的切片
+	var end uint64
+	for _, seg := range mpd.Segments {
+		mpd.TimeShiftBufferDepth += time.Duration(seg.Duration) * time.Millisecond
+		end = seg.Time + seg.Duration
+	}
+
+	if ended && end > mpd.PresentationTimeOffset {
+		mpd.MediaPresentationDuration = time.Duration(end-mpd.PresentationTimeOffset) * time.Millisecond
+	}
+
+	return s.writeHlsFile(DASH_MPD_NAME, mpd.Encode())
+}
+
+// 处理 GET /dash/..., MPD和初始化段不缓存,切片和HLS的切片一样缓存一小段时间.文件和HLS的文件在同一个HLSStore中
+func (s *Server) serveDASH(w http.ResponseWriter, r *http.Request) {
+	if s.HLS == nil || !s.HLS.dashEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// path.Clean 之后不会有 .. 跳出根目录
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/dash/")), "/")
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch path.Ext(name) {
+	case ".mpd":
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Cache-Control", s.HLS.segmentCacheControl())
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	content, modtime, err := s.HLS.readFile(name)
+	if err != nil {
+		// /dash/myapp/mystream.mpd 重定向到流的MPD /dash/myapp/mystream/index.mpd,
+		// 重定向之后MPD中切片的相对路径才正确
+		if path.Ext(name) == ".mpd" && path.Base(name) != DASH_MPD_NAME {
+			mpd := strings.TrimSuffix(name, ".mpd") + "/" + DASH_MPD_NAME
+			if _, _, err = s.HLS.readFile(mpd); err == nil {
+				http.Redirect(w, r, "/dash/"+mpd, http.StatusFound)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, name, modtime, content)
+}
@@ -0,0 +1,55 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/config"
+	"net/http"
+	"testing"
+)
+
+// 切片加密的时候不输出DASH,DASH的播放器不能解密HLS的切片
+func TestDASHDisabledWithEncrypt(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	for _, encrypt := range []bool{false, true} {
+		s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+		s.HLS.SegmentTypes = map[string]string{"live": HLS_SEGMENT_TYPE_FMP4}
+		s.HLS.DASH = true
+		s.HLS.Encrypt = encrypt
+		startTestServer(t, s)
+
+		pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeTestH264(pub, 50)
+		pub.Close()
+
+		base := "http://" + s.HTTPAddr
+		waitTestPlaylistEnd(t, base+"/hls/live/test/"+HLS_PLAYLIST_NAME)
+
+		want := http.StatusOK
+		if encrypt {
+			want = http.StatusNotFound
+		}
+
+		for _, name := range []string{DASH_MPD_NAME, HLS_INIT_NAME, "test-0.m4s"} {
+			res, err := http.Get(base + "/dash/live/test/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != want {
+				t.Errorf("encrypt = %v, %s: status %d, want %d", encrypt, name, res.StatusCode, want)
+			}
+		}
+
+		if _, _, err = s.HLS.readFile("live/test/" + DASH_MPD_NAME); (err == nil) == encrypt {
+			t.Errorf("encrypt = %v: read MPD err = %v", encrypt, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/onedss/gortmp/config"
+	"strings"
+)
+
+// 边缘模式.
+// 订阅者订阅的流在本服务器上不存在的时候,从源站拉流,创建一个本地的广播,拉到的音视频包就像发布者发布的一样流入广播.
+// 之后订阅同一个流的订阅者都加入这个广播,最后一个订阅者离开之后,停止拉流.
+//
+// 源站 --> RtmpClient(拉流) --> edge goroutine --> 广播 --> 订阅者1, 订阅者2, ...
+
+// 查找订阅者需要订阅的广播.
+// 边缘模式,没有找到广播的时候从源站拉流,创建一个本地的广播.同时订阅同一个流的订阅者只有一个连接源站.
+func find_or_pull_broadcast(registry *StreamRegistry, s *RtmpNetStream) (*Broadcast, bool) {
+	if d, ok := find_broadcast(registry, s.streamPath); ok || config.EdgeOrigin == "" {
+		return d, ok
+	}
+
+	d, err := registry.pull(s.streamPath, func() error {
+		return start_edge(registry, s, config.EdgeOrigin)
+	})
+	if err != nil {
+		fmt.Println("Edge pull error :", err)
+		return nil, false
+	}
+
+	return d, true
+}
+
+// 从源站拉流并启动广播,流路径在注册表中已经存在的时候返回错误(其他订阅者已经开始拉流).
+// origin 是源站地址,例如 rtmp://origin:1935, 拉流地址是 origin/流路径.
+func start_edge(registry *StreamRegistry, s *RtmpNetStream, origin string) error {
+	client, err := DialPlay(strings.TrimSuffix(origin, "/") + "/" + s.streamPath)
+	if err != nil {
+		return err
+	}
+
+	// 拉流的连接作为广播的发布者,关闭的时候和发布者一样,在服务器的注册表中停止广播
+	client.conn.server = s.conn.server
+
+	publisher := newNetStream(client.conn, s.serverHandler)
+	publisher.streamPath = s.streamPath
+	publisher.mode = 1
+	publisher.edge = client
+
+	if err = start_broadcast(registry, publisher, 5, 5); err != nil {
+		client.Close()
+		return err
+	}
+
+	fmt.Println("Edge pull start, Broadcast :", s.streamPath, "\nOrigin :", origin)
+
+	go publisher.edgeLoop()
+
+	return nil
+}
+
+// 将从源站拉到的音视频包放入发布者的通道,和发布者发布的音视频消息的处理一样.
+// 第一个音频包和视频包是sequence header.
+func (s *RtmpNetStream) edgeLoop() {
+	defer s.Close()
+
+	for pkt := range s.edge.ReadChan() {
+		switch pkt.Type {
+		case RTMP_MSG_AUDIO:
+			{
+				if s.audioTag == nil {
+					s.setSequenceHeader(pkt)
+				} else {
+					s.pushPacket(s.audiochan, pkt)
+				}
+			}
+		case RTMP_MSG_VIDEO:
+			{
+				if s.videoTag == nil {
+					s.setSequenceHeader(pkt)
+				} else {
+					if pkt.isKeyFrame() {
+						s.videoKeyFrame = pkt
+					}
+
+					s.pushPacket(s.videochan, pkt)
+				}
+			}
+		default:
+			{
+				if dataMessageName(pkt.Payload) == "onMetaData" {
+					s.metaData = pkt
+				}
+
+				s.pushPacket(s.datachan, pkt)
+			}
+		}
+	}
+
+	fmt.Println("Edge pull stopped, Broadcast :", s.streamPath, "\nerror :", s.edge.Err())
+}
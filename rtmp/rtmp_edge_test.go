@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/config"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 统计源站收到的播放请求
+type countingPlayHandler struct {
+	DefaultServerHandler
+	plays int32
+}
+
+func (h *countingPlayHandler) OnPlaying(s *RtmpNetStream) error {
+	atomic.AddInt32(&h.plays, 1)
+	return h.DefaultServerHandler.OnPlaying(s)
+}
+
+// 几个播放者同时在边缘服务器上播放同一个流,边缘服务器只从源站拉一次流.
+// 所有播放者离开之后停止拉流,之后的播放者重新从源站拉流
+func TestEdgeConcurrentPlay(t *testing.T) {
+	defer func(n int) { config.GopCacheNum = n }(config.GopCacheNum)
+	config.GopCacheNum = 1
+
+	origin := &Server{Addr: freeAddr(t), Handler: new(countingPlayHandler)}
+	startTestServer(t, origin)
+
+	pub, err := DialPublish("rtmp://" + origin.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	writeTestH264(pub, 10)
+	waitTestBroadcast(t, origin, "live/test")
+
+	defer func(origin string) { config.EdgeOrigin = origin }(config.EdgeOrigin)
+	config.EdgeOrigin = "rtmp://" + origin.Addr
+
+	edge := &Server{Addr: freeAddr(t)}
+	startTestServer(t, edge)
+
+	players := make([]*RtmpClient, 4)
+	var wg sync.WaitGroup
+	for i := range players {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			players[i], _ = DialPlay("rtmp://" + edge.Addr + "/live/test")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, player := range players {
+		if player == nil {
+			t.Fatalf("player %d: dial failed", i)
+		}
+
+		if pkt := readTestPacket(t, player); pkt.Type != RTMP_MSG_VIDEO || pkt.Payload[1] != 0 {
+			t.Fatalf("player %d: first packet type = %d, payload = % x", i, pkt.Type, pkt.Payload[:2])
+		}
+	}
+
+	if n := atomic.LoadInt32(&origin.Handler.(*countingPlayHandler).plays); n != 1 {
+		t.Errorf("origin plays = %d, want 1", n)
+	}
+
+	for _, player := range players {
+		player.Close()
+	}
+
+	for i := 0; ; i++ {
+		if _, ok := edge.Streams.Find("live/test"); !ok {
+			break
+		}
+
+		if i == 300 {
+			t.Fatal("timeout waiting for the edge pull to stop")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	player, err := DialPlay("rtmp://" + edge.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	if pkt := readTestPacket(t, player); pkt.Type != RTMP_MSG_VIDEO || pkt.Payload[1] != 0 {
+		t.Fatalf("first packet type = %d, payload = % x", pkt.Type, pkt.Payload[:2])
+	}
+
+	if n := atomic.LoadInt32(&origin.Handler.(*countingPlayHandler).plays); n != 2 {
+		t.Errorf("origin plays = %d, want 2", n)
+	}
+}
+
+// 广播结束之后加入广播返回false,不会一直等待,也不会以为加入成功
+func TestJoinStoppedBroadcast(t *testing.T) {
+	s := &Server{Addr: freeAddr(t)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestH264(pub, 1)
+	waitTestBroadcast(t, s, "live/test")
+
+	b, _ := s.Streams.Find("live/test")
+	if !b.join(newFlvSubscriber(ioutil.Discard, "127.0.0.1:1", "live/test")) {
+		t.Fatal("join a running broadcast failed")
+	}
+
+	pub.Close()
+
+	select {
+	case <-b.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the broadcast to stop")
+	}
+
+	if b.join(newFlvSubscriber(ioutil.Discard, "127.0.0.1:2", "live/test")) {
+		t.Fatal("join a stopped broadcast succeeded")
+	}
+}
@@ -14,11 +14,13 @@ const (
 
 	/* Code */
 	/* NetStream */
-	NetStream_Play_Reset          = "NetStream.Play.Reset"          // "status" 由播放列表重置导致
-	NetStream_Play_Start          = "NetStream.Play.Start"          // "status" 播放已开始
-	NetStream_Play_StreamNotFound = "NetStream.Play.StreamNotFound" // "error"  无法找到传递给 play()方法的 FLV
-	NetStream_Play_Stop           = "NetStream.Play.Stop"           // "status" 播放已结束
-	NetStream_Play_Failed         = "NetStream.Play.Failed"         // "error"  出于此表中列出的原因之外的某一原因(例如订阅者没有读取权限),播放发生了错误
+	NetStream_Play_Reset           = "NetStream.Play.Reset"           // "status" 由播放列表重置导致
+	NetStream_Play_Start           = "NetStream.Play.Start"           // "status" 播放已开始
+	NetStream_Play_StreamNotFound  = "NetStream.Play.StreamNotFound"  // "error"  无法找到传递给 play()方法的 FLV
+	NetStream_Play_Stop            = "NetStream.Play.Stop"            // "status" 播放已结束
+	NetStream_Play_Failed          = "NetStream.Play.Failed"          // "error"  出于此表中列出的原因之外的某一原因(例如订阅者没有读取权限),播放发生了错误
+	NetStream_Play_PublishNotify   = "NetStream.Play.PublishNotify"   // "status" 流的发布者开始发布
+	NetStream_Play_UnpublishNotify = "NetStream.Play.UnpublishNotify" // "status" 流的发布者停止发布
 
 	NetStream_Play_Switch   = "NetStream.Play.Switch"
 	NetStream_Play_Complete = "NetStream.Play.Switch"
@@ -4,13 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"github.com/onedss/gortmp/avformat"
+	"github.com/onedss/gortmp/dash"
 	//"../config"
 	"github.com/onedss/gortmp/hls"
 	"github.com/onedss/gortmp/mpegts"
 	"github.com/onedss/gortmp/util"
 	//"fmt"
 	"io"
-	"os"
 	//"strconv"
 	//"strings"
 	//"sync"
@@ -33,6 +33,7 @@ type RtmpFile struct {
 	vtwrite           bool                                   // video tag
 	awrite_time       uint32                                 // write audio time
 	vwrite_time       uint32                                 // write video time
+	vlast_time        uint32                                 // last video time
 	audio_cc          uint16                                 // audio ContinuityCounter(mpegts)
 	video_cc          uint16                                 // video ContinuityCounter(mpegts)
 	avc               avformat.AVCDecoderConfigurationRecord // AVCDecoderConfigurationRecord(mpegts)
@@ -41,8 +42,38 @@ type RtmpFile struct {
 	hls_m3u8_name     string                                 // hls m3u8 name
 	hls_playlist      hls.Playlist                           // hls play list
 	hls_fragment      int64                                  // hls fragment
+	hls_max_fragment  int64                                  // hls max fragment, cut without keyframe
 	hls_segment_count uint32                                 // hls segment count
 	hls_segment_data  *bytes.Buffer                          // hls segment
+	hls_store         *HLSStore                              // hls store, nil: only write files
+	hls_name          string                                 // hls m3u8 name, relative to hls store
+	hls_generation    uint64                                 // hls publish generation of the stream
+	hls_key           *hls.PlaylistKey                       // hls current key, nil: not encrypted
+	hls_key_data      []byte                                 // hls current key data
+	hls_key_iv        []byte                                 // hls current key iv
+	hls_key_count     uint32                                 // hls key count
+	hls_key_names     map[*hls.PlaylistKey]string            // hls key files in store, expired with segments
+	hls_group         string                                 // hls variant group, empty: not a variant
+	hls_bytes         int64                                  // hls bytes of all segments
+	hls_duration      float64                                // hls duration of all segments
+	hls_bandwidth     int                                    // hls max bandwidth of segments
+	hls_key_segment   uint32                                 // hls segment count when the key rotated
+	hls_part_duration int64                                  // ll-hls part target duration
+	hls_part_index    int                                    // ll-hls part index in segment
+	hls_part_offset   int                                    // ll-hls part start offset in segment data
+	hls_part_time     uint32                                 // ll-hls part start timestamp
+	hls_part_video    bool                                   // ll-hls part has video
+	hls_part_idr      bool                                   // ll-hls part starts with keyframe
+	hls_fmp4          *avformat.FMP4Muxer                    // hls fmp4 muxer, nil: mpeg-ts segments
+	hls_pdt_start     time.Time                              // hls program date time of the first segment
+	hls_pdt_offset    uint32                                 // hls timestamp of the first segment
+	hls_init_name     string                                 // hls fmp4 init segment name, empty: not written
+	hls_segment_map   string                                 // hls init segment used from the next segment
+	hls_discontinuity bool                                   // hls next segment follows the archived segments
+	dash_segments     []dash.Segment                         // dash segments in mpd, same as hls window
+	dash_start        time.Time                              // dash availability start time
+	dash_offset       uint32                                 // dash timestamp of the first segment
+	dash_number       uint32                                 // dash number of the first segment in mpd
 	timeout           time.Duration                          // timeout
 	control           chan interface{}                       // control
 }
@@ -151,38 +182,30 @@ func rtmpVideoPacketToPES(video *AVPacket, avc_dcr avformat.AVCDecoderConfigurat
 	return
 }
 
-func writeHlsTsSegmentFile(filename string, data []byte) (err error) {
-	var file *os.File
+// PAT + PMT + ts数据
+func hlsTsSegment(data []byte) (segment []byte, err error) {
+	var b bytes.Buffer
 
-	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
+	if err = mpegts.WriteDefaultPATPacket(&b); err != nil {
 		return
 	}
-	defer file.Close()
 
-	if err = mpegts.WriteDefaultPATPacket(file); err != nil {
+	if err = mpegts.WriteDefaultPMTPacket(&b); err != nil {
 		return
 	}
 
-	if err = mpegts.WriteDefaultPMTPacket(file); err != nil {
-		return
-	}
+	b.Write(data)
 
-	if _, err = file.Write(data); err != nil {
-		return
-	}
-
-	file.Close()
-
-	return
+	return b.Bytes(), nil
 }
 
 func writeFLVTag(w io.Writer, data *AVPacket) (err error) {
 	tag := avformat.FLVTag{
-		TagType:   data.Type,
-		DataSize:  uint32(len(data.Payload)),
-		Timestamp: data.Timestamp,
-		Data:      *bytes.NewBuffer(data.Payload),
+		TagType:           data.Type,
+		DataSize:          uint32(len(data.Payload)),
+		Timestamp:         data.Timestamp & 0xFFFFFF,  // 低24位
+		TimestampExtended: byte(data.Timestamp >> 24), // 高8位
+		Data:              *bytes.NewBuffer(data.Payload),
 	}
 
 	bw := &bytes.Buffer{}
@@ -0,0 +1,60 @@
+package rtmp
+
+// GOP缓存.
+// 订阅者在订阅一个广播的时候,如果只能从下一个关键帧开始播放,那么在GOP比较大的情况下(例如10s),播放器需要等待很久才能出画面.
+// 因此广播中缓存最近的GOP(从关键帧开始,一直到下一个关键帧之前的所有音视频包),新的订阅者加入的时候,先将缓存的GOP发送给订阅者,然后再发送实时的数据.
+//
+// | keyframe | audio | video | audio | ... | keyframe | audio | video | ... |
+// |<------------- GOP 1 ------------------>|<-------- GOP 2 ------------->|
+//
+// GOP缓存只在广播的goroutine中被访问,因此不需要加锁.
+type GopCache struct {
+	num  int           // 最多缓存的GOP个数,小于等于0表示不缓存
+	gops [][]*AVPacket // 缓存的GOP
+}
+
+func newGopCache(num int) *GopCache {
+	return &GopCache{
+		num:  num,
+		gops: make([][]*AVPacket, 0, num+1)}
+}
+
+// 将发布者的音视频包放入GOP缓存中.
+// 遇到关键帧的时候,开始一个新的GOP,超出缓存个数的时候,丢弃最旧的GOP.
+// 在收到第一个关键帧之前的音视频包是无法解码的,直接丢弃.
+func (c *GopCache) push(pkt *AVPacket) {
+	if c.num <= 0 {
+		return
+	}
+
+	if pkt.Type == RTMP_MSG_VIDEO && pkt.isKeyFrame() {
+		c.gops = append(c.gops, []*AVPacket{pkt})
+		if len(c.gops) > c.num {
+			c.gops[0] = nil
+			c.gops = c.gops[1:]
+		}
+
+		return
+	}
+
+	if len(c.gops) == 0 {
+		return
+	}
+
+	last := len(c.gops) - 1
+	c.gops[last] = append(c.gops[last], pkt)
+}
+
+// 按照接收的顺序,返回缓存中所有的音视频包.
+func (c *GopCache) packets() []*AVPacket {
+	var pkts []*AVPacket
+	for _, gop := range c.gops {
+		pkts = append(pkts, gop...)
+	}
+
+	return pkts
+}
+
+func (c *GopCache) clear() {
+	c.gops = c.gops[:0]
+}
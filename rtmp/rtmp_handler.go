@@ -1,7 +1,6 @@
 package rtmp
 
 import (
-	"errors"
 	"fmt"
 )
 
@@ -18,24 +17,24 @@ type DefaultServerHandler struct {
 // 发布者成功发布流后,就启动广播
 func (p *DefaultServerHandler) OnPublishing(s *RtmpNetStream) error {
 	// 在广播中发现这个广播已经存在,那么就认为这个广播是无效的.(例如已经发布ip/myapp/mystream这个广播,再次发布ip/app/mystream,就认为这个广播是无效的)
-	if _, ok := find_broadcast(s.streamPath); ok {
-		return errors.New("NetStream.Publish.BadName")
+	// 查找和注册在注册表的同一个锁里面完成,同时发布同一个流路径,只有一个能成功.
+	if err := start_broadcast(s.conn.server.Streams, s, 5, 5); err != nil {
+		return newStatusError(NetStream_Publish_BadName, err.Error())
 	}
 
-	start_broadcast(s, 5, 5)
-
 	return nil
 }
 
-// 订阅者成功订阅流后,就将订阅者添加进广播中
+// 订阅者成功订阅流后,查找订阅者需要订阅的广播.
+// 这里只记下广播,发送了NetStream.Play.Start之后才加入广播(playMessageHandle),播放者先收到响应,再收到音视频
 func (p *DefaultServerHandler) OnPlaying(s *RtmpNetStream) error {
-	// 根据订阅者(s)提供的信息,来查找订阅者需要订阅的广播,如果找到了,那么就让这个广播添加这个订阅者
-	if d, ok := find_broadcast(s.streamPath); ok {
-		d.addSubscriber(s)
+	// 根据订阅者(s)提供的信息,来查找订阅者需要订阅的广播.边缘模式,没有找到广播的时候从源站拉流
+	if d, ok := find_or_pull_broadcast(s.conn.server.Streams, s); ok {
+		s.broadcast = d
 		return nil
 	}
 
-	return errors.New("NetStream.Play.StreamNotFound")
+	return newStatusError(NetStream_Play_StreamNotFound, s.streamPath+" not found")
 }
 
 func (dsh *DefaultServerHandler) OnClosed(s *RtmpNetStream) {
@@ -50,7 +49,8 @@ func (dsh *DefaultServerHandler) OnClosed(s *RtmpNetStream) {
 
 	fmt.Printf("NetStream OnClosed, remoteAddr : %v\npath : %v\nmode : %v\n", s.conn.remoteAddr, s.streamPath, mode)
 
-	if d, ok := find_broadcast(s.streamPath); ok {
+	// 使用这个流发布或者订阅的广播,不按路径查找:广播已经结束之后,同一个路径可能已经有新的广播
+	if d := s.broadcast; d != nil {
 		if s.mode == 1 {
 			d.stop()
 		} else if s.mode == 2 {
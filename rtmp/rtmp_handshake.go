@@ -91,6 +91,51 @@ func handshake(brw *bufio.ReadWriter) error {
 	return complex_handshake(brw, C1)
 }
 
+// 客户端握手(simple handshake).
+// C0 + C1 -> 服务器
+// 服务器 -> S0 + S1 + S2
+// C2(S1) -> 服务器
+func client_handshake(brw *bufio.ReadWriter) error {
+	C0 := byte(RTMP_HANDSHAKE_VERSION)
+	C1 := make([]byte, 1536-8)
+	C1_Time := uint32(0)
+	C1_Zero := uint32(0) // Zero为0,表示使用simple handshake
+
+	for i := range C1 {
+		C1[i] = byte(rand.Int() % 256)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(C0)
+	binary.Write(buf, binary.BigEndian, C1_Time)
+	binary.Write(buf, binary.BigEndian, C1_Zero)
+	buf.Write(C1)
+
+	if _, err := brw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	S0S1S2 := make([]byte, 1+1536+1536)
+	if _, err := io.ReadFull(brw, S0S1S2); err != nil {
+		return err
+	}
+
+	if S0S1S2[0] != RTMP_HANDSHAKE_VERSION {
+		return errors.New("S0 Error")
+	}
+
+	C2 := S0S1S2[1 : 1+1536] // C2 就是 S1
+	if _, err := brw.Write(C2); err != nil {
+		return err
+	}
+
+	return brw.Flush()
+}
+
 func simple_handshake(brw *bufio.ReadWriter, C1 []byte) error {
 	var S0 byte
 	S0 = 0x03
@@ -0,0 +1,452 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"github.com/onedss/gortmp/hls"
+	"github.com/onedss/gortmp/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HLS_SEGMENT_GRACE = time.Second * 10 // 切片离开滑动窗口之后保留的时间,正在下载的播放器还可以下载到
+	HLS_PURGE_DELAY   = time.Second * 60 // 广播结束之后,保留这个流的HLS文件的时间
+)
+
+// 每个流的播放列表的文件名,流的播放列表和切片都在 应用名/流名称/ 目录下
+const HLS_PLAYLIST_NAME = "index.m3u8"
+
+// 磁盘模式下服务器在每个流的目录中写的标记文件,启动的时候只清理有这个文件的目录
+const HLS_STREAM_MARKER = ".gortmp-hls"
+
+// 密钥服务器的回调,返回流的第index个密钥(16字节)和播放列表中的密钥URI.
+// 密钥由外部的密钥服务器保存和提供,不保存在HLSStore中
+type HLSKeyFunc func(streamPath string, index uint32) (key []byte, uri string, err error)
+
+// HLS文件的存储.
+// 磁盘模式下,切片和播放列表写到Dir中,HTTP服务从磁盘读取.
+// 内存模式下,切片和播放列表只保存在内存中(只保留滑动窗口中的切片),HTTP服务直接从内存读取,没有磁盘I/O.
+// 文件名都是相对于Dir的路径,例如 myapp/mystream/index.m3u8, 对应的URL是 /hls/myapp/mystream/index.m3u8
+//
+// 切片离开滑动窗口之后,保留Grace再删除.广播结束之后,保留PurgeDelay再删除这个流的目录(应用名/流名称/).
+// 服务器启动的时候删除Dir中上次运行留下的切片和播放列表,只删除服务器创建的流目录(有HLS_STREAM_MARKER)中的文件.
+//
+// Encrypt为true的时候切片使用AES-128加密,每KeyRotate个切片换一个密钥.
+// KeyFunc为nil的时候随机生成密钥,和切片保存在一起(应用名/流名称/key-序号.key),和切片一样过期删除.
+type HLSStore struct {
+	Dir           string                // HLS文件的根目录
+	Memory        bool                  // 是否只保存在内存中
+	Grace         time.Duration         // 切片离开滑动窗口之后保留的时间
+	PurgeDelay    time.Duration         // 广播结束之后保留这个流的HLS文件的时间,0表示不删除
+	Encrypt       bool                  // 是否使用AES-128加密切片
+	KeyRotate     int                   // 每个密钥加密的切片个数,0表示每次发布只使用一个密钥
+	KeyURL        string                // 密钥URI的前缀,例如 https://host/keys/ ,为空的时候使用相对路径
+	KeyFunc       HLSKeyFunc            // 密钥服务器,为nil的时候随机生成密钥并保存
+	Variants      map[string][]string   // 多码率的分组, 应用名 -> 流名称的后缀列表, 例如 live -> [_720, _480]
+	LowLatency    bool                  // 是否输出低延迟HLS(分片,阻塞请求播放列表)
+	PartDuration  time.Duration         // 低延迟HLS分片的目标时长,0表示HLS_PART_DURATION
+	SegmentTypes  map[string]string     // 切片的格式, 应用名 -> ts或者fmp4, 没有配置的应用是ts
+	DASH          bool                  // fMP4切片的流是否同时输出DASH的MPD
+	PlaylistTypes map[string]string     // 播放列表的类型, 应用名 -> live或者event, 没有配置的应用是live
+	lock          sync.RWMutex          // guards the following
+	files         map[string]*hlsFile   // 内存模式下的文件, 文件名 -> 文件
+	streams       map[string]*hlsStream // 流路径 -> 发布的次数和编号,广播结束之后也保留
+	lives         map[string]*hlsLive   // 低延迟HLS, 播放列表的文件名 -> 流正在生成的位置
+	masterLock    sync.Mutex            // guards masters
+	masters       map[string]*hlsMaster // 多码率的分组 -> 主播放列表
+}
+
+// 流的发布次数和切片,密钥的编号.
+// 重新发布之后切片和密钥继续编号,文件名(URL)不会重复,播放列表的媒体序列号也不会变小
+type hlsStream struct {
+	generation uint64 // 发布的次数,重新发布之后不删除新的文件
+	sequence   uint32 // 下一个切片的序号
+	keyIndex   uint32 // 下一个密钥的序号
+}
+
+type hlsFile struct {
+	data    []byte
+	modtime time.Time
+}
+
+func NewHLSStore(dir string, memory bool) *HLSStore {
+	return &HLSStore{
+		Dir:        dir,
+		Memory:     memory,
+		Grace:      HLS_SEGMENT_GRACE,
+		PurgeDelay: HLS_PURGE_DELAY,
+		files:      make(map[string]*hlsFile),
+		streams:    make(map[string]*hlsStream)}
+}
+
+// 内存模式下保存文件,返回的文件用于removeFile判断文件是否被覆盖
+func (h *HLSStore) writeFile(name string, data []byte) *hlsFile {
+	f := &hlsFile{data: data, modtime: time.Now()}
+
+	h.lock.Lock()
+	h.files[name] = f
+	h.lock.Unlock()
+
+	return f
+}
+
+// 保存文件,内存模式下保存在内存中,否则先写临时文件再改名,播放器不会读到写了一半的文件
+func (h *HLSStore) putFile(name string, data []byte) error {
+	if h.Memory {
+		h.writeFile(name, data)
+		return nil
+	}
+
+	filename := filepath.Join(h.Dir, filepath.FromSlash(name))
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// 生成流的第index个密钥.
+// KeyFunc为nil的时候随机生成密钥,保存为 流路径/key-序号.key, name是保存的文件名;否则从KeyFunc取得,name为空
+func (h *HLSStore) newKey(streamPath string, index uint32) (key []byte, name, uri string, err error) {
+	if h.KeyFunc != nil {
+		if key, uri, err = h.KeyFunc(streamPath, index); err != nil {
+			return
+		}
+
+		if len(key) != aes.BlockSize {
+			err = errors.New("hls: key must be 16 bytes")
+		}
+
+		return
+	}
+
+	if key, err = hls.NewAES128Key(); err != nil {
+		return
+	}
+
+	filename := "key-" + strconv.FormatUint(uint64(index), 10) + ".key"
+	name = streamPath + "/" + filename
+
+	if err = h.putFile(name, key); err != nil {
+		return
+	}
+
+	// 播放列表和密钥在同一个目录下,没有前缀的时候使用相对路径
+	if h.KeyURL != "" {
+		uri = h.KeyURL + name
+	} else {
+		uri = filename
+	}
+
+	return
+}
+
+// 删除内存中的文件, f不为nil的时候只在文件没有被覆盖的时候删除
+func (h *HLSStore) removeFile(name string, f *hlsFile) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if old, ok := h.files[name]; ok && (f == nil || old == f) {
+		delete(h.files, name)
+	}
+}
+
+// 删除文件,内存模式下从内存删除,否则从磁盘删除
+func (h *HLSStore) remove(name string) {
+	if h.Memory {
+		h.removeFile(name, nil)
+		return
+	}
+
+	if err := os.Remove(filepath.Join(h.Dir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+		fmt.Println("HLS remove error :", err)
+	}
+}
+
+// 切片离开了滑动窗口,Grace之后删除.
+// 这之间文件被重新写过(例如重新发布之后写了同名的文件)的时候不删除,只删除现在的这个文件
+func (h *HLSStore) expire(name string) {
+	if h.Memory {
+		h.lock.RLock()
+		f, ok := h.files[name]
+		h.lock.RUnlock()
+
+		if ok {
+			time.AfterFunc(h.Grace, func() {
+				h.removeFile(name, f)
+			})
+		}
+
+		return
+	}
+
+	// 磁盘模式下文件先写临时文件再改名,重新写过的文件不是同一个文件
+	filename := filepath.Join(h.Dir, filepath.FromSlash(name))
+	info, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	time.AfterFunc(h.Grace, func() {
+		if now, err := os.Stat(filename); err == nil && os.SameFile(info, now) {
+			h.remove(name)
+		}
+	})
+}
+
+// 磁盘模式下在流的目录中写标记文件,之后启动的时候cleanup只清理有标记的目录
+func (h *HLSStore) markStream(streamPath string) error {
+	if h.Memory {
+		return nil
+	}
+
+	return ioutil.WriteFile(filepath.Join(h.Dir, filepath.FromSlash(streamPath), HLS_STREAM_MARKER), []byte(streamPath+"\n"), 0644)
+}
+
+// 开始发布流,返回这次发布的序号,第一个切片的序号和第一个密钥的序号
+func (h *HLSStore) publish(streamPath string) (generation uint64, sequence, keyIndex uint32) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	st, ok := h.streams[streamPath]
+	if !ok {
+		st = new(hlsStream)
+		h.streams[streamPath] = st
+	}
+
+	st.generation++
+	return st.generation, st.sequence, st.keyIndex
+}
+
+// 开始写序号为sequence的切片,下一个密钥的序号是keyIndex.
+// 在写文件之前保留序号,上一次发布正在写的最后一个切片和密钥不会和重新发布的重名
+func (h *HLSStore) reserve(streamPath string, sequence, keyIndex uint32) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	st, ok := h.streams[streamPath]
+	if !ok {
+		return
+	}
+
+	if sequence+1 > st.sequence {
+		st.sequence = sequence + 1
+	}
+
+	if keyIndex > st.keyIndex {
+		st.keyIndex = keyIndex
+	}
+}
+
+// 广播结束,PurgeDelay之后删除这个流的目录,并从主播放列表中删除.这之间重新发布了同一个流的时候不删除.
+// EVENT播放列表的流是存档,不删除
+func (h *HLSStore) unpublish(streamPath string, generation uint64) {
+	if h.PurgeDelay <= 0 || (!h.Memory && h.eventPlaylist(streamPath)) {
+		return
+	}
+
+	time.AfterFunc(h.PurgeDelay, func() {
+		h.lock.Lock()
+		if st, ok := h.streams[streamPath]; !ok || st.generation != generation {
+			h.lock.Unlock()
+			return
+		}
+
+		// 保留发布的次数和编号,之后重新发布的切片不会和CDN,播放器缓存的旧切片重名
+		delete(h.lives, streamPath+"/"+HLS_PLAYLIST_NAME)
+
+		// 内存模式,删除这个流目录下所有的文件
+		prefix := streamPath + "/"
+		for name := range h.files {
+			if strings.HasPrefix(name, prefix) {
+				delete(h.files, name)
+			}
+		}
+		h.lock.Unlock()
+
+		if !h.Memory {
+			if err := os.RemoveAll(filepath.Join(h.Dir, filepath.FromSlash(streamPath))); err != nil {
+				fmt.Println("HLS purge error :", err)
+			}
+		}
+
+		if group := h.variantGroup(streamPath); group != "" {
+			h.removeVariant(group, path.Base(streamPath))
+		}
+
+		fmt.Println("HLS purged, stream :", streamPath)
+	})
+}
+
+// 删除Dir中上次运行留下的切片,播放列表和密钥(.ts, .m4s, .mp4, .m3u8, .mpd, .key, .tmp),以及删除之后空的目录.
+// 只清理服务器创建的流目录(有HLS_STREAM_MARKER),Dir中其他的文件(例如配置错误的时候和Dir重叠的录制目录)不删除.
+// EVENT播放列表的应用的目录是存档,不删除
+func (h *HLSStore) cleanup() error {
+	if h.Memory || h.Dir == "" || !util.Exist(h.Dir) {
+		return nil
+	}
+
+	return filepath.Walk(h.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() || name == h.Dir {
+			return nil
+		}
+
+		if rel, err := filepath.Rel(h.Dir, name); err == nil {
+			if t, ok := h.PlaylistTypes[filepath.ToSlash(rel)]; ok && t == HLS_PLAYLIST_EVENT {
+				return filepath.SkipDir
+			}
+		}
+
+		if !util.Exist(filepath.Join(name, HLS_STREAM_MARKER)) {
+			return nil
+		}
+
+		files, err := ioutil.ReadDir(name)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+
+			switch filepath.Ext(f.Name()) {
+			case ".ts", ".m4s", ".mp4", ".m3u8", ".mpd", ".key", ".tmp":
+				if err = os.Remove(filepath.Join(name, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+
+		// 最后删除标记,目录和应用的目录不为空的时候删除失败,忽略
+		os.Remove(filepath.Join(name, HLS_STREAM_MARKER))
+		if os.Remove(name) == nil && filepath.Dir(name) != h.Dir {
+			os.Remove(filepath.Dir(name))
+		}
+
+		return filepath.SkipDir
+	})
+}
+
+// 读取文件,内存模式下从内存读取,否则从磁盘读取
+func (h *HLSStore) readFile(name string) (io.ReadSeeker, time.Time, error) {
+	if h.Memory {
+		h.lock.RLock()
+		f, ok := h.files[name]
+		h.lock.RUnlock()
+
+		if !ok {
+			return nil, time.Time{}, os.ErrNotExist
+		}
+
+		return bytes.NewReader(f.data), f.modtime, nil
+	}
+
+	filename := filepath.Join(h.Dir, filepath.FromSlash(name))
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return bytes.NewReader(data), info.ModTime(), nil
+}
+
+// 切片的Cache-Control.切片的缓存时间不超过Grace,缓存在切片被删除之前过期.
+// 服务器重启之后切片的文件名(URL)会重复,CDN和播放器不会用上次运行缓存的旧切片代替新的切片
+func (h *HLSStore) segmentCacheControl() string {
+	if h.Grace < time.Second {
+		return "no-cache"
+	}
+
+	return "public, max-age=" + strconv.Itoa(int(h.Grace/time.Second))
+}
+
+// 处理 GET /hls/..., 播放列表和密钥不缓存,切片可以缓存一小段时间
+func (s *Server) serveHLS(w http.ResponseWriter, r *http.Request) {
+	if s.HLS == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// path.Clean 之后不会有 .. 跳出根目录
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/hls/")), "/")
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch path.Ext(name) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", s.HLS.segmentCacheControl())
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Cache-Control", s.HLS.segmentCacheControl())
+	case ".mp4":
+		// fMP4的初始化段,重新发布之后可能变化
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".key":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// 低延迟HLS阻塞请求播放列表
+	if path.Base(name) == HLS_PLAYLIST_NAME && r.URL.Query().Get("_HLS_msn") != "" {
+		if code := s.HLS.blockReload(r, name); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	} else if r.URL.Query().Get("_HLS_part") != "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	content, modtime, err := s.HLS.readFile(name)
+	if err != nil && (path.Ext(name) == ".ts" || path.Ext(name) == ".m4s") && s.HLS.waitPreload(r, name) {
+		// 请求的是下一个分片(#EXT-X-PRELOAD-HINT),已经生成
+		content, modtime, err = s.HLS.readFile(name)
+	}
+
+	if err != nil {
+		// /hls/myapp/mystream.m3u8 重定向到流的播放列表 /hls/myapp/mystream/index.m3u8,
+		// 重定向之后播放列表中切片的相对路径才正确
+		if path.Base(name) != HLS_PLAYLIST_NAME {
+			playlist := strings.TrimSuffix(name, ".m3u8") + "/" + HLS_PLAYLIST_NAME
+			if _, _, err = s.HLS.readFile(playlist); err == nil {
+				http.Redirect(w, r, "/hls/"+playlist, http.StatusFound)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, name, modtime, content)
+}
@@ -0,0 +1,154 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/onedss/gortmp/hls"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EVENT(DVR)播放列表,用于存档.
+// HLSStore.PlaylistTypes 中应用的播放列表类型配置为event的时候,这个应用的流的播放列表保留所有的切片:
+//
+// #EXT-X-PLAYLIST-TYPE:EVENT
+// #EXT-X-PROGRAM-DATE-TIME:2020-01-02T15:04:05.000+08:00
+// #EXTINF:5.000,
+// stream-0.ts
+//
+// 切片不离开播放列表,所以不会被删除,广播结束之后也不按照HLSStore.PurgeDelay删除(内存模式除外),服务器启动的时候也不清理.
+// 广播结束之后播放列表改为 #EXT-X-PLAYLIST-TYPE:VOD 并加上 #EXT-X-ENDLIST.
+//
+// 同一个流重新发布(包括服务器重启之后)的时候继续之前的存档:播放列表保留存档中的切片,这次发布的第一个切片前面写#EXT-X-DISCONTINUITY,
+// 切片,密钥和初始化段接着存档中最大的序号编号,存档中的文件不会被覆盖.
+
+const (
+	HLS_PLAYLIST_LIVE  = "live"  // 滑动窗口
+	HLS_PLAYLIST_EVENT = "event" // 保留所有的切片
+)
+
+// 流所在的应用是否配置为EVENT播放列表
+func (h *HLSStore) eventPlaylist(streamPath string) bool {
+	t, ok := h.PlaylistTypes[path.Dir(streamPath)]
+	return ok && t == HLS_PLAYLIST_EVENT
+}
+
+// 播放列表是否保留所有的切片,广播结束之前是EVENT,之后是VOD
+func (s *RtmpNetStream) hlsEvent() bool {
+	return s.rtmpFile.hls_playlist.PlaylistType != ""
+}
+
+// 切片开始的绝对时间. start是切片开始的时间戳, end是切片结束的时间戳.
+// 第一个切片在它结束的时候写完,之后的切片按照时间戳推算,不受写文件的时间影响
+func (s *RtmpNetStream) hlsProgramDateTime(start, end uint32) time.Time {
+	if s.rtmpFile.hls_pdt_start.IsZero() {
+		s.rtmpFile.hls_pdt_start = time.Now().Add(-time.Duration(end-start) * time.Millisecond)
+		s.rtmpFile.hls_pdt_offset = start
+	}
+
+	return s.rtmpFile.hls_pdt_start.Add(time.Duration(start-s.rtmpFile.hls_pdt_offset) * time.Millisecond)
+}
+
+// 开始发布EVENT播放列表的流的时候,继续这个流之前的存档(播放列表还在HLSStore中).
+// 不能继续的存档(无法解析,或者fMP4切片的存档之后是ts切片,#EXT-X-MAP对之后所有的切片有效)另存为 index-序号.m3u8,
+// 这次发布的播放列表从这次的切片开始
+func (s *RtmpNetStream) resumeHlsEvent() {
+	f, _, err := s.rtmpFile.hls_store.readFile(s.rtmpFile.hls_name)
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	archive, err := hls.Parse(data)
+	if err == nil {
+		s.skipHlsArchive(archive)
+	}
+
+	if err != nil || (archive.Map != "" && s.rtmpFile.hls_fmp4 == nil) {
+		name := "index-" + strconv.FormatUint(uint64(s.rtmpFile.hls_segment_count), 10) + ".m3u8"
+		fmt.Println("HLS archive can not be continued, stream :", s.streamPath, "saved as :", name)
+
+		if err = s.writeHlsFile(name, data); err != nil {
+			fmt.Println("HLS archive error :", err)
+		}
+
+		return
+	}
+
+	if len(archive.Segments) == 0 {
+		return
+	}
+
+	playlist := &s.rtmpFile.hls_playlist
+	playlist.Sequence = archive.Sequence
+	playlist.DiscontinuitySequence = archive.DiscontinuitySequence
+	playlist.Map = archive.Map
+
+	// 存档的切片可能比这次的目标时长长
+	if archive.Targetduration > playlist.Targetduration {
+		playlist.Targetduration = archive.Targetduration
+	}
+
+	if archive.Version > playlist.Version {
+		playlist.Version = archive.Version
+	}
+
+	// 存档的分片已经不在直播边缘,只保留完整的切片
+	for _, inf := range archive.Segments {
+		for _, part := range inf.Parts {
+			s.rtmpFile.hls_store.expire(path.Join(s.streamPath, part.Uri))
+		}
+
+		inf.Parts = nil
+		playlist.Segments = append(playlist.Segments, inf)
+	}
+
+	s.rtmpFile.hls_discontinuity = true
+}
+
+// 这次发布的切片和密钥的序号从存档中最大的序号之后开始
+func (s *RtmpNetStream) skipHlsArchive(archive *hls.Playlist) {
+	prefix := path.Base(s.streamPath) + "-"
+
+	for _, inf := range archive.Segments {
+		if n, ok := hlsFileNumber(inf.Title, prefix); ok && n >= s.rtmpFile.hls_segment_count {
+			s.rtmpFile.hls_segment_count = n + 1
+		}
+
+		if inf.Key == nil {
+			continue
+		}
+
+		if n, ok := hlsFileNumber(path.Base(inf.Key.Uri), "key-"); ok && n >= s.rtmpFile.hls_key_count {
+			s.rtmpFile.hls_key_count = n + 1
+		}
+	}
+}
+
+// 文件名 前缀 + 序号 + 扩展名 中的序号
+func hlsFileNumber(name, prefix string) (uint32, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+
+	name = strings.TrimPrefix(name, prefix)
+	if i := strings.Index(name, "."); i != -1 {
+		name = name[:i]
+	}
+
+	n, err := strconv.ParseUint(name, 10, 32)
+	return uint32(n), err == nil
+}
+
+// 广播结束,EVENT播放列表改为VOD
+func (s *RtmpNetStream) endHlsEvent() {
+	if s.hlsEvent() {
+		s.rtmpFile.hls_playlist.PlaylistType = hls.HLS_PLAYLIST_TYPE_VOD
+	}
+}
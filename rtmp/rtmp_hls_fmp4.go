@@ -0,0 +1,89 @@
+package rtmp
+
+import (
+	"path"
+	"strconv"
+)
+
+// fMP4(CMAF)切片的HLS.
+// HLSStore.SegmentTypes 中应用的切片格式配置为fmp4的时候,这个应用的流输出fMP4切片代替ts切片:
+//
+// #EXT-X-MAP:URI="init.mp4"
+// #EXTINF:5.000,
+// stream-0.m4s
+//
+// init.mp4 是初始化段(ftyp + moov),在第一个切片之前生成,之后的切片(stream-序号.m4s)是 moof + mdat.
+// 低延迟HLS的每个分片(stream-序号.分片序号.m4s)是一个 moof + mdat, 切片是它的分片连在一起.
+
+const (
+	HLS_SEGMENT_TYPE_TS   = "ts"   // MPEG-TS切片
+	HLS_SEGMENT_TYPE_FMP4 = "fmp4" // fMP4(CMAF)切片
+)
+
+// fMP4切片的初始化段的文件名,和播放列表在同一个目录下
+const HLS_INIT_NAME = "init.mp4"
+
+// 流所在的应用配置的切片格式,没有配置的时候是ts
+func (h *HLSStore) segmentType(streamPath string) string {
+	if t, ok := h.SegmentTypes[path.Dir(streamPath)]; ok && t == HLS_SEGMENT_TYPE_FMP4 {
+		return HLS_SEGMENT_TYPE_FMP4
+	}
+
+	return HLS_SEGMENT_TYPE_TS
+}
+
+// 切片和分片的扩展名
+func (s *RtmpNetStream) hlsSegmentExt() string {
+	if s.rtmpFile.hls_fmp4 != nil {
+		return ".m4s"
+	}
+
+	return ".ts"
+}
+
+// fMP4切片,视频帧加入到fMP4的封装中,在分片或者切片的时候写成 moof + mdat
+func (s *RtmpNetStream) writeHlsFmp4Video(video *AVPacket) {
+	// AVCPacketType, 1 = AVC NALU
+	if len(video.Payload) < 5 || video.Payload[1] != 1 {
+		return
+	}
+
+	// CompositionTime, 24 bits, 有符号
+	cts := int32(video.Payload[2])<<16 | int32(video.Payload[3])<<8 | int32(video.Payload[4])
+	if cts&0x800000 != 0 {
+		cts -= 0x1000000
+	}
+
+	s.rtmpFile.hls_fmp4.WriteVideo(video.Timestamp, cts, video.isKeyFrame(), video.Payload[5:])
+}
+
+// fMP4切片,将缓存的帧写成一个 moof + mdat 加到当前切片的数据中.
+// 第一次调用的时候先写初始化段,这时候已经知道有没有音频.
+// 继续存档的时候播放列表中已经有存档的初始化段,这次发布的初始化段是 init-第一个切片的序号.mp4,从这次的第一个切片开始使用
+func (s *RtmpNetStream) flushHlsFmp4(timestamp uint32) error {
+	m := s.rtmpFile.hls_fmp4
+	if m == nil || !m.Buffered() {
+		return nil
+	}
+
+	if s.rtmpFile.hls_init_name == "" {
+		name := HLS_INIT_NAME
+		if s.rtmpFile.hls_playlist.Map != "" {
+			name = "init-" + strconv.FormatUint(uint64(s.rtmpFile.hls_segment_count), 10) + ".mp4"
+		}
+
+		if err := s.writeHlsFile(name, m.InitSegment()); err != nil {
+			return err
+		}
+
+		s.rtmpFile.hls_init_name = name
+		if s.rtmpFile.hls_playlist.Map == "" {
+			s.rtmpFile.hls_playlist.Map = name
+		} else {
+			s.rtmpFile.hls_segment_map = name
+		}
+	}
+
+	s.rtmpFile.hls_segment_data.Write(m.Fragment(timestamp))
+	return nil
+}
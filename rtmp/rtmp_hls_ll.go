@@ -0,0 +1,212 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/hls"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// 低延迟HLS(LL-HLS).
+// 每个切片再分成PartDuration(大约200ms)的分片(#EXT-X-PART),分片生成之后马上更新播放列表,
+// 播放器可以在直播边缘的几个分片之后播放,延迟从几个切片的时长减少到1-2秒.
+//
+// GET /hls/app/stream/index.m3u8?_HLS_msn=N&_HLS_part=M 阻塞到播放列表中有媒体序列号为N的切片的第M个分片之后再返回,
+// 没有_HLS_part的时候阻塞到切片N完成之后返回.
+// 播放列表最后的#EXT-X-PRELOAD-HINT是下一个分片,请求还没有生成的这个分片的时候,阻塞到分片生成之后返回.
+//
+// stream-5.ts 是第5个切片, stream-5.0.ts, stream-5.1.ts ... 是组成这个切片的分片,ts数据是一样的
+
+const HLS_PART_DURATION = time.Millisecond * 200 // 分片的默认时长
+
+// 低延迟HLS的流正在生成的位置,用于阻塞的请求
+type hlsLive struct {
+	msn     int           // 正在生成的切片的媒体序列号
+	parts   int           // 正在生成的切片已经生成的分片个数
+	hint    string        // 下一个分片的文件名(#EXT-X-PRELOAD-HINT)
+	target  time.Duration // 目标时长,阻塞请求最多等待3倍的目标时长
+	ended   bool          // 广播已经结束,不会再更新
+	changed chan struct{} // 更新之后关闭,唤醒等待的请求
+}
+
+// 播放列表更新之后,更新流的位置并唤醒等待的请求. name是播放列表的文件名
+func (h *HLSStore) notify(name string, msn, parts int, hint string, target time.Duration, ended bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.lives == nil {
+		h.lives = make(map[string]*hlsLive)
+	}
+
+	live, ok := h.lives[name]
+	if !ok {
+		live = &hlsLive{changed: make(chan struct{})}
+		h.lives[name] = live
+	}
+
+	live.msn, live.parts, live.hint, live.target, live.ended = msn, parts, hint, target, ended
+
+	close(live.changed)
+	live.changed = make(chan struct{})
+}
+
+// 处理阻塞的播放列表请求(_HLS_msn, _HLS_part),返回0表示可以返回播放列表,否则是HTTP的错误码.
+// 请求的切片比播放列表中最后一个切片(正在生成的切片的前一个)晚两个以上的时候回复400 (6.2.5.2),
+// 3倍的目标时长之后还没有的时候回复503
+func (h *HLSStore) blockReload(r *http.Request, name string) int {
+	query := r.URL.Query()
+
+	msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return http.StatusBadRequest
+	}
+
+	part := -1
+	if v := query.Get("_HLS_part"); v != "" {
+		if part, err = strconv.Atoi(v); err != nil || part < 0 {
+			return http.StatusBadRequest
+		}
+	}
+
+	var timeout <-chan time.Time
+	for {
+		h.lock.RLock()
+		live, ok := h.lives[name]
+		if !ok {
+			// 不是低延迟HLS的流,或者已经删除,直接返回播放列表
+			h.lock.RUnlock()
+			return 0
+		}
+
+		if live.ended || msn < live.msn || (msn == live.msn && part >= 0 && part < live.parts) {
+			h.lock.RUnlock()
+			return 0
+		}
+
+		if msn > live.msn+1 {
+			h.lock.RUnlock()
+			return http.StatusBadRequest
+		}
+
+		changed, target := live.changed, live.target
+		h.lock.RUnlock()
+
+		if timeout == nil {
+			timer := time.NewTimer(3 * target)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return http.StatusServiceUnavailable
+		case <-r.Context().Done():
+			return http.StatusServiceUnavailable
+		}
+	}
+}
+
+// 请求的文件是还没有生成的下一个分片(#EXT-X-PRELOAD-HINT)的时候,等到分片生成之后返回true
+func (h *HLSStore) waitPreload(r *http.Request, name string) bool {
+	playlist := path.Dir(name) + "/" + HLS_PLAYLIST_NAME
+
+	h.lock.RLock()
+	live, ok := h.lives[playlist]
+	if !ok || live.ended || live.hint != name {
+		h.lock.RUnlock()
+		return false
+	}
+
+	changed, target := live.changed, live.target
+	h.lock.RUnlock()
+
+	timer := time.NewTimer(3 * target)
+	defer timer.Stop()
+
+	// 分片生成之后会更新播放列表,这时候下一个分片已经不是这个分片了
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// HLS输出低延迟HLS
+func (s *RtmpNetStream) hlsLowLatency() bool {
+	return s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.LowLatency
+}
+
+// 分片的文件名,例如 stream-5.2.ts
+func (s *RtmpNetStream) hlsPartFilename(segment uint32, part int) string {
+	return path.Base(s.streamPath) + "-" + strconv.FormatUint(uint64(segment), 10) + "." + strconv.Itoa(part) + s.hlsSegmentExt()
+}
+
+// 将当前分片(hls_part_offset之后缓存的ts数据)写成一个分片文件,更新播放列表.timestamp 是分片结束的时间戳
+func (s *RtmpNetStream) writeHlsPart(timestamp uint32) (err error) {
+	if err = s.flushHlsFmp4(timestamp); err != nil {
+		return
+	}
+
+	data := s.rtmpFile.hls_segment_data.Bytes()[s.rtmpFile.hls_part_offset:]
+	if len(data) == 0 {
+		return nil
+	}
+
+	var part []byte
+	if part, err = s.hlsSegmentData(data); err != nil {
+		return
+	}
+
+	filename := s.hlsPartFilename(s.rtmpFile.hls_segment_count, s.rtmpFile.hls_part_index)
+	if err = s.writeHlsFile(filename, part); err != nil {
+		return
+	}
+
+	var duration float64
+	if timestamp > s.rtmpFile.hls_part_time {
+		duration = float64(timestamp-s.rtmpFile.hls_part_time) / 1000
+	}
+
+	partial := s.rtmpFile.hls_playlist.Partial
+	partial.Key = s.rtmpFile.hls_key
+	partial.Discontinuity = s.rtmpFile.hls_discontinuity
+	partial.Map = s.rtmpFile.hls_segment_map
+	partial.Parts = append(partial.Parts, hls.PlaylistPart{
+		Duration:    duration,
+		Uri:         filename,
+		Independent: s.rtmpFile.hls_part_idr,
+	})
+
+	s.rtmpFile.hls_part_index++
+	s.rtmpFile.hls_part_offset = s.rtmpFile.hls_segment_data.Len()
+	s.rtmpFile.hls_part_time = timestamp
+	s.rtmpFile.hls_part_video = false
+	s.rtmpFile.hls_part_idr = false
+
+	s.rtmpFile.hls_playlist.PreloadHint = s.hlsPartFilename(s.rtmpFile.hls_segment_count, s.rtmpFile.hls_part_index)
+
+	if err = s.writeHlsPlaylist(); err != nil {
+		return
+	}
+
+	s.notifyHlsLive(false)
+	return nil
+}
+
+// 播放列表更新之后,唤醒等待这个流的阻塞请求
+func (s *RtmpNetStream) notifyHlsLive(ended bool) {
+	playlist := &s.rtmpFile.hls_playlist
+
+	parts := 0
+	if playlist.Partial != nil {
+		parts = len(playlist.Partial.Parts)
+	}
+
+	s.rtmpFile.hls_store.notify(s.rtmpFile.hls_name, playlist.Sequence+len(playlist.Segments), parts,
+		path.Join(s.streamPath, playlist.PreloadHint), time.Duration(playlist.Targetduration)*time.Second, ended)
+}
@@ -0,0 +1,160 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/onedss/gortmp/config"
+	"github.com/onedss/gortmp/hls"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type llhlsTestResponse struct {
+	code int
+	body []byte
+}
+
+// 在另一个goroutine中请求,阻塞的请求返回之后放入返回的通道
+func getLLHLSTest(url string) <-chan llhlsTestResponse {
+	c := make(chan llhlsTestResponse, 1)
+
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			c <- llhlsTestResponse{}
+			return
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		c <- llhlsTestResponse{code: res.StatusCode, body: body}
+	}()
+
+	return c
+}
+
+func waitLLHLSTest(t *testing.T, c <-chan llhlsTestResponse, what string) llhlsTestResponse {
+	t.Helper()
+
+	select {
+	case res := <-c:
+		if res.code != http.StatusOK {
+			t.Fatalf("%s: status %d", what, res.code)
+		}
+
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: timeout", what)
+	}
+
+	return llhlsTestResponse{}
+}
+
+func notReturnedLLHLSTest(t *testing.T, c <-chan llhlsTestResponse, what string) {
+	t.Helper()
+
+	select {
+	case res := <-c:
+		t.Fatalf("%s returned before the stream reached it : status %d", what, res.code)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// 推流过程中请求低延迟HLS:分片的布局,阻塞请求播放列表(_HLS_msn, _HLS_part),请求下一个分片(#EXT-X-PRELOAD-HINT)
+func TestLLHLSBlockingReload(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	s.HLS.LowLatency = true
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	// 切片0在第25帧(1000ms)完成,切片1正在生成,切片1的第一个分片在第30帧(1200ms)完成
+	writeTestH264(pub, 31)
+
+	base := "http://" + s.HTTPAddr + "/hls/live/test/"
+	playlist := waitTestPlaylist(t, base+HLS_PLAYLIST_NAME, func(p *hls.Playlist) bool {
+		return len(p.Segments) == 1 && p.Partial != nil && len(p.Partial.Parts) > 0
+	})
+
+	if !playlist.CanBlockReload || playlist.PartTarget != 0.2 || playlist.Sequence != 0 {
+		t.Errorf("can block reload = %v, part target = %v, sequence = %d", playlist.CanBlockReload, playlist.PartTarget, playlist.Sequence)
+	}
+
+	// 切片0由分片 test-0.0.ts, test-0.1.ts ... 组成,第一个分片从关键帧开始
+	seg := playlist.Segments[0]
+	if seg.Title != "test-0.ts" || len(seg.Parts) < 4 || !seg.Parts[0].Independent {
+		t.Fatalf("segment 0 = %+v", seg)
+	}
+
+	var total float64
+	for i, part := range seg.Parts {
+		if want := fmt.Sprintf("test-0.%d.ts", i); part.Uri != want {
+			t.Errorf("part %d uri = %s, want %s", i, part.Uri, want)
+		}
+
+		if part.Duration <= 0 || part.Duration > 0.2+0.04 {
+			t.Errorf("part %d duration = %v", i, part.Duration)
+		}
+
+		total += part.Duration
+	}
+
+	if math.Abs(total-seg.Duration) > 0.001 {
+		t.Errorf("parts duration = %v, segment duration = %v", total, seg.Duration)
+	}
+
+	if want := fmt.Sprintf("test-1.%d.ts", len(playlist.Partial.Parts)); playlist.PreloadHint != want {
+		t.Errorf("preload hint = %s, want %s", playlist.PreloadHint, want)
+	}
+
+	// 已经完成的切片马上返回;播放列表中最后一个切片是0,请求切片3的时候回复400
+	if res := waitLLHLSTest(t, getLLHLSTest(base+HLS_PLAYLIST_NAME+"?_HLS_msn=0"), "msn 0"); len(res.body) == 0 {
+		t.Error("msn 0: empty playlist")
+	}
+
+	if res := <-getLLHLSTest(base + HLS_PLAYLIST_NAME + "?_HLS_msn=3"); res.code != http.StatusBadRequest {
+		t.Errorf("msn 3: status %d, want 400", res.code)
+	}
+
+	// 还没有生成的切片和分片,阻塞到生成之后返回
+	reload := getLLHLSTest(base + HLS_PLAYLIST_NAME + "?_HLS_msn=2")
+	partReload := getLLHLSTest(base + HLS_PLAYLIST_NAME + "?_HLS_msn=1&_HLS_part=" + fmt.Sprint(len(playlist.Partial.Parts)+1))
+	preload := getLLHLSTest(base + playlist.PreloadHint)
+
+	notReturnedLLHLSTest(t, reload, "msn 2")
+	notReturnedLLHLSTest(t, partReload, "msn 1 part")
+	notReturnedLLHLSTest(t, preload, "preload hint")
+
+	writeTestH264Frames(pub, 31, 45)
+
+	res := waitLLHLSTest(t, preload, "preload hint")
+	if len(res.body) == 0 || res.body[0] != 0x47 {
+		t.Errorf("preload hint part = % x", res.body)
+	}
+
+	res = waitLLHLSTest(t, partReload, "msn 1 part")
+	if p, err := hls.Parse(res.body); err != nil || p.Partial == nil || len(p.Partial.Parts) < len(playlist.Partial.Parts)+2 {
+		t.Errorf("msn 1 part playlist = %+v, %v", p, err)
+	}
+
+	notReturnedLLHLSTest(t, reload, "msn 2")
+
+	// 切片1在第50帧完成,切片2在第75帧完成
+	writeTestH264Frames(pub, 45, 80)
+
+	res = waitLLHLSTest(t, reload, "msn 2")
+	if p, err := hls.Parse(res.body); err != nil || p.Sequence+len(p.Segments) <= 2 {
+		t.Errorf("msn 2 playlist = %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,596 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/onedss/gortmp/config"
+	"github.com/onedss/gortmp/hls"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 推n帧H.264(640x480),每帧40毫秒,每25帧一个关键帧
+func writeTestH264(pub *RtmpClient, n int) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1e, 0xab, 0x40, 0x50, 0x1e, 0xc8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	seq := []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}
+	seq = append(seq, sps...)
+	seq = append(seq, 1, 0, byte(len(pps)))
+	seq = append(seq, pps...)
+	pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Payload: seq})
+
+	writeTestH264Frames(pub, 0, n)
+}
+
+// 推第from帧到第to帧(不包括to)
+func writeTestH264Frames(pub *RtmpClient, from, to int) {
+	for i := from; i < to; i++ {
+		b := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 5, 0x41, 1, 2, 3, 4}
+		if i%25 == 0 {
+			b[0], b[9] = 0x17, 0x65
+		}
+
+		pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: uint32(i * 40), Payload: b})
+	}
+}
+
+func httpGetTest(t *testing.T, url string) []byte {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, res.Status)
+	}
+
+	return body
+}
+
+// 广播结束之后最后一个切片写完,播放列表有#EXT-X-ENDLIST
+func waitTestPlaylistEnd(t *testing.T, url string) *hls.Playlist {
+	t.Helper()
+
+	return waitTestPlaylist(t, url, func(p *hls.Playlist) bool { return p.EndList })
+}
+
+// 等到播放列表满足ok
+func waitTestPlaylist(t *testing.T, url string, ok func(*hls.Playlist) bool) *hls.Playlist {
+	t.Helper()
+
+	var playlist *hls.Playlist
+	for i := 0; playlist == nil || !ok(playlist); i++ {
+		if i == 100 {
+			t.Fatalf("timeout waiting for the playlist : %+v", playlist)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if res, err := http.Get(url); err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			playlist, _ = hls.Parse(body)
+		}
+	}
+
+	return playlist
+}
+
+func TestHLSStoreCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string) {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filename, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHLSStore(dir, false)
+	h.PlaylistTypes = map[string]string{"archive": HLS_PLAYLIST_EVENT}
+
+	// 服务器创建的流目录
+	write("live/test/index.m3u8")
+	write("live/test/test-0.ts")
+	write("live/test/init.mp4")
+	if err = h.markStream("live/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有标记的目录和文件,例如和HLS_Path重叠的录制目录
+	write("vod/movie.mp4")
+	write("vod/clip/index.m3u8")
+	write("top.ts")
+
+	// EVENT播放列表的存档
+	write("archive/test/index.m3u8")
+	if err = h.markStream("archive/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "live")); !os.IsNotExist(err) {
+		t.Errorf("live: want removed, got %v", err)
+	}
+
+	for _, name := range []string{"vod/movie.mp4", "vod/clip/index.m3u8", "top.ts", "archive/test/index.m3u8", "archive/test/" + HLS_STREAM_MARKER} {
+		if _, err = os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: want kept, got %v", name, err)
+		}
+	}
+}
+
+func TestHLSEncryptedSegments(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	s.HLS.Encrypt = true
+	s.HLS.KeyRotate = 2
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestH264(pub, 100)
+	pub.Close()
+
+	base := "http://" + s.HTTPAddr + "/hls/live/test/"
+	playlist := waitTestPlaylistEnd(t, base+HLS_PLAYLIST_NAME)
+
+	if len(playlist.Segments) != 4 {
+		t.Fatalf("segments = %d, want 4", len(playlist.Segments))
+	}
+
+	// 目标时长是hls_max_fragment(默认是hls_fragment的2倍)
+	if playlist.Targetduration != 2 {
+		t.Errorf("target duration = %d, want 2", playlist.Targetduration)
+	}
+
+	keys := make(map[string]bool)
+	for i, inf := range playlist.Segments {
+		if inf.Key == nil || inf.Key.Method != hls.HLS_KEY_METHOD_AES_128 {
+			t.Fatalf("segment %d: key = %+v", i, inf.Key)
+		}
+
+		keys[inf.Key.Uri] = true
+
+		key := httpGetTest(t, base+inf.Key.Uri)
+		iv, err := hex.DecodeString(strings.TrimPrefix(inf.Key.IV, "0x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segment, err := hls.DecryptSegment(httpGetTest(t, base+inf.Title), key, iv)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+
+		if len(segment) == 0 || len(segment)%188 != 0 {
+			t.Fatalf("segment %d: length = %d", i, len(segment))
+		}
+
+		for j := 0; j < len(segment); j += 188 {
+			if segment[j] != 0x47 {
+				t.Fatalf("segment %d: sync byte at %d = %#x", i, j, segment[j])
+			}
+		}
+	}
+
+	// 每2个切片换一个密钥
+	if len(keys) != 2 {
+		t.Errorf("keys = %v, want 2 keys", keys)
+	}
+}
+
+// fmp4应用的流:播放列表引用初始化段(#EXT-X-MAP),切片是一个或多个 moof + mdat
+func TestHLSFmp4Segments(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	s.HLS.SegmentTypes = map[string]string{"live": HLS_SEGMENT_TYPE_FMP4}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestH264(pub, 50)
+	pub.Close()
+
+	base := "http://" + s.HTTPAddr + "/hls/live/test/"
+	playlist := waitTestPlaylistEnd(t, base+HLS_PLAYLIST_NAME)
+
+	if playlist.Version != 7 || playlist.Map != HLS_INIT_NAME || len(playlist.Segments) != 2 {
+		t.Fatalf("version = %d, map = %q, segments = %d", playlist.Version, playlist.Map, len(playlist.Segments))
+	}
+
+	for i, inf := range playlist.Segments {
+		if want := fmt.Sprintf("test-%d.m4s", i); inf.Title != want {
+			t.Errorf("segment %d = %s, want %s", i, inf.Title, want)
+		}
+	}
+
+	// 顶层的box按大小排满整个文件
+	boxTypes := func(name string, b []byte) []string {
+		var types []string
+		for i := 0; i < len(b); {
+			size := 0
+			if len(b)-i >= 8 {
+				size = int(binary.BigEndian.Uint32(b[i:]))
+			}
+
+			if size < 8 || i+size > len(b) {
+				t.Fatalf("%s: bad box at %d, %d bytes left", name, i, len(b)-i)
+			}
+
+			types = append(types, string(b[i+4:i+8]))
+			i += size
+		}
+
+		return types
+	}
+
+	for _, want := range []struct {
+		name        string
+		contentType string
+		types       string
+	}{
+		{HLS_INIT_NAME, "video/mp4", "ftyp moov"},
+		{playlist.Segments[0].Title, "video/iso.segment", "moof mdat"},
+		{playlist.Segments[1].Title, "video/iso.segment", "moof mdat"},
+	} {
+		res, err := http.Get(base + want.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != want.contentType {
+			t.Fatalf("%s: status %d, Content-Type %q", want.name, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+
+		// 没有低延迟HLS的时候每个切片是一个 moof + mdat
+		if types := strings.Join(boxTypes(want.name, body), " "); types != want.types {
+			t.Errorf("%s: boxes = %s, want %s", want.name, types, want.types)
+		}
+	}
+}
+
+func TestHLSVariantMaxFragment(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	s.HLS.Variants = map[string][]string{"live": {"_720"}}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test_720")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有第一帧是关键帧,GOP比hls_max_fragment长
+	writeTestH264(pub, 1)
+	for i := 1; i < 100; i++ {
+		b := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 5, 0x41, 1, 2, 3, 4}
+		pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: uint32(i * 40), Payload: b})
+	}
+	pub.Close()
+
+	url := "http://" + s.HTTPAddr + "/hls/live/test_720/" + HLS_PLAYLIST_NAME
+	var playlist *hls.Playlist
+	for i := 0; playlist == nil || !playlist.EndList; i++ {
+		if i == 100 {
+			t.Fatal("timeout waiting for the playlist to end")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if res, err := http.Get(url); err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			playlist, _ = hls.Parse(body)
+		}
+	}
+
+	// 达到hls_max_fragment(2秒)的时候不等关键帧切片
+	if len(playlist.Segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(playlist.Segments))
+	}
+
+	for i, inf := range playlist.Segments {
+		if int(inf.Duration+0.5) > playlist.Targetduration {
+			t.Errorf("segment %d: duration %.3f exceeds target duration %d", i, inf.Duration, playlist.Targetduration)
+		}
+	}
+}
+
+// 切片只缓存HLSStore.Grace,在切片被删除之前过期
+func TestHLSSegmentCacheControl(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestH264(pub, 50)
+	pub.Close()
+
+	base := "http://" + s.HTTPAddr + "/hls/live/test/"
+	playlist := waitTestPlaylistEnd(t, base+HLS_PLAYLIST_NAME)
+
+	res, err := http.Get(base + playlist.Segments[0].Title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=10" {
+		t.Errorf("segment Cache-Control = %q", cc)
+	}
+
+	s.HLS.Grace = 0
+	if cc := s.HLS.segmentCacheControl(); cc != "no-cache" {
+		t.Errorf("Cache-Control without grace = %q", cc)
+	}
+}
+
+// 重新发布之后切片和密钥继续编号,媒体序列号不会变小,上一次发布的切片不会被覆盖
+func TestHLSRepublishSequence(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore("", true)}
+	s.HLS.Encrypt = true
+	startTestServer(t, s)
+
+	base := "http://" + s.HTTPAddr + "/hls/live/test/"
+	publish := func() *hls.Playlist {
+		pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeTestH264(pub, 50)
+		pub.Close()
+
+		// 等广播结束,之后才能重新发布
+		for i := 0; ; i++ {
+			if _, ok := s.Streams.Find("live/test"); !ok {
+				break
+			}
+
+			if i == 100 {
+				t.Fatal("timeout waiting for the broadcast to stop")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return waitTestPlaylistEnd(t, base+HLS_PLAYLIST_NAME)
+	}
+
+	first := publish()
+	if len(first.Segments) == 0 {
+		t.Fatal("no segments")
+	}
+
+	old := make(map[string][]byte)
+	for _, inf := range first.Segments {
+		old[inf.Title] = httpGetTest(t, base+inf.Title)
+	}
+
+	second := publish()
+	if last := first.Sequence + len(first.Segments) - 1; second.Sequence <= last {
+		t.Errorf("media sequence after republish = %d, want > %d", second.Sequence, last)
+	}
+
+	for _, inf := range second.Segments {
+		if _, ok := old[inf.Title]; ok {
+			t.Errorf("segment %s reused after republish", inf.Title)
+		}
+
+		if inf.Key.Uri == first.Segments[0].Key.Uri {
+			t.Errorf("key %s reused after republish", inf.Key.Uri)
+		}
+	}
+
+	for name, data := range old {
+		if !bytes.Equal(httpGetTest(t, base+name), data) {
+			t.Errorf("segment %s overwritten after republish", name)
+		}
+	}
+}
+
+// EVENT播放列表的存档,服务器重启之后重新发布同一个流:播放列表保留存档中的切片,
+// 这次发布的切片接着存档编号,前面有#EXT-X-DISCONTINUITY和这次的初始化段,存档中的文件不会被覆盖
+func TestHLSEventArchiveResume(t *testing.T) {
+	defer func(fragment int64, window int) {
+		config.HLSFragment, config.HLSWindow = fragment, window
+	}(config.HLSFragment, config.HLSWindow)
+	config.HLSFragment, config.HLSWindow = 1, 10
+
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { config.HLSPath = path }(config.HLSPath)
+	config.HLSPath = dir
+
+	// 每次都是新的服务器和HLSStore,相当于重启之后发布
+	publish := func() (*Server, *hls.Playlist) {
+		s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t), HLS: NewHLSStore(dir, false)}
+		s.HLS.PlaylistTypes = map[string]string{"archive": HLS_PLAYLIST_EVENT}
+		s.HLS.SegmentTypes = map[string]string{"archive": HLS_SEGMENT_TYPE_FMP4}
+		s.HLS.Encrypt = true
+		startTestServer(t, s)
+
+		pub, err := DialPublish("rtmp://" + s.Addr + "/archive/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeTestH264(pub, 50)
+		pub.Close()
+
+		return s, waitTestPlaylistEnd(t, "http://"+s.HTTPAddr+"/hls/archive/test/"+HLS_PLAYLIST_NAME)
+	}
+
+	_, first := publish()
+	if len(first.Segments) == 0 || first.Map != HLS_INIT_NAME {
+		t.Fatalf("segments = %d, map = %q", len(first.Segments), first.Map)
+	}
+
+	// 存档中的文件,播放列表和标记文件除外
+	stream := filepath.Join(dir, "archive", "test")
+	archived := make(map[string][]byte)
+	files, err := ioutil.ReadDir(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range files {
+		if name := info.Name(); name != HLS_PLAYLIST_NAME && name != HLS_STREAM_MARKER {
+			if archived[name], err = ioutil.ReadFile(filepath.Join(stream, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s, second := publish()
+	if second.Sequence != first.Sequence || second.PlaylistType != hls.HLS_PLAYLIST_TYPE_VOD || second.Map != first.Map {
+		t.Errorf("sequence = %d, playlist type = %s, map = %q", second.Sequence, second.PlaylistType, second.Map)
+	}
+
+	if len(second.Segments) <= len(first.Segments) {
+		t.Fatalf("segments = %d, want more than the %d archived", len(second.Segments), len(first.Segments))
+	}
+
+	for i, inf := range first.Segments {
+		if got := second.Segments[i]; got.Title != inf.Title || got.Key.Uri != inf.Key.Uri || got.Discontinuity {
+			t.Errorf("archived segment %d = %+v, want %+v", i, got, inf)
+		}
+	}
+
+	resumed := second.Segments[len(first.Segments)]
+	if !resumed.Discontinuity || resumed.Map != "init-"+strconv.Itoa(len(first.Segments))+".mp4" {
+		t.Errorf("first resumed segment = %+v", resumed)
+	}
+
+	base := "http://" + s.HTTPAddr + "/hls/archive/test/"
+	for _, inf := range second.Segments[len(first.Segments):] {
+		if _, ok := archived[inf.Title]; ok {
+			t.Errorf("segment %s reused after republish", inf.Title)
+		}
+
+		if _, ok := archived[path.Base(inf.Key.Uri)]; ok {
+			t.Errorf("key %s reused after republish", inf.Key.Uri)
+		}
+
+		httpGetTest(t, base+inf.Title)
+	}
+
+	httpGetTest(t, base+resumed.Map)
+
+	for name, data := range archived {
+		if now, err := ioutil.ReadFile(filepath.Join(stream, name)); err != nil || !bytes.Equal(now, data) {
+			t.Errorf("archived %s overwritten after republish : %v", name, err)
+		}
+	}
+}
+
+// 切片离开滑动窗口之后,在Grace之内被重新写过的时候不删除
+func TestHLSExpireRewritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.MkdirAll(filepath.Join(dir, "live", "test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, memory := range []bool{true, false} {
+		h := NewHLSStore(dir, memory)
+		h.Grace = 50 * time.Millisecond
+
+		for _, name := range []string{"live/test/test-0.ts", "live/test/test-1.ts"} {
+			if err = h.putFile(name, []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			h.expire(name)
+		}
+
+		// test-0.ts 在删除之前被重新写了
+		if err = h.putFile("live/test/test-0.ts", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		if f, _, err := h.readFile("live/test/test-0.ts"); err != nil {
+			t.Errorf("memory %v: rewritten segment removed : %v", memory, err)
+		} else if data, _ := ioutil.ReadAll(f); string(data) != "new" {
+			t.Errorf("memory %v: rewritten segment = %q", memory, data)
+		}
+
+		if _, _, err = h.readFile("live/test/test-1.ts"); !os.IsNotExist(err) {
+			t.Errorf("memory %v: expired segment not removed : %v", memory, err)
+		}
+	}
+}
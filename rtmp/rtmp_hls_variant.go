@@ -0,0 +1,151 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onedss/gortmp/avformat"
+	"github.com/onedss/gortmp/hls"
+	"path"
+	"strings"
+)
+
+// 多码率的HLS.
+// 编码器同时推同一个内容的几个版本,例如 live/stream_720, live/stream_480,
+// HLSStore.Variants 中配置了应用live的后缀 _720,_480 之后,这两个流是分组 live/stream 的两个版本,
+// 主播放列表是 live/stream.m3u8 (URL: /hls/live/stream.m3u8),每个版本一个#EXT-X-STREAM-INF,指向这个版本的媒体播放列表:
+//
+// #EXT-X-STREAM-INF:BANDWIDTH=2500000,AVERAGE-BANDWIDTH=2200000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"
+// stream_720/index.m3u8
+//
+// 码率根据切片的大小和时长计算,分辨率和编码来自AVCDecoderConfigurationRecord(SPS)和AudioSpecificConfig.
+// 同一个分组的流在同样的时间戳的关键帧切片,只要编码器的关键帧是对齐的,各个版本的切片就是对齐的.
+
+// 一个分组的主播放列表
+type hlsMaster struct {
+	variants map[string]hls.VariantStream // 流名称 -> 版本
+	data     []byte                       // 上次写的主播放列表
+}
+
+// 流所在的分组,例如 live/stream_720 -> live/stream, 不属于任何分组的时候返回空
+func (h *HLSStore) variantGroup(streamPath string) string {
+	app, name := path.Dir(streamPath), path.Base(streamPath)
+
+	for _, suffix := range h.Variants[app] {
+		if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return path.Join(app, strings.TrimSuffix(name, suffix))
+		}
+	}
+
+	return ""
+}
+
+// 更新分组中一个版本的信息,主播放列表变化的时候重新写
+func (h *HLSStore) updateVariant(group, name string, v hls.VariantStream) {
+	h.masterLock.Lock()
+	defer h.masterLock.Unlock()
+
+	if h.masters == nil {
+		h.masters = make(map[string]*hlsMaster)
+	}
+
+	m, ok := h.masters[group]
+	if !ok {
+		m = &hlsMaster{variants: make(map[string]hls.VariantStream)}
+		h.masters[group] = m
+	}
+
+	m.variants[name] = v
+	h.writeMasterLocked(group, m)
+}
+
+// 这个版本的HLS文件删除之后,从主播放列表中删除.没有版本的时候删除主播放列表
+func (h *HLSStore) removeVariant(group, name string) {
+	h.masterLock.Lock()
+	defer h.masterLock.Unlock()
+
+	m, ok := h.masters[group]
+	if !ok {
+		return
+	}
+
+	delete(m.variants, name)
+	if len(m.variants) == 0 {
+		delete(h.masters, group)
+		h.remove(group + ".m3u8")
+		return
+	}
+
+	h.writeMasterLocked(group, m)
+}
+
+// 按照配置的后缀的顺序生成主播放列表,调用的时候持有masterLock
+func (h *HLSStore) writeMasterLocked(group string, m *hlsMaster) {
+	master := hls.MasterPlaylist{Version: 3}
+
+	app, base := path.Dir(group), path.Base(group)
+	for _, suffix := range h.Variants[app] {
+		if v, ok := m.variants[base+suffix]; ok {
+			master.Variants = append(master.Variants, v)
+		}
+	}
+
+	data := master.Encode()
+	if bytes.Equal(data, m.data) {
+		return
+	}
+
+	if err := h.putFile(group+".m3u8", data); err != nil {
+		fmt.Println("HLS master playlist error :", err)
+		return
+	}
+
+	m.data = data
+}
+
+// 根据切片的大小和时长计算码率,主播放列表和DASH的MPD使用
+func (s *RtmpNetStream) updateHlsBandwidth(size int, duration float64) {
+	if duration <= 0 {
+		return
+	}
+
+	if bandwidth := int(float64(size*8) / duration); bandwidth > s.rtmpFile.hls_bandwidth {
+		s.rtmpFile.hls_bandwidth = bandwidth
+	}
+
+	s.rtmpFile.hls_bytes += int64(size)
+	s.rtmpFile.hls_duration += duration
+}
+
+// 更新主播放列表中这个流的版本.
+// BANDWIDTH是切片码率的最大值,AVERAGE-BANDWIDTH是这次发布的平均码率
+func (s *RtmpNetStream) updateHlsVariant() {
+	if s.rtmpFile.hls_duration <= 0 {
+		return
+	}
+
+	name := path.Base(s.streamPath)
+	v := hls.VariantStream{
+		Bandwidth:        s.rtmpFile.hls_bandwidth,
+		AverageBandwidth: int(float64(s.rtmpFile.hls_bytes*8) / s.rtmpFile.hls_duration),
+		Codecs:           s.hlsCodecs(),
+		Uri:              name + "/" + HLS_PLAYLIST_NAME,
+	}
+
+	if width, height, err := avformat.ParseSPSResolution(s.rtmpFile.avc.SequenceParameterSetNALUnit); err == nil {
+		v.Resolution = fmt.Sprintf("%dx%d", width, height)
+	}
+
+	s.rtmpFile.hls_store.updateVariant(s.rtmpFile.hls_group, name, v)
+}
+
+// RFC 6381 的编码字符串, H.264: avc1.PPCCLL (profile, 兼容性, level), AAC: mp4a.40.AudioObjectType
+func (s *RtmpNetStream) hlsCodecs() string {
+	avc := s.rtmpFile.avc
+	codecs := fmt.Sprintf("avc1.%02x%02x%02x", avc.AVCProfileIndication, avc.ProfileCompatibility, avc.AVCLevelIndication)
+
+	if s.rtmpFile.atwrite {
+		codecs += fmt.Sprintf(",mp4a.40.%d", s.rtmpFile.asc.AudioObjectType)
+	}
+
+	return codecs
+}
@@ -0,0 +1,39 @@
+package rtmp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HTTP服务.
+// 和RTMP的监听同时运行,提供HTTP-FLV的直播播放,HLS和DASH.
+// GET /app/stream.flv --> HTTP-FLV
+// ws://host/app/stream.flv --> WebSocket-FLV
+// GET /hls/app/stream.m3u8, /hls/app/xxx.ts, /hls/app/xxx.m4s, /hls/app/xxx.key --> HLS
+// GET /dash/app/stream.mpd, /dash/app/stream/init.mp4, /dash/app/stream/xxx.m4s --> DASH
+
+// 在HTTP监听上开始处理请求,不会阻塞.调用的时候持有connLock
+func (s *Server) serveHTTPLocked(l net.Listener) {
+	s.httpServer = &http.Server{Handler: s}
+	go s.httpServer.Serve(l)
+}
+
+// 根据请求的路径选择处理的方法
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/hls/"):
+		s.serveHLS(w, r)
+	case strings.HasPrefix(r.URL.Path, "/dash/"):
+		s.serveDASH(w, r)
+	case strings.HasSuffix(r.URL.Path, ".flv"):
+		s.serveFLV(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
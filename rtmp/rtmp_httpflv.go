@@ -0,0 +1,295 @@
+package rtmp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/onedss/gortmp/avformat"
+	"github.com/onedss/gortmp/util"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var errFlvSubscriberClosed = errors.New("flv subscriber closed")
+
+// HTTP-FLV播放者.
+// GET /app/stream.flv, 响应是一个没有长度的FLV文件(chunked),浏览器可以用flv.js播放.
+// ws://host/app/stream.flv, 同样的FLV数据放在WebSocket的二进制帧中,适合会缓存chunked响应的代理后面的播放器.
+// 在广播中和RTMP的播放者一样是一个普通的订阅者,有自己的发送队列和goroutine.
+// 先写FLV头和元数据,从第一个关键帧开始,在关键帧之前写AVC sequence header和AAC sequence header,
+// 时间戳从0开始.
+type FlvSubscriber struct {
+	w          *bufio.Writer // 写到HTTP响应
+	flusher    http.Flusher  // 每个tag之后刷新到客户端
+	remoteAddr string        // 客户端地址
+	streamPath string        // 播放的流路径
+	broadcast  *Broadcast    // 订阅的广播
+	header     bool          // 已经写了FLV头
+	started    bool          // 已经写了sequence header,开始写音视频
+	base       uint32        // 第一个音视频包的时间戳,之后的时间戳都减去这个值
+	lock       sync.Mutex    // guards closed
+	closed     bool          // 关闭之后不再写
+	done       chan struct{} // 关闭之后结束HTTP响应
+}
+
+func newFlvSubscriber(w io.Writer, remoteAddr, streamPath string) *FlvSubscriber {
+	f := &FlvSubscriber{
+		w:          bufio.NewWriter(w),
+		remoteAddr: remoteAddr,
+		streamPath: streamPath,
+		done:       make(chan struct{})}
+
+	f.flusher, _ = w.(http.Flusher)
+	return f
+}
+
+// 处理 GET /app/stream.flv (HTTP-FLV或者WebSocket-FLV), 一直阻塞到广播结束或者客户端断开.
+// HEAD 在流存在的时候只返回响应头
+func (s *Server) serveFLV(w http.ResponseWriter, r *http.Request) {
+	streamPath := strings.TrimSuffix(strings.Trim(r.URL.Path, "/"), ".flv")
+
+	b, ok := find_broadcast(s.Streams, streamPath)
+	if !ok {
+		http.Error(w, "stream not found : "+streamPath, http.StatusNotFound)
+		return
+	}
+
+	// WebSocket-FLV, 同样的FLV数据放在WebSocket的二进制帧中
+	var out io.Writer = w
+	gone := r.Context().Done()
+	if isWebSocketUpgrade(r) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			fmt.Println("WebSocket-FLV upgrade error :", err)
+			return
+		}
+
+		defer ws.Close()
+		go ws.readLoop()
+
+		out = ws
+		gone = ws.closed
+	} else {
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+
+		// HEAD 只返回响应头,不订阅广播
+		if r.Method == http.MethodHead {
+			return
+		}
+	}
+
+	f := newFlvSubscriber(out, r.RemoteAddr, streamPath)
+	f.broadcast = b
+	if !b.join(f) { // 这里会添加订阅者,广播已经结束的时候直接结束响应
+		return
+	}
+
+	fmt.Println("HTTP-FLV play, remoteAddr :", f.remoteAddr, "\npath :", streamPath)
+
+	select {
+	case <-f.done:
+	case <-b.done:
+	case <-gone:
+	}
+
+	f.Close()
+}
+
+func (f *FlvSubscriber) SendVideo(video *AVPacket) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errFlvSubscriberClosed
+	}
+
+	if !f.started {
+		if !video.isKeyFrame() {
+			return nil
+		}
+
+		if err := f.start(video.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	return f.writeTag(video)
+}
+
+func (f *FlvSubscriber) SendAudio(audio *AVPacket) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errFlvSubscriberClosed
+	}
+
+	// 有视频的时候从第一个关键帧开始,只有音频的时候从第一个音频包开始
+	if !f.started {
+		if vTag, _ := f.broadcast.publisher.sequenceHeaders(); vTag != nil {
+			return nil
+		}
+
+		if err := f.start(audio.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	return f.writeTag(audio)
+}
+
+// 只写AMF0的数据消息(onMetaData...),FLV的script tag只支持AMF0
+func (f *FlvSubscriber) SendData(data *AVPacket) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errFlvSubscriberClosed
+	}
+
+	if data.Type != RTMP_MSG_AMF0_METADATA {
+		return nil
+	}
+
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+
+	if !f.started {
+		data.Timestamp = f.base
+	}
+
+	return f.writeTag(data)
+}
+
+// 写FLV头,音频和视频的标志根据发布者是否发布了音频和视频
+func (f *FlvSubscriber) writeHeader() error {
+	if f.header {
+		return nil
+	}
+
+	header := avformat.FLVHeader{
+		SignatureF: 0x46,
+		SignatureL: 0x4C,
+		SignatureV: 0x56,
+		Version:    0x01,
+		DataOffse:  9,
+	}
+
+	vTag, aTag := f.broadcast.publisher.sequenceHeaders()
+	if aTag != nil {
+		header.TypeFlagsAudio = 1
+	}
+
+	if vTag != nil {
+		header.TypeFlagsVideo = 1
+	}
+
+	if err := avformat.WriteFLVHeader(f.w, header); err != nil {
+		return err
+	}
+
+	// PreviousTagSize0 == 0x00000000
+	if err := util.WriteUint32ToByte(f.w, 0x00000000, true); err != nil {
+		return err
+	}
+
+	f.header = true
+	return nil
+}
+
+// 写FLV头和AVC sequence header,AAC sequence header, base是第一个音视频包的时间戳
+func (f *FlvSubscriber) start(base uint32) error {
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+
+	f.base = base
+
+	vTag, aTag := f.broadcast.publisher.sequenceHeaders()
+	for _, tag := range []*AVPacket{vTag, aTag} {
+		if tag == nil {
+			continue
+		}
+
+		header := tag.Clone()
+		header.Timestamp = base
+		if err := f.writeTag(header); err != nil {
+			return err
+		}
+	}
+
+	f.started = true
+	return nil
+}
+
+// 时间戳减去第一个音视频包的时间戳,音频可能比第一个关键帧早一点,这时候时间戳为0
+func (f *FlvSubscriber) writeTag(pkt *AVPacket) error {
+	if pkt.Timestamp > f.base {
+		pkt.Timestamp -= f.base
+	} else {
+		pkt.Timestamp = 0
+	}
+
+	if err := writeFLVTag(f.w, pkt); err != nil {
+		return err
+	}
+
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+
+	return nil
+}
+
+func (f *FlvSubscriber) subscriberID() string {
+	return "flv:" + f.remoteAddr
+}
+
+func (f *FlvSubscriber) subscriberClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+func (f *FlvSubscriber) subscriberError(err error) {
+	fmt.Printf("HTTP-FLV OnError, remoteAddr : %v\npath : %v\nerror : %v\n", f.remoteAddr, f.streamPath, err)
+	f.Close()
+}
+
+// 广播结束,已经从广播中删除,只需要结束HTTP响应.
+// 可能正在写一个网络不好的客户端,不阻塞广播的goroutine
+func (f *FlvSubscriber) closeSubscriber(notify bool) {
+	go f.close()
+}
+
+// 客户端断开或者发送失败,结束HTTP响应,并从广播中删除
+func (f *FlvSubscriber) Close() {
+	if f.close() && f.broadcast != nil {
+		f.broadcast.send(f)
+	}
+}
+
+// 正在写的时候会等待写完,之后不会再写HTTP响应.第一次关闭的时候返回true
+func (f *FlvSubscriber) close() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return false
+	}
+
+	f.closed = true
+	close(f.done)
+	fmt.Println("HTTP-FLV closed, remoteAddr :", f.remoteAddr, "\npath :", f.streamPath)
+	return true
+}
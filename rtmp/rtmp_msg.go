@@ -95,6 +95,7 @@ func newRtmpHeader(chunkID uint32, timestamp uint32, messageLength uint32, messa
 func (h *RtmpHeader) Clone() *RtmpHeader {
 	head := new(RtmpHeader)
 	head.ChunkBasicHeader.ChunkStreamID = h.ChunkBasicHeader.ChunkStreamID
+	head.ChunkBasicHeader.ChunkType = h.ChunkBasicHeader.ChunkType
 	head.ChunkMessgaeHeader.Timestamp = h.ChunkMessgaeHeader.Timestamp
 	head.ChunkMessgaeHeader.MessageLength = h.ChunkMessgaeHeader.MessageLength
 	head.ChunkMessgaeHeader.MessageTypeID = h.ChunkMessgaeHeader.MessageTypeID
@@ -500,8 +501,9 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.CommandName = cmd
-			m.Properties = readObject(amf)
-			m.Infomation = readObject(amf)
+			m.TransactionId = readTransactionId(amf)
+			m.Properties, _ = amf.decodeObject() // 可能是null
+			m.Infomation, _ = amf.decodeObject() // 可能是对象,也可能是数字(createStream的响应中为流ID)
 			return m
 		}
 	case "onStatus":
@@ -510,8 +512,9 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.CommandName = cmd
-			m.Properties = readObject(amf)
-			m.Infomation = readObject(amf)
+			m.TransactionId = readTransactionId(amf)
+			m.Properties, _ = amf.decodeObject() // 可能是null
+			m.Infomation, _ = amf.decodeObject() // 可能是对象,也可能是数字(createStream的响应中为流ID)
 			return m
 		}
 	case "_error":
@@ -520,8 +523,9 @@ func decodeCommandAMF0(head *RtmpHeader, body *RtmpBody) RtmpMessage {
 			m.RtmpHeader = head
 			m.RtmpBody = body
 			m.CommandName = cmd
-			m.Properties = readObject(amf)
-			m.Infomation = readObject(amf)
+			m.TransactionId = readTransactionId(amf)
+			m.Properties, _ = amf.decodeObject() // 可能是null
+			m.Infomation, _ = amf.decodeObject() // 可能是对象,也可能是数字(createStream的响应中为流ID)
 			return m
 		}
 	case "FCPublish":
@@ -1190,6 +1194,8 @@ func (msg *CreateStreamMessage) Encode0() {
 
 	if msg.Object != nil {
 		amf.encodeObject(msg.Object.(AMFObjects))
+	} else {
+		amf.writeNull() // 命令对象,没有的时候为null
 	}
 
 	msg.RtmpBody.Payload = amf.Bytes()
@@ -1265,14 +1271,16 @@ func (msg *PlayMessage) Encode0() {
 	amf.writeNull()
 	amf.writeString(msg.StreamName)
 
+	// 后面的参数都是可选的,但是按照位置解析,只有前面的参数存在,后面的参数才能存在
 	if msg.Start > 0 {
 		amf.writeNumber(float64(msg.Start))
-	}
-	if msg.Duration > 0 {
-		amf.writeNumber(float64(msg.Duration))
+
+		if msg.Duration > 0 {
+			amf.writeNumber(float64(msg.Duration))
+			amf.writeBool(msg.Rest)
+		}
 	}
 
-	amf.writeBool(msg.Rest)
 	msg.RtmpBody.Payload = amf.Bytes()
 }
 
@@ -1479,6 +1487,13 @@ func newPublishMessage() *PublishMessage {
 // “live”:发布直播数据而不录制到文件
 
 func (msg *PublishMessage) Encode0() {
+	amf := newAMFEncoder()
+	amf.writeString(msg.CommandName)
+	amf.writeNumber(float64(msg.TransactionId))
+	amf.writeNull()
+	amf.writeString(msg.PublishingName)
+	amf.writeString(msg.PublishingType)
+	msg.RtmpBody.Payload = amf.Bytes()
 }
 
 func (msg *PublishMessage) Header() *RtmpHeader {
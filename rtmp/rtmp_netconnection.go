@@ -2,7 +2,10 @@ package rtmp
 
 import (
 	"bufio"
+	"errors"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,18 +39,24 @@ type RtmpNetConnection struct {
 	bw                 *bufio.Writer               // Write
 	brw                *bufio.ReadWriter           // Read and Write,用来握手
 	lock               *sync.Mutex                 // lock
+	wlock              *sync.Mutex                 // 写块的锁,发送音视频的goroutine和读消息的goroutine(发送确认消息)可能同时写
 	incompleteRtmpBody map[uint32][]byte           // 完整的RtmpBody,在网络上是被分成一块一块的,需要将其组装起来
 	rtmpHeader         map[uint32]*RtmpHeader      // RtmpHeader
 	connected          bool                        // 连接是否完成
 	nextStreamID       func(chunkid uint32) uint32 // 下一个流ID
 	streamID           uint32                      // 流ID
+	lastStreamID       uint32                      // 上一次分配的流ID,每个连接从64开始分配
+	beginTime          time.Time                   // 连接建立的时间,发布的流开始广播的时候打印间隔
+	transactionID      uint64                      // 客户端发送命令消息的传输ID
+	readTimeout        time.Duration               // 读一个消息的超时时间,0表示不超时
+	writeTimeout       time.Duration               // 写一个块的超时时间,0表示不超时
+	appQuery           url.Values                  // 应用名(或者tcUrl)后面的参数.(例如myapp?key=value)
 }
 
-var gstreamid = uint32(64)
-
-func gen_next_stream_id(chunkid uint32) uint32 {
-	gstreamid += 1
-	return gstreamid
+// 分配下一个流ID.只在连接读消息的goroutine中调用(createStream)
+func (c *RtmpNetConnection) genNextStreamID(chunkid uint32) uint32 {
+	c.lastStreamID += 1
+	return c.lastStreamID
 }
 
 func newRtmpNetConnect(conn net.Conn, s *Server) (c *RtmpNetConnection) {
@@ -57,11 +66,14 @@ func newRtmpNetConnect(conn net.Conn, s *Server) (c *RtmpNetConnection) {
 	c.brw = bufio.NewReadWriter(c.br, c.bw)
 	c.conn = conn
 	c.lock = new(sync.Mutex)
+	c.wlock = new(sync.Mutex)
 	c.server = s
 	c.bandwidth = RTMP_MAX_CHUNK_SIZE * 8
-	c.createTime = time.Now().String()
+	c.beginTime = time.Now()
+	c.createTime = c.beginTime.String()
 	c.remoteAddr = conn.RemoteAddr().String()
-	c.nextStreamID = gen_next_stream_id
+	c.lastStreamID = 64
+	c.nextStreamID = c.genNextStreamID
 	c.readChunkSize = RTMP_DEFAULT_CHUNK_SIZE
 	c.writeChunkSize = RTMP_DEFAULT_CHUNK_SIZE
 	c.rtmpHeader = make(map[uint32]*RtmpHeader)
@@ -70,14 +82,168 @@ func newRtmpNetConnect(conn net.Conn, s *Server) (c *RtmpNetConnection) {
 	return
 }
 
+// 客户端连接服务器上的应用,需要先完成握手.
+// command 是服务url(tcUrl),例如 rtmp://host:port/app, args 是可选的用户变量(AMFObjects).
 func (c *RtmpNetConnection) Connect(command string, args ...interface{}) error {
+	u, err := url.Parse(command)
+	if err != nil {
+		return err
+	}
+
+	c.url = command
+	c.appName = strings.Trim(u.Path, "/")
+
+	data := newAMFObjects()
+	data["app"] = c.appName
+	data["type"] = "nonprivate"
+	data["flashVer"] = "FMLE/3.0 (compatible; gortmp)"
+	data["tcUrl"] = c.url
+	data["fpad"] = false
+	data["capabilities"] = 15
+	data["audioCodecs"] = 3191
+	data["videoCodecs"] = 252
+	data["videoFunction"] = 1
+	data["objectEncoding"] = c.objectEncoding
+
+	for _, v := range args {
+		obj, ok := v.(AMFObjects)
+		if !ok {
+			return errors.New("connect args must be AMFObjects")
+		}
+
+		for k, vv := range obj {
+			data[k] = vv
+		}
+	}
+
+	c.transactionID = 1 // connect 的传输ID总是1
+	if err = sendMessage(c, SEND_CONNECT_MESSAGE, data); err != nil {
+		return err
+	}
+
+	res, err := recvResponse(c, func(r *ResponseMessage) bool {
+		return r.TransactionId == 1 && (r.CommandName == Response_Result || r.CommandName == Response_Error)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if res.CommandName != Response_Result {
+		return errors.New("rtmp connect error : " + responseError(res))
+	}
+
+	c.connected = true
 	return nil
 }
 
+// 调用服务器上的远程方法(RPC).
+// args[0] 是命令对象, args[1] 是可选的参数,都必须是 AMFObjects. 服务器的响应由读消息的地方处理.
 func (c *RtmpNetConnection) Call(command string, args ...interface{}) error {
+	if len(args) > 2 {
+		return errors.New("call args must be [object [, optional]]")
+	}
+
+	m := newCallMessage()
+	m.CommandName = command
+	m.TransactionId = c.nextTransactionID()
+
+	for i, v := range args {
+		obj, ok := v.(AMFObjects)
+		if !ok {
+			return errors.New("call args must be AMFObjects")
+		}
+
+		if i == 0 {
+			m.Object = obj
+		} else {
+			m.Optional = obj
+		}
+	}
+
+	m.Encode0()
+	m.RtmpHeader = newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
+	return writeMessage(c, m)
+}
+
+// 客户端下一个命令消息的传输ID
+func (c *RtmpNetConnection) nextTransactionID() uint64 {
+	c.transactionID += 1
+	return c.transactionID
+}
+
+// 写一个块
+func (c *RtmpNetConnection) writeChunk(mark []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	if _, err := c.bw.Write(mark); err != nil {
+		return err
+	}
+
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+
+	c.writeSeqNum += uint32(len(mark))
 	return nil
 }
 
+// 读下一个消息之前调用,读超时之后recvMessage()返回错误
+func (c *RtmpNetConnection) setReadDeadline(enabled bool) {
+	if enabled && c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// 写的字节数超过了窗口大小,需要发送确认消息,返回总共写了多少字节
+func (c *RtmpNetConnection) checkWriteAck() (uint32, bool) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.writeSeqNum <= c.bandwidth {
+		return 0, false
+	}
+
+	c.totalWrite += c.writeSeqNum
+	c.writeSeqNum = 0
+	return c.totalWrite, true
+}
+
+func (c *RtmpNetConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// 客户端connect的tcUrl.(例如rtmp://192.168.2.1/myapp)
+func (c *RtmpNetConnection) TcUrl() string {
+	return c.url
+}
+
+// 应用名,不带参数
+func (c *RtmpNetConnection) AppName() string {
+	return c.appName
+}
+
+func (c *RtmpNetConnection) AppQuery() url.Values {
+	return c.appQuery
+}
+
+// 将 name?key=value 分成名字和参数
+func splitQuery(name string) (string, url.Values) {
+	i := strings.Index(name, "?")
+	if i < 0 {
+		return name, url.Values{}
+	}
+
+	query, _ := url.ParseQuery(name[i+1:])
+	return name[:i], query
+}
+
 func (c *RtmpNetConnection) Connected() bool {
 	return c.connected
 }
@@ -2,6 +2,7 @@ package rtmp
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"github.com/onedss/gortmp/avformat"
 	"github.com/onedss/gortmp/config"
@@ -9,7 +10,10 @@ import (
 	"github.com/onedss/gortmp/mpegts"
 	"github.com/onedss/gortmp/util"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	//"reflect"
 	"errors"
 	"strconv"
@@ -50,10 +54,12 @@ type RtmpNetStream struct {
 	videoKeyFrame  *AVPacket          // keyframe (for AVC, a seekableframe)（关键帧）
 	videochan      chan *AVPacket     // live video chan
 	audiochan      chan *AVPacket     // live audio chan
+	datachan       chan *AVPacket     // live data chan (onMetaData, onTextData, onCuePoint...)
 	streamPath     string             // 客户端推流的路径.(例如rtmp://192.168.2.1/myapp/mystream,那么流路径就是myapp/mystream)
 	bufferTime     time.Duration      // 指定在开始显示流之前需要多长时间将消息存入缓冲区
 	bufferLength   uint64             // [read-only] 数据当前存在于缓冲区中的秒数
 	bufferLoad     uint64             // [read-only] 已加载到播放器中的数据的字节数
+	tagLock        sync.RWMutex       // guards videoTag, audioTag. 发布者的goroutine写,订阅者和转推的goroutine读
 	lock           *sync.Mutex        // guards the following
 	serverHandler  ServerHandler      // 服务器对客户端命令消息的响应处理
 	mode           int                // mode
@@ -62,11 +68,14 @@ type RtmpNetStream struct {
 	vstreamToFile  bool               // 是否可以将视频流保存为文件
 	astreamToFile  bool               // 是否可以将音频流保存为文件
 	broadcast      *Broadcast         // Broadcast, 装载着需要广播的对象.(也即是具体的发布者)
-	total_duration uint32             // media total duration 存放音频或者视频的时间戳累加.就是一个绝对时间戳. 当前绝对时间戳 = 上一个绝对时间戳 + 当前相对时间戳
+	pub_timestamps map[uint32]uint32  // 发布者每个块流上一个音视频消息的绝对时间戳. 当前绝对时间戳 = 上一个绝对时间戳 + 当前相对时间戳
 	vsend_time     uint32             // 上一个视频的绝对时间戳
 	asend_time     uint32             // 上一个音频的绝对时间戳
 	closed         bool               // 是否关闭
 	rtmpFile       *RtmpFile          // netstream write file
+	edge           *RtmpClient        // 边缘模式,从源站拉流的客户端,这个时候NetStream是广播的发布者
+	streamName     string             // 发布或者播放的流名称,不带参数.(例如mystream)
+	streamQuery    url.Values         // 流名称后面的参数.(例如mystream?key=value)
 }
 
 func newNetStream(conn *RtmpNetConnection, sh ServerHandler) (s *RtmpNetStream) {
@@ -74,6 +83,7 @@ func newNetStream(conn *RtmpNetConnection, sh ServerHandler) (s *RtmpNetStream)
 	s.conn = conn
 	s.lock = new(sync.Mutex)
 	s.serverHandler = sh
+	s.pub_timestamps = make(map[uint32]uint32)
 	//s.clientHandler = ch
 	s.vkfsended = false
 	s.akfsended = false
@@ -82,6 +92,32 @@ func newNetStream(conn *RtmpNetConnection, sh ServerHandler) (s *RtmpNetStream)
 	return
 }
 
+func (s *RtmpNetStream) Connection() *RtmpNetConnection {
+	return s.conn
+}
+
+// 流路径, 应用名/流名称
+func (s *RtmpNetStream) StreamPath() string {
+	return s.streamPath
+}
+
+func (s *RtmpNetStream) StreamName() string {
+	return s.streamName
+}
+
+func (s *RtmpNetStream) StreamQuery() url.Values {
+	return s.streamQuery
+}
+
+// 客户端的参数,先查找流名称后面的参数,再查找应用名(tcUrl)后面的参数
+func (s *RtmpNetStream) Query(key string) string {
+	if v := s.streamQuery.Get(key); v != "" {
+		return v
+	}
+
+	return s.conn.appQuery.Get(key)
+}
+
 func (s *RtmpNetStream) AttachVideo(video chan *AVPacket) {
 	s.videochan = video
 }
@@ -90,6 +126,31 @@ func (s *RtmpNetStream) AttachAudio(audio chan *AVPacket) {
 	s.audiochan = audio
 }
 
+func (s *RtmpNetStream) AttachData(data chan *AVPacket) {
+	s.datachan = data
+}
+
+// 发布者的AVC sequence header和AAC sequence header,还没有收到的时候为nil.
+// 返回的包是所有订阅者共享的,需要修改的时候先拷贝一份
+func (s *RtmpNetStream) sequenceHeaders() (video, audio *AVPacket) {
+	s.tagLock.RLock()
+	defer s.tagLock.RUnlock()
+
+	return s.videoTag, s.audioTag
+}
+
+// 保存发布者的第一个视频包或者音频包(sequence header),只在发布者的goroutine中调用
+func (s *RtmpNetStream) setSequenceHeader(pkt *AVPacket) {
+	s.tagLock.Lock()
+	defer s.tagLock.Unlock()
+
+	if pkt.Type == RTMP_MSG_AUDIO {
+		s.audioTag = pkt
+	} else {
+		s.videoTag = pkt
+	}
+}
+
 // 先发送关键帧(Tag),之后就不断发送数据
 func (s *RtmpNetStream) SendVideo(video *AVPacket) error {
 	// 这里发送时间戳的依据是,当发送第一个包和Tag的时候,需要发送Chunk12的头
@@ -108,12 +169,13 @@ func (s *RtmpNetStream) SendVideo(video *AVPacket) error {
 		return nil
 	}
 
-	vTag := s.broadcast.publisher.videoTag // 从发布者发布的数据中,拿出视频Tag.
+	vTag, _ := s.broadcast.publisher.sequenceHeaders() // 从发布者发布的数据中,拿出视频Tag.
 	if vTag == nil {
 		fmt.Println("Video Tag nil")
 		return nil
 	}
 
+	vTag = vTag.Clone() // 所有订阅者共享发布者的视频Tag,拷贝一份再修改时间戳
 	vTag.Timestamp = 0
 
 	// 如果视频的格式是AVC(H.264)的话,VideoTagHeader(1个字节)会多出4个字节的信息.AVCPacketType(1Bytes)和 CompositionTime(3 Bytes).
@@ -172,7 +234,13 @@ func (s *RtmpNetStream) SendAudio(audio *AVPacket) error {
 	// FMS推送H264和AAC直播流,需要首先发送"AVC sequence header"和"AAC sequence header",这两项数据包含的是重要的编码信息,没有它们,解码器将无法解码.
 	// 在发送这两个header需要在前面分别加上 VideoTags、AudioTags  这两个个tags都是1个字节（8bits）的数据
 	// Audio Tag == SoundFormat(4 Bit) + SoundRate(2 Bit) + SoundSize(1 Bit) + SoundTypet(1 Bit)
-	aTag := s.broadcast.publisher.audioTag // 从发布者发布的数据中,拿出音频Tag.
+	_, aTag := s.broadcast.publisher.sequenceHeaders() // 从发布者发布的数据中,拿出音频Tag.
+	if aTag == nil {
+		fmt.Println("Audio Tag nil")
+		return nil
+	}
+
+	aTag = aTag.Clone() // 所有订阅者共享发布者的音频Tag,拷贝一份再修改时间戳
 	aTag.Timestamp = 0
 
 	err := sendMessage(s.conn, SEND_FULL_AUDIO_MESSAGE, aTag) // 发送音频Tag.
@@ -186,6 +254,11 @@ func (s *RtmpNetStream) SendAudio(audio *AVPacket) error {
 	return sendMessage(s.conn, SEND_FULL_AUDIO_MESSAGE, audio) // 发送第一个完整的音频包
 }
 
+// 发送数据消息(onMetaData...)给订阅者
+func (s *RtmpNetStream) SendData(data *AVPacket) error {
+	return sendMessage(s.conn, SEND_DATA_MESSAGE, data)
+}
+
 func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (err error) {
 	switch fileType {
 	case RTMP_FILE_TYPE_ES_H264:
@@ -244,40 +317,54 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 		{
 			if s.rtmpFile.vtwrite {
 				var packet mpegts.MpegTsPESPacket
-				if packet, err = rtmpVideoPacketToPES(video, s.rtmpFile.avc); err != nil {
+				if s.rtmpFile.hls_fmp4 == nil {
+					if packet, err = rtmpVideoPacketToPES(video, s.rtmpFile.avc); err != nil {
+						return
+					}
+				} else if _, err = CheckIsH264(video); err != nil {
 					return
 				}
 
-				if video.isKeyFrame() {
-					// 当前的时间戳减去上一个ts切片的时间戳
-					if int64(video.Timestamp-s.rtmpFile.vwrite_time) >= s.rtmpFile.hls_fragment {
-						//fmt.Println("time :", video.Timestamp, tsSegmentTimestamp)
+				// 当前的时间戳减去上一个ts切片的时间戳.
+				// 在关键帧切片,切片从关键帧开始;GOP太长的时候,达到hls_max_fragment就不等关键帧直接切片
+				elapsed := int64(video.Timestamp) - int64(s.rtmpFile.vwrite_time)
+				cut := (video.isKeyFrame() && elapsed >= s.rtmpFile.hls_fragment) || elapsed >= s.rtmpFile.hls_max_fragment
+
+				// 多码率的流,时间戳按hls_fragment分段,关键帧进入新的分段的时候切片.
+				// 切片的位置只和时间戳有关,和开始发布的时间无关,各个版本在同一个关键帧切片;
+				// 同样达到hls_max_fragment的时候不等关键帧直接切片,切片不会超过目标时长
+				if s.rtmpFile.hls_group != "" {
+					cut = (video.isKeyFrame() && int64(video.Timestamp)/s.rtmpFile.hls_fragment != int64(s.rtmpFile.vwrite_time)/s.rtmpFile.hls_fragment) ||
+						elapsed >= s.rtmpFile.hls_max_fragment
+				}
 
-						tsFilename := strings.Split(s.streamPath, "/")[1] + "-" + strconv.FormatInt(time.Now().Unix(), 10) + ".ts"
+				if cut {
+					if err = s.writeHlsSegment(video.Timestamp); err != nil {
+						return
+					}
+				}
 
-						if err = writeHlsTsSegmentFile(s.rtmpFile.hls_path+"/"+tsFilename, s.rtmpFile.hls_segment_data.Bytes()); err != nil {
+				// 低延迟HLS,加上这一帧会超过分片的目标时长的时候,在这一帧之前结束当前分片
+				if s.hlsLowLatency() {
+					interval := int64(video.Timestamp) - int64(s.rtmpFile.vlast_time)
+					if int64(video.Timestamp)-int64(s.rtmpFile.hls_part_time)+interval > s.rtmpFile.hls_part_duration {
+						if err = s.writeHlsPart(video.Timestamp); err != nil {
 							return
 						}
+					}
 
-						inf := hls.PlaylistInf{
-							Duration: float64((video.Timestamp - s.rtmpFile.vwrite_time) / 1000),
-							Title:    tsFilename,
-						}
+					// 分片的第一个视频帧是关键帧的时候,分片可以独立解码
+					if !s.rtmpFile.hls_part_video {
+						s.rtmpFile.hls_part_video = true
+						s.rtmpFile.hls_part_idr = video.isKeyFrame()
+					}
+				}
 
-						if s.rtmpFile.hls_segment_count >= uint32(config.HLSWindow) {
-							if err = s.rtmpFile.hls_playlist.UpdateInf(s.rtmpFile.hls_m3u8_name, s.rtmpFile.hls_m3u8_name+".tmp", inf); err != nil {
-								return
-							}
-						} else {
-							if err = s.rtmpFile.hls_playlist.WriteInf(s.rtmpFile.hls_m3u8_name, inf); err != nil {
-								return
-							}
-						}
+				s.rtmpFile.vlast_time = video.Timestamp
 
-						s.rtmpFile.hls_segment_count++
-						s.rtmpFile.vwrite_time = video.Timestamp
-						s.rtmpFile.hls_segment_data.Reset()
-					}
+				if s.rtmpFile.hls_fmp4 != nil {
+					s.writeHlsFmp4Video(video)
+					return nil
 				}
 
 				frame := new(mpegts.MpegtsPESFrame)
@@ -304,30 +391,96 @@ func (s *RtmpNetStream) WriteVideo(w io.Writer, video *AVPacket, fileType int) (
 				s.rtmpFile.hls_fragment = 10000
 			}
 
+			if config.HLSMaxFragment > 0 && config.HLSMaxFragment*1000 >= s.rtmpFile.hls_fragment {
+				s.rtmpFile.hls_max_fragment = config.HLSMaxFragment * 1000
+			} else {
+				s.rtmpFile.hls_max_fragment = s.rtmpFile.hls_fragment * 2
+			}
+
+			// 目标时长不能改变,切片最长是hls_max_fragment(达到的时候不等关键帧直接切片)
 			s.rtmpFile.hls_playlist = hls.Playlist{
 				Version:        3,
 				Sequence:       0,
-				Targetduration: int(s.rtmpFile.hls_fragment / 666), // hlsFragment * 1.5 / 1000
+				Targetduration: int((s.rtmpFile.hls_max_fragment + 999) / 1000),
+			}
+
+			// 每个流一个目录,例如 myapp/mystream/index.m3u8, myapp/mystream/mystream-0.ts
+			s.rtmpFile.hls_path = config.HLSPath + "/" + s.streamPath
+			s.rtmpFile.hls_m3u8_name = s.rtmpFile.hls_path + "/" + HLS_PLAYLIST_NAME
+			s.rtmpFile.hls_name = s.streamPath + "/" + HLS_PLAYLIST_NAME
+
+			if s.conn.server != nil && s.conn.server.HLS != nil {
+				s.rtmpFile.hls_store = s.conn.server.HLS
+				s.rtmpFile.hls_generation, s.rtmpFile.hls_segment_count, s.rtmpFile.hls_key_count = s.rtmpFile.hls_store.publish(s.streamPath)
+				s.rtmpFile.hls_playlist.Sequence = int(s.rtmpFile.hls_segment_count)
+				s.rtmpFile.hls_group = s.rtmpFile.hls_store.variantGroup(s.streamPath)
 			}
 
-			s.rtmpFile.hls_path = config.HLSPath + "/" + strings.Split(s.streamPath, "/")[0]
-			s.rtmpFile.hls_m3u8_name = s.rtmpFile.hls_path + "/mystream.m3u8"
+			// fMP4切片,需要版本7
+			if s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.segmentType(s.streamPath) == HLS_SEGMENT_TYPE_FMP4 {
+				s.rtmpFile.hls_fmp4 = avformat.NewFMP4Muxer(s.rtmpFile.avc)
+				s.rtmpFile.hls_playlist.Version = 7
+			}
+
+			// EVENT播放列表,保留所有的切片,重新发布的时候继续之前的存档
+			if s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.eventPlaylist(s.streamPath) {
+				s.rtmpFile.hls_playlist.PlaylistType = hls.HLS_PLAYLIST_TYPE_EVENT
+				s.resumeHlsEvent()
+			}
 
-			if !util.Exist(s.rtmpFile.hls_path) {
-				if err = os.Mkdir(s.rtmpFile.hls_path, os.ModePerm); err != nil {
+			// 低延迟HLS,PART-HOLD-BACK是分片目标时长的3倍 (4.4.3.8)
+			if s.hlsLowLatency() {
+				s.rtmpFile.hls_part_duration = int64(s.rtmpFile.hls_store.PartDuration / time.Millisecond)
+				if s.rtmpFile.hls_part_duration <= 0 {
+					s.rtmpFile.hls_part_duration = int64(HLS_PART_DURATION / time.Millisecond)
+				}
+
+				if s.rtmpFile.hls_playlist.Version < 6 {
+					s.rtmpFile.hls_playlist.Version = 6
+				}
+
+				s.rtmpFile.hls_playlist.PartTarget = float64(s.rtmpFile.hls_part_duration) / 1000
+				s.rtmpFile.hls_playlist.CanBlockReload = true
+				s.rtmpFile.hls_playlist.PartHoldBack = 3 * s.rtmpFile.hls_playlist.PartTarget
+				s.rtmpFile.hls_playlist.Partial = &hls.PlaylistInf{}
+				s.rtmpFile.hls_playlist.PreloadHint = s.hlsPartFilename(s.rtmpFile.hls_segment_count, 0)
+
+				s.rtmpFile.hls_part_index = 0
+				s.rtmpFile.hls_part_offset = 0
+				s.rtmpFile.hls_part_time = video.Timestamp
+			}
+
+			if !s.hlsMemory() && !util.Exist(s.rtmpFile.hls_path) {
+				if err = os.MkdirAll(s.rtmpFile.hls_path, os.ModePerm); err != nil {
+					return
+				}
+			}
+
+			// 标记是服务器创建的流目录,下次启动的时候可以清理
+			if s.rtmpFile.hls_store != nil {
+				if err = s.rtmpFile.hls_store.markStream(s.streamPath); err != nil {
 					return
 				}
 			}
 
-			if err = s.rtmpFile.hls_playlist.Init(s.rtmpFile.hls_m3u8_name); err != nil {
+			if err = s.writeHlsPlaylist(); err != nil {
 				fmt.Println(err)
 				return
 			}
 
 			s.rtmpFile.hls_segment_data = &bytes.Buffer{}
-			s.rtmpFile.hls_segment_count = 0
+			s.reserveHlsSegment()
+			s.rtmpFile.vwrite_time = video.Timestamp // 第一个切片开始的时间戳
+			s.rtmpFile.vlast_time = video.Timestamp
+
+			if s.hlsLowLatency() {
+				s.notifyHlsLive(false)
+			}
 
 			s.rtmpFile.vtwrite = true
+
+			// 序列头不经过videochan,第一个视频包是第一个关键帧,写入第一个切片(和第一个分片)
+			return s.WriteVideo(w, video, fileType)
 		}
 	case RTMP_FILE_TYPE_FLV:
 		{
@@ -434,6 +587,15 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 			}
 
 			if s.rtmpFile.atwrite {
+				if s.rtmpFile.hls_fmp4 != nil {
+					if _, err = CheckIsAAC(audio); err != nil {
+						return
+					}
+
+					s.rtmpFile.hls_fmp4.WriteAudio(audio.Timestamp, audio.Payload[2:])
+					return nil
+				}
+
 				var packet mpegts.MpegTsPESPacket
 				if packet, err = rtmpAudioPacketToPES(audio, s.rtmpFile.asc); err != nil {
 					return
@@ -457,6 +619,12 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 				return
 			}
 
+			if s.rtmpFile.hls_fmp4 != nil {
+				if err = s.rtmpFile.hls_fmp4.SetAudio(s.rtmpFile.asc); err != nil {
+					return
+				}
+			}
+
 			s.rtmpFile.atwrite = true
 		}
 	case RTMP_FILE_TYPE_FLV:
@@ -492,6 +660,276 @@ func (s *RtmpNetStream) WriteAudio(w io.Writer, audio *AVPacket, fileType int) (
 	return nil
 }
 
+// HLS只保存在内存中
+func (s *RtmpNetStream) hlsMemory() bool {
+	return s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.Memory
+}
+
+// HLS切片使用AES-128加密
+func (s *RtmpNetStream) hlsEncrypt() bool {
+	return s.rtmpFile.hls_store != nil && s.rtmpFile.hls_store.Encrypt
+}
+
+// 将缓存的ts数据写成一个切片文件,更新播放列表.timestamp 是切片结束的时间戳.
+// 离开滑动窗口的切片在HLSStore.Grace之后删除,密钥在使用它的切片都离开滑动窗口之后删除.
+func (s *RtmpNetStream) writeHlsSegment(timestamp uint32) (err error) {
+	// 切片的序号和播放列表中的媒体序列号(#EXT-X-MEDIA-SEQUENCE)一致,每个切片递增
+	tsFilename := path.Base(s.streamPath) + "-" + strconv.FormatUint(uint64(s.rtmpFile.hls_segment_count), 10) + s.hlsSegmentExt()
+
+	// 精确到毫秒
+	var duration float64
+	if timestamp > s.rtmpFile.vwrite_time {
+		duration = float64(timestamp-s.rtmpFile.vwrite_time) / 1000
+	}
+
+	if err = s.flushHlsFmp4(timestamp); err != nil {
+		return
+	}
+
+	// 低延迟HLS,先写完最后一个分片
+	if s.hlsLowLatency() {
+		if err = s.writeHlsPart(timestamp); err != nil {
+			return
+		}
+	}
+
+	var segment []byte
+	if segment, err = s.hlsSegmentData(s.rtmpFile.hls_segment_data.Bytes()); err != nil {
+		return
+	}
+
+	inf := hls.PlaylistInf{
+		Duration:      duration,
+		Title:         tsFilename,
+		Key:           s.rtmpFile.hls_key,
+		Discontinuity: s.rtmpFile.hls_discontinuity,
+		Map:           s.rtmpFile.hls_segment_map,
+	}
+
+	s.rtmpFile.hls_discontinuity = false
+	s.rtmpFile.hls_segment_map = ""
+
+	if s.hlsEvent() {
+		inf.ProgramDateTime = s.hlsProgramDateTime(s.rtmpFile.vwrite_time, timestamp)
+	}
+
+	if partial := s.rtmpFile.hls_playlist.Partial; partial != nil {
+		inf.Parts = partial.Parts
+		s.rtmpFile.hls_playlist.Partial = &hls.PlaylistInf{}
+	}
+
+	if err = s.writeHlsFile(tsFilename, segment); err != nil {
+		return
+	}
+
+	// 滑动窗口中的切片, EVENT播放列表保留所有的切片
+	s.rtmpFile.hls_playlist.Append(inf)
+
+	var expired []hls.PlaylistInf
+	if !s.hlsEvent() {
+		expired = s.rtmpFile.hls_playlist.Slide(config.HLSWindow)
+	}
+
+	// 低延迟HLS,离直播边缘超过3个目标时长的切片不再列出分片 (4.4.4.9)
+	var trimmed []hls.PlaylistPart
+	if s.hlsLowLatency() {
+		s.rtmpFile.hls_playlist.PreloadHint = s.hlsPartFilename(s.rtmpFile.hls_segment_count+1, 0)
+		trimmed = s.rtmpFile.hls_playlist.TrimParts(float64(3 * s.rtmpFile.hls_playlist.Targetduration))
+	}
+
+	if err = s.writeHlsPlaylist(); err != nil {
+		return
+	}
+
+	s.updateHlsBandwidth(len(segment), inf.Duration)
+
+	if s.rtmpFile.hls_group != "" {
+		s.updateHlsVariant()
+	}
+
+	if s.dashEnabled() {
+		if err = s.writeDashSegment(s.rtmpFile.vwrite_time, timestamp); err != nil {
+			return
+		}
+	}
+
+	if s.rtmpFile.hls_store != nil {
+		for _, part := range trimmed {
+			s.rtmpFile.hls_store.expire(path.Join(s.streamPath, part.Uri))
+		}
+
+		for _, e := range expired {
+			s.rtmpFile.hls_store.expire(path.Join(s.streamPath, e.Title))
+			for _, part := range e.Parts {
+				s.rtmpFile.hls_store.expire(path.Join(s.streamPath, part.Uri))
+			}
+
+			// 窗口中已经没有切片使用这个密钥
+			if name, ok := s.rtmpFile.hls_key_names[e.Key]; ok && !s.hlsKeyInUse(e.Key) {
+				s.rtmpFile.hls_store.expire(name)
+				delete(s.rtmpFile.hls_key_names, e.Key)
+			}
+		}
+	}
+
+	s.rtmpFile.hls_segment_count++
+	s.reserveHlsSegment()
+	s.rtmpFile.vwrite_time = timestamp
+	s.rtmpFile.hls_segment_data.Reset()
+
+	if s.hlsLowLatency() {
+		s.rtmpFile.hls_part_index = 0
+		s.rtmpFile.hls_part_offset = 0
+		s.rtmpFile.hls_part_time = timestamp
+		s.notifyHlsLive(false)
+	}
+
+	return nil
+}
+
+// 开始写一个新的切片,在HLSStore中保留切片的序号
+func (s *RtmpNetStream) reserveHlsSegment() {
+	if s.rtmpFile.hls_store != nil {
+		s.rtmpFile.hls_store.reserve(s.streamPath, s.rtmpFile.hls_segment_count, s.rtmpFile.hls_key_count)
+	}
+}
+
+// PAT + PMT + ts数据(fMP4切片是 moof + mdat),加密的时候使用当前切片的密钥加密
+func (s *RtmpNetStream) hlsSegmentData(data []byte) (segment []byte, err error) {
+	if s.rtmpFile.hls_fmp4 != nil {
+		segment = data
+	} else if segment, err = hlsTsSegment(data); err != nil {
+		return
+	}
+
+	if !s.hlsEncrypt() {
+		return
+	}
+
+	if err = s.rotateHlsKey(); err != nil {
+		return
+	}
+
+	return hls.EncryptSegment(segment, s.rtmpFile.hls_key_data, s.rtmpFile.hls_key_iv)
+}
+
+// 滑动窗口中是否还有切片使用这个密钥
+func (s *RtmpNetStream) hlsKeyInUse(key *hls.PlaylistKey) bool {
+	for _, inf := range s.rtmpFile.hls_playlist.Segments {
+		if inf.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 第一个切片生成密钥,之后每HLSStore.KeyRotate个切片换一个新的密钥,每个密钥使用一个随机的IV.
+// 同一个切片(和它的分片)只在第一次调用的时候换密钥
+func (s *RtmpNetStream) rotateHlsKey() (err error) {
+	store := s.rtmpFile.hls_store
+	count := s.rtmpFile.hls_segment_count
+
+	// 重新发布的时候第一个切片的序号不是0,从生成密钥的切片开始计算
+	if s.rtmpFile.hls_key != nil && (store.KeyRotate <= 0 || count-s.rtmpFile.hls_key_segment < uint32(store.KeyRotate)) {
+		return nil
+	}
+
+	// 先保留密钥的序号,再生成密钥
+	store.reserve(s.streamPath, count, s.rtmpFile.hls_key_count+1)
+
+	var key, iv []byte
+	var name, uri string
+	if key, name, uri, err = store.newKey(s.streamPath, s.rtmpFile.hls_key_count); err != nil {
+		return
+	}
+
+	if iv, err = hls.NewAES128Key(); err != nil {
+		return
+	}
+
+	s.rtmpFile.hls_key = &hls.PlaylistKey{
+		Method: hls.HLS_KEY_METHOD_AES_128,
+		Uri:    uri,
+		IV:     "0x" + hex.EncodeToString(iv),
+	}
+	s.rtmpFile.hls_key_data = key
+	s.rtmpFile.hls_key_iv = iv
+	s.rtmpFile.hls_key_count++
+	s.rtmpFile.hls_key_segment = count
+
+	if name != "" {
+		if s.rtmpFile.hls_key_names == nil {
+			s.rtmpFile.hls_key_names = make(map[*hls.PlaylistKey]string)
+		}
+
+		s.rtmpFile.hls_key_names[s.rtmpFile.hls_key] = name
+	}
+
+	return nil
+}
+
+// 保存流目录下的文件,有HLSStore的时候通过HLSStore保存(内存或者磁盘),否则写到流的目录
+func (s *RtmpNetStream) writeHlsFile(filename string, data []byte) error {
+	if s.rtmpFile.hls_store != nil {
+		return s.rtmpFile.hls_store.putFile(path.Join(s.streamPath, filename), data)
+	}
+
+	return ioutil.WriteFile(s.rtmpFile.hls_path+"/"+filename, data, 0644)
+}
+
+// 重新生成整个播放列表,先写临时文件再改名
+func (s *RtmpNetStream) writeHlsPlaylist() error {
+	if s.rtmpFile.hls_store != nil {
+		return s.rtmpFile.hls_store.putFile(s.rtmpFile.hls_name, s.rtmpFile.hls_playlist.Encode())
+	}
+
+	return s.rtmpFile.hls_playlist.WriteFile(s.rtmpFile.hls_m3u8_name)
+}
+
+// 广播结束的时候,将最后一个没有写完的切片写成文件,并在播放列表的最后加上#EXT-X-ENDLIST.
+// 之后在HLSStore.PurgeDelay之后删除这个流所有的HLS文件
+func (s *RtmpNetStream) closeFile() (err error) {
+	if s.rtmpFile == nil || s.rtmpFile.hls_segment_data == nil {
+		return nil
+	}
+
+	if s.rtmpFile.hls_store != nil {
+		defer s.rtmpFile.hls_store.unpublish(s.streamPath, s.rtmpFile.hls_generation)
+	}
+
+	if err = s.flushHlsFmp4(s.rtmpFile.vlast_time); err != nil {
+		return
+	}
+
+	if s.rtmpFile.hls_segment_data.Len() > 0 {
+		if err = s.writeHlsSegment(s.rtmpFile.vlast_time); err != nil {
+			return
+		}
+	}
+
+	s.rtmpFile.hls_playlist.Partial = nil
+	s.rtmpFile.hls_playlist.PreloadHint = ""
+	s.rtmpFile.hls_playlist.EndList = true
+	s.endHlsEvent()
+
+	if err = s.writeHlsPlaylist(); err != nil {
+		return
+	}
+
+	if s.dashEnabled() && len(s.rtmpFile.dash_segments) > 0 {
+		if err = s.writeDashMPD(true); err != nil {
+			return
+		}
+	}
+
+	if s.hlsLowLatency() {
+		s.notifyHlsLive(true)
+	}
+
+	return nil
+}
+
 func (s *RtmpNetStream) Close() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -539,6 +977,9 @@ func (s *RtmpNetStream) Close() {
 
 func (s *RtmpNetStream) msgLoopProc() {
 	for {
+		// 播放者在播放的时候只会偶尔发送确认消息,不检查读超时,网络不好或者不再读取的播放者由写超时检测
+		s.conn.setReadDeadline(s.mode&2 == 0)
+
 		msg, err := recvMessage(s.conn)
 		if err != nil {
 			s.serverHandler.OnError(s, err)
@@ -625,13 +1066,7 @@ func (s *RtmpNetStream) msgLoopProc() {
 
 func audioMessageHandle(s *RtmpNetStream, audio *AudioMessage) {
 	pkt := new(AVPacket)
-	if audio.RtmpHeader.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		s.total_duration += audio.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
-		pkt.Timestamp = s.total_duration
-	} else {
-		s.total_duration += audio.RtmpHeader.ChunkMessgaeHeader.Timestamp // 绝对时间戳
-		pkt.Timestamp = s.total_duration                                  // 当前时间戳(用绝对时间戳做当前音频包的时间戳)
-	}
+	pkt.Timestamp = chunkTimestamp(s.pub_timestamps, audio.RtmpHeader) // 当前时间戳(用绝对时间戳做当前音频包的时间戳)
 
 	//fmt.Println("recv audio time stamp:", pkt.Timestamp)
 
@@ -645,21 +1080,15 @@ func audioMessageHandle(s *RtmpNetStream, audio *AudioMessage) {
 	pkt.SoundType = tmp & 0x01        // 音频类型 0 = Mono sound or 1 = Stereo sound
 
 	if s.audioTag == nil { // (AAC Header(2 Bytes) + AAC sequence Header(2 Bytes))
-		s.audioTag = pkt
+		s.setSequenceHeader(pkt)
 	} else {
-		s.audiochan <- pkt
+		s.pushPacket(s.audiochan, pkt)
 	}
 }
 
 func videoMessageHandle(s *RtmpNetStream, video *VideoMessage) {
 	pkt := new(AVPacket)
-	if video.RtmpHeader.ChunkMessgaeHeader.Timestamp == 0xffffff {
-		s.total_duration += video.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
-		pkt.Timestamp = s.total_duration
-	} else {
-		s.total_duration += video.RtmpHeader.ChunkMessgaeHeader.Timestamp
-		pkt.Timestamp = s.total_duration
-	}
+	pkt.Timestamp = chunkTimestamp(s.pub_timestamps, video.RtmpHeader)
 
 	pkt.Type = video.RtmpHeader.ChunkMessgaeHeader.MessageTypeID
 	pkt.Payload = video.RtmpBody.Payload
@@ -676,13 +1105,13 @@ func videoMessageHandle(s *RtmpNetStream, video *VideoMessage) {
 	pkt.VideoCodecID = tmp & 0x0f // 编码类型ID 4Bit, JPEG, H263, AVC...
 
 	if s.videoTag == nil {
-		s.videoTag = pkt
+		s.setSequenceHeader(pkt)
 	} else {
 		if pkt.VideoFrameType == 1 { // 关键帧
 			s.videoKeyFrame = pkt
 		}
 
-		s.videochan <- pkt
+		s.pushPacket(s.videochan, pkt)
 	}
 }
 
@@ -694,12 +1123,65 @@ func metadataMessageHandle(s *RtmpNetStream, mete *MetadataMessage) {
 		pkt.Timestamp = mete.RtmpHeader.ChunkExtendedTimestamp.ExtendTimestamp
 	}
 
-	pkt.Type = mete.RtmpHeader.ChunkMessgaeHeader.MessageTypeID
+	pkt.Type = RTMP_MSG_AMF0_METADATA
 	pkt.Payload = mete.RtmpBody.Payload
 
-	if s.metaData == nil {
+	// AMF3的数据消息,第一个字节是格式选择(0x00),后面跟着的还是AMF0编码的数据
+	if mete.RtmpHeader.ChunkMessgaeHeader.MessageTypeID == RTMP_MSG_AMF3_METADATA && len(pkt.Payload) > 0 {
+		pkt.Payload = pkt.Payload[1:]
+	}
+
+	pkt.Payload = stripSetDataFrame(pkt.Payload)
+
+	// 发布者每次更新onMetaData都保存最新的,其他的数据消息(onTextData, onCuePoint...)只需要转发
+	if dataMessageName(pkt.Payload) == "onMetaData" {
 		s.metaData = pkt
 	}
+
+	s.pushPacket(s.datachan, pkt)
+}
+
+// 发布者的音视频包放入广播的通道.
+// 没有发布成功(没有广播)的时候直接丢弃,广播已经结束的时候不再阻塞.
+func (s *RtmpNetStream) pushPacket(c chan *AVPacket, pkt *AVPacket) {
+	if c == nil || s.broadcast == nil {
+		return
+	}
+
+	select {
+	case c <- pkt:
+	case <-s.broadcast.done:
+	}
+}
+
+// 发布者发送的元数据是 "@setDataFrame" + "onMetaData" + ECMA Array,
+// 播放者需要的是 "onMetaData" + ECMA Array,因此需要去掉前面的"@setDataFrame".
+// AMF0 string == AMF0_STRING(1 byte) + length(2 bytes) + data.
+func stripSetDataFrame(payload []byte) []byte {
+	name := "@setDataFrame"
+	if len(payload) < 3+len(name) || payload[0] != AMF0_STRING {
+		return payload
+	}
+
+	if util.BigEndian.Uint16(payload[1:3]) != uint16(len(name)) || string(payload[3:3+len(name)]) != name {
+		return payload
+	}
+
+	return payload[3+len(name):]
+}
+
+// 数据消息的第一个AMF0 string就是消息的名字,例如onMetaData, onTextData, onCuePoint...
+func dataMessageName(payload []byte) string {
+	if len(payload) < 3 || payload[0] != AMF0_STRING {
+		return ""
+	}
+
+	l := int(util.BigEndian.Uint16(payload[1:3]))
+	if len(payload) < 3+l {
+		return ""
+	}
+
+	return string(payload[3 : 3+l])
 }
 
 func createStreamMessageHandle(s *RtmpNetStream, csmsg *CreateStreamMessage) error {
@@ -707,18 +1189,44 @@ func createStreamMessageHandle(s *RtmpNetStream, csmsg *CreateStreamMessage) err
 	return sendMessage(s.conn, SEND_CREATE_STREAM_RESPONSE_MESSAGE, csmsg.TransactionId)
 }
 
+// 服务器配置了Authenticator的时候,检查发布(publish为true)或者播放的权限
+func (s *RtmpNetStream) authorize(publish bool) error {
+	if s.conn.server == nil || s.conn.server.Authenticator == nil {
+		return nil
+	}
+
+	if publish {
+		if err := s.conn.server.Authenticator.Publish(s); err != nil {
+			return newStatusError(NetStream_Publish_BadName, err.Error())
+		}
+	} else if err := s.conn.server.Authenticator.Play(s); err != nil {
+		return newStatusError(NetStream_Play_Failed, err.Error())
+	}
+
+	return nil
+}
+
 // 当发布者成功发布流后,服务器会接收到发布流的消息,然后进行消息广播
 func publishMessageHandle(s *RtmpNetStream, pbmsg *PublishMessage) error {
+	s.streamName, s.streamQuery = splitQuery(pbmsg.PublishingName) // PublishingName == mystream?key=value
+
 	if strings.HasSuffix(s.conn.appName, "/") { // appName == "myapp"
-		s.streamPath = s.conn.appName + strings.Split(pbmsg.PublishingName, "?")[0] // PublishingName ==  myapp/mystream
+		s.streamPath = s.conn.appName + s.streamName // PublishingName ==  myapp/mystream
 	} else {
-		s.streamPath = s.conn.appName + "/" + strings.Split(pbmsg.PublishingName, "?")[0] // s.streamPath == myapp/mystream
+		s.streamPath = s.conn.appName + "/" + s.streamName // s.streamPath == myapp/mystream
+	}
+
+	// 和connect一样,先鉴权再调用ServerHandler,鉴权失败的发布不会到达ServerHandler(例如HTTP回调)
+	err := s.authorize(true)
+	if err == nil {
+		err = s.serverHandler.OnPublishing(s)
 	}
 
-	err := s.serverHandler.OnPublishing(s)
 	if err != nil {
+		code, description := errorStatus(err, NetStream_Publish_BadName)
 
-		prmdErr := newPublishResponseMessageData(s.conn.streamID, "error", err.Error())
+		prmdErr := newPublishResponseMessageData(s.conn.streamID, code, Level_Error)
+		prmdErr["description"] = description
 
 		err = sendMessage(s.conn, SEND_PUBLISH_RESPONSE_MESSAGE, prmdErr) // 服务器端发送publish的响应消息.
 		if err != nil {
@@ -751,28 +1259,47 @@ func publishMessageHandle(s *RtmpNetStream, pbmsg *PublishMessage) error {
 
 // 当订阅者成功订阅流后,服务器会接收到订阅流的消息
 func playMessageHandle(s *RtmpNetStream, plmsg *PlayMessage) error {
+	s.streamName, s.streamQuery = splitQuery(plmsg.StreamName) // StreamName == mystream?key=value
+
 	if strings.HasSuffix(s.conn.appName, "/") { // appName == "myapp"
-		s.streamPath = s.conn.appName + strings.Split(plmsg.StreamName, "?")[0] // StreamName ==  myapp/mystream
+		s.streamPath = s.conn.appName + s.streamName // StreamName ==  myapp/mystream
 	} else {
-		s.streamPath = s.conn.appName + "/" + strings.Split(plmsg.StreamName, "?")[0] // s.streamPath == myapp/mystream
+		s.streamPath = s.conn.appName + "/" + s.streamName // s.streamPath == myapp/mystream
 	}
 
 	fmt.Println("stream path:", s.streamPath)
 
+	// 先发送设置块大小的消息,之后的响应(包括拒绝播放)和加入广播之后发送的音视频都使用新的块大小
 	s.conn.writeChunkSize = 512 //RTMP_MAX_CHUNK_SIZE
-	err := s.serverHandler.OnPlaying(s)
+
+	err := sendMessage(s.conn, SEND_CHUNK_SIZE_MESSAGE, uint32(s.conn.writeChunkSize)) // 服务器端发送设置块大小的消息
+	if err != nil {
+		return err
+	}
+
+	if err = s.authorize(false); err == nil {
+		err = s.serverHandler.OnPlaying(s)
+	}
+
 	if err != nil {
-		prmdErr := newPlayResponseMessageData(s.conn.streamID, "error", err.Error())
+		code, description := errorStatus(err, NetStream_Play_Failed)
+
+		prmdErr := newPlayResponseMessageData(s.conn.streamID, code, Level_Error)
+		prmdErr["description"] = description
 
 		err = sendMessage(s.conn, SEND_PLAY_RESPONSE_MESSAGE, prmdErr) // 服务器端发送play response的消息
 		if err != nil {
 			return err
 		}
+
+		return nil
 	}
 
-	err = sendMessage(s.conn, SEND_CHUNK_SIZE_MESSAGE, uint32(s.conn.writeChunkSize)) // 服务器端发送设置块大小的消息
-	if err != nil {
-		return err
+	// 先设置模式,之后的响应发送失败的时候,关闭的时候(OnClosed)也会按照播放者处理
+	if s.mode == 0 {
+		s.mode = 2
+	} else {
+		s.mode = s.mode | 2
 	}
 
 	err = sendMessage(s.conn, SEND_STREAM_IS_RECORDED_MESSAGE, nil) // 服务器端发送另一个协议消息(用户控制),这个消息中定义了 'StreamIsRecorded' 事件和流 ID.消息在前两个字节中保存事件类型,在后四个字节中保存流 ID
@@ -799,10 +1326,17 @@ func playMessageHandle(s *RtmpNetStream, plmsg *PlayMessage) error {
 		return err
 	}
 
-	if s.mode == 0 {
-		s.mode = 2
-	} else {
-		s.mode = s.mode | 2
+	// 发送了NetStream.Play.Start之后才加入广播,订阅者的goroutine开始发送元数据和缓存的GOP.
+	// 广播在加入之前已经结束的时候(边缘模式最后一个订阅者刚刚离开,停止了拉流),重新查找广播或者从源站拉流
+	for i := 0; s.broadcast != nil && !s.broadcast.addSubscriber(s); i++ {
+		d, ok := find_or_pull_broadcast(s.conn.server.Streams, s)
+		if !ok || d == s.broadcast || i == 2 {
+			fmt.Println("Subscriber join error, Broadcast :", s.streamPath, "stopped")
+			s.closeSubscriber(true) // 发送NetStream.Play.Stop,然后关闭
+			return nil
+		}
+
+		s.broadcast = d
 	}
 
 	return nil
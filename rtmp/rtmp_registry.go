@@ -0,0 +1,117 @@
+package rtmp
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// 流注册表.
+// 保存一个Server上所有正在发布的广播(流路径 -> Broadcast),每个Server有自己的注册表,多个Server之间互不影响.
+// 发布者,订阅者分别在各自连接的goroutine中查找,注册,注销广播,因此需要加锁.
+type StreamRegistry struct {
+	lock    sync.RWMutex             // guards the following
+	streams map[string]*Broadcast    // 流路径 -> 广播
+	pulling map[string]chan struct{} // 边缘模式正在从源站拉流的流路径,拉流结束(成功或者失败)之后关闭
+}
+
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{
+		streams: make(map[string]*Broadcast),
+		pulling: make(map[string]chan struct{})}
+}
+
+// 根据流路径查找广播
+func (r *StreamRegistry) Find(path string) (*Broadcast, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.streams[path]
+	return b, ok
+}
+
+// 注册广播,流路径已经存在的时候返回错误.
+// 查找和添加在同一个锁里面完成,两个发布者同时发布同一个流路径,只有一个能成功.
+func (r *StreamRegistry) Register(b *Broadcast) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.streams[b.streamPath]; ok {
+		return errors.New("stream already exists : " + b.streamPath)
+	}
+
+	r.streams[b.streamPath] = b
+	return nil
+}
+
+// 注销广播,只有注册的是同一个广播才会注销,返回是否注销成功.
+// 防止已经停止的旧广播把同一个流路径上新发布的广播注销掉.
+func (r *StreamRegistry) Unregister(b *Broadcast) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if v, ok := r.streams[b.streamPath]; !ok || v != b {
+		return false
+	}
+
+	delete(r.streams, b.streamPath)
+	return true
+}
+
+// 边缘模式,查找广播,没有找到的时候调用start从源站拉流.
+// 同一个流路径同时只有一个订阅者拉流,同时订阅的其他订阅者等待拉流结束,然后加入拉流创建的广播,不会重复连接源站.
+func (r *StreamRegistry) pull(path string, start func() error) (*Broadcast, error) {
+	r.lock.Lock()
+	if b, ok := r.streams[path]; ok {
+		r.lock.Unlock()
+		return b, nil
+	}
+
+	if wait, ok := r.pulling[path]; ok {
+		r.lock.Unlock()
+		<-wait
+
+		if b, ok := r.Find(path); ok {
+			return b, nil
+		}
+
+		return nil, errors.New("edge pull failed : " + path)
+	}
+
+	wait := make(chan struct{})
+	r.pulling[path] = wait
+	r.lock.Unlock()
+
+	err := start()
+
+	r.lock.Lock()
+	delete(r.pulling, path)
+	b, ok := r.streams[path]
+	r.lock.Unlock()
+	close(wait)
+
+	// 拉流失败的时候,同一个流路径可能已经有发布者发布了
+	if ok {
+		return b, nil
+	}
+
+	if err == nil {
+		err = errors.New("edge pull failed : " + path)
+	}
+
+	return nil, err
+}
+
+// 返回所有正在发布的流路径(已排序)
+func (r *StreamRegistry) List() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	paths := make([]string, 0, len(r.streams))
+	for path := range r.streams {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
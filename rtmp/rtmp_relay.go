@@ -0,0 +1,275 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 转推的状态
+const (
+	RELAY_STATE_CONNECTING   = "connecting"   // 正在连接上游服务器
+	RELAY_STATE_PUBLISHING   = "publishing"   // 正在推流
+	RELAY_STATE_RECONNECTING = "reconnecting" // 连接断开,等待重连
+	RELAY_STATE_STOPPED      = "stopped"      // 已经停止
+)
+
+const (
+	RELAY_QUEUE_SIZE  = 512              // 转推发送队列的长度
+	RELAY_BACKOFF_MIN = time.Second      // 第一次重连的等待时间
+	RELAY_BACKOFF_MAX = time.Second * 30 // 最长的重连等待时间,每次重连失败等待时间翻倍
+)
+
+var errUpstreamClosed = errors.New("upstream closed the connection")
+
+// 转推的状态信息
+type RelayStatus struct {
+	URL        string    // 上游服务器地址
+	State      string    // 转推的状态
+	Reconnects int       // 重连的次数
+	LastError  string    // 最近一次断开的原因
+	Connected  time.Time // 最近一次连接成功的时间
+	Sent       uint64    // 发送的音视频包个数
+	Dropped    uint64    // 丢弃的音视频包个数
+}
+
+// 转推.
+// 发布者发布流之后,广播把音视频包放入每个上游服务器自己的发送队列中(不会阻塞),
+// 每个上游服务器有自己的goroutine,作为RTMP客户端推流到上游服务器.
+// 每个上游服务器独立重连,某一个上游服务器断开或者网络不好,不会影响发布者,订阅者和其他的上游服务器.
+//
+// 广播 --> | queue | --> relay goroutine --> RtmpClient --> 上游服务器1
+//
+//	--> | queue | --> relay goroutine --> RtmpClient --> 上游服务器2
+type Relay struct {
+	broadcast    *Broadcast     // 转推的广播
+	url          string         // 上游服务器地址(包括流名称)
+	queue        chan *AVPacket // 发送队列
+	metaData     *AVPacket      // 最新的onMetaData,重连之后先发送元数据,只在relay goroutine中访问
+	waitKeyFrame bool           // 丢帧之后,等待下一个关键帧,只在广播的goroutine中访问
+	lock         sync.Mutex     // guards status
+	status       RelayStatus    // 转推的状态
+	sent         uint64         // 发送的音视频包个数
+	dropped      uint64         // 丢弃的音视频包个数
+	once         sync.Once      // 只停止一次
+	done         chan struct{}  // 停止relay goroutine
+}
+
+// 根据应用的转推配置,得到上游服务器的推流地址.
+// 地址中的{stream}替换为流名称,没有{stream}的时候,流名称追加在地址的后面.
+func relayURL(target, streamName string) string {
+	if strings.Contains(target, "{stream}") {
+		return strings.Replace(target, "{stream}", streamName, -1)
+	}
+
+	return strings.TrimSuffix(target, "/") + "/" + streamName
+}
+
+func newRelay(b *Broadcast, url string) *Relay {
+	return &Relay{
+		broadcast: b,
+		url:       url,
+		queue:     make(chan *AVPacket, RELAY_QUEUE_SIZE),
+		metaData:  b.metaData,
+		status:    RelayStatus{URL: url, State: RELAY_STATE_CONNECTING},
+		done:      make(chan struct{})}
+}
+
+// 转推的状态
+func (r *Relay) Status() RelayStatus {
+	r.lock.Lock()
+	status := r.status
+	r.lock.Unlock()
+
+	status.Sent = atomic.LoadUint64(&r.sent)
+	status.Dropped = atomic.LoadUint64(&r.dropped)
+	return status
+}
+
+func (r *Relay) setState(state string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch state {
+	case RELAY_STATE_PUBLISHING:
+		r.status.Connected = time.Now()
+	case RELAY_STATE_RECONNECTING:
+		r.status.Reconnects++
+	}
+
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+
+	r.status.State = state
+	fmt.Println("Relay", state, ", Broadcast :", r.broadcast.streamPath, "\nUpstream :", r.url)
+}
+
+// 将音视频包放入发送队列,只在广播的goroutine中调用,不会阻塞.
+// 队列满了(上游服务器网络不好或者正在重连)之后丢帧,直到下一个关键帧.
+func (r *Relay) push(pkt *AVPacket) {
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+
+	isVideo := pkt.Type == RTMP_MSG_VIDEO
+	if r.waitKeyFrame && isVideo {
+		if !pkt.isKeyFrame() {
+			atomic.AddUint64(&r.dropped, 1)
+			return
+		}
+
+		r.waitKeyFrame = false
+	}
+
+	select {
+	case r.queue <- pkt:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+		if isVideo {
+			r.waitKeyFrame = true
+		}
+	}
+}
+
+func (r *Relay) start() {
+	go func(r *Relay) {
+		backoff := RELAY_BACKOFF_MIN
+
+		for {
+			r.setState(RELAY_STATE_CONNECTING, nil)
+
+			client, err := DialPublish(r.url)
+			if err == nil {
+				r.setState(RELAY_STATE_PUBLISHING, nil)
+				backoff = RELAY_BACKOFF_MIN
+
+				err = r.forward(client)
+				client.Close()
+			}
+
+			select {
+			case <-r.done:
+				r.setState(RELAY_STATE_STOPPED, nil)
+				return
+			default:
+			}
+
+			if err == nil {
+				err = errUpstreamClosed
+			}
+
+			r.setState(RELAY_STATE_RECONNECTING, err)
+			fmt.Println("Relay error :", err, "\nReconnect in :", backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-r.done:
+				r.setState(RELAY_STATE_STOPPED, nil)
+				return
+			}
+
+			if backoff *= 2; backoff > RELAY_BACKOFF_MAX {
+				backoff = RELAY_BACKOFF_MAX
+			}
+		}
+	}(r)
+}
+
+// 推流到上游服务器,直到连接断开或者转推停止.
+// 每次连接成功之后,先发送元数据,然后从关键帧开始,在关键帧之前先发送AVC sequence header和AAC sequence header.
+func (r *Relay) forward(client *RtmpClient) error {
+	// 上游服务器不读数据的时候,WritePacket会一直阻塞到写超时.停止转推的时候关闭客户端,WritePacket马上返回
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-r.done:
+			client.Close()
+		case <-stopped:
+		}
+	}()
+
+	// 断开期间队列中积压的都是旧的数据,直接丢弃,只保留最新的元数据
+	for drained := false; !drained; {
+		select {
+		case pkt := <-r.queue:
+			r.keepMetaData(pkt)
+			atomic.AddUint64(&r.dropped, 1)
+		default:
+			drained = true
+		}
+	}
+
+	if r.metaData != nil {
+		if err := client.WritePacket(r.metaData); err != nil {
+			return err
+		}
+	}
+
+	publisher := r.broadcast.publisher
+	started := false
+
+	for {
+		select {
+		case pkt := <-r.queue:
+			{
+				if pkt.Type != RTMP_MSG_AUDIO && pkt.Type != RTMP_MSG_VIDEO {
+					r.keepMetaData(pkt)
+				} else if !started {
+					// 有视频的时候从关键帧开始,只有音频的时候从第一个音频包开始
+					vTag, aTag := publisher.sequenceHeaders()
+					if pkt.Type == RTMP_MSG_VIDEO && !pkt.isKeyFrame() || pkt.Type == RTMP_MSG_AUDIO && vTag != nil {
+						continue
+					}
+
+					for _, tag := range []*AVPacket{vTag, aTag} {
+						if tag == nil {
+							continue
+						}
+
+						header := tag.Clone()
+						header.Timestamp = pkt.Timestamp
+						if err := client.WritePacket(header); err != nil {
+							return err
+						}
+					}
+
+					started = true
+				}
+
+				if err := client.WritePacket(pkt); err != nil {
+					return err
+				}
+
+				atomic.AddUint64(&r.sent, 1)
+			}
+		case <-client.Done():
+			{
+				return client.Err()
+			}
+		case <-r.done:
+			{
+				return nil
+			}
+		}
+	}
+}
+
+func (r *Relay) keepMetaData(pkt *AVPacket) {
+	if pkt.Type == RTMP_MSG_AMF0_METADATA && dataMessageName(pkt.Payload) == "onMetaData" {
+		r.metaData = pkt
+	}
+}
+
+func (r *Relay) stop() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
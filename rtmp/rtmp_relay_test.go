@@ -0,0 +1,121 @@
+package rtmp
+
+import (
+	"github.com/onedss/gortmp/config"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 转发到上游服务器的TCP代理,stall关闭之后不再读推流的数据,模拟不读数据的上游服务器
+func startStallProxy(t *testing.T, upstream string, stall <-chan struct{}) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		l.Close()
+	})
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		up, err := net.Dial("tcp", upstream)
+		if err != nil {
+			return
+		}
+		defer up.Close()
+
+		go io.Copy(c, up)
+
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-stall:
+				<-done
+				return
+			default:
+			}
+
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if _, err = up.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// 上游服务器不读数据,转推阻塞在发送音视频包的时候,发布者断开之后转推马上停止,不会等到写超时
+func TestRelayStopWhileBlocked(t *testing.T) {
+	upstream := &Server{Addr: freeAddr(t)}
+	startTestServer(t, upstream)
+
+	stall := make(chan struct{})
+	proxy := startStallProxy(t, upstream.Addr, stall)
+
+	defer func(targets map[string][]string) { config.RelayTargets = targets }(config.RelayTargets)
+	config.RelayTargets = map[string][]string{"live": {"rtmp://" + proxy + "/up"}}
+
+	s := &Server{Addr: freeAddr(t)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	writeTestH264(pub, 1)
+	waitTestBroadcast(t, s, "live/test")
+
+	b, _ := s.Streams.Find("live/test")
+	waitRelayState(t, b, RELAY_STATE_PUBLISHING)
+
+	close(stall)
+
+	// 足够大的关键帧,填满代理和转推之间的TCP缓冲区
+	for i := 1; i <= 120; i++ {
+		frame := make([]byte, 256<<10)
+		frame[0], frame[1] = 0x17, 1
+		if err = pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: uint32(i * 40), Payload: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	pub.Close()
+
+	waitRelayState(t, b, RELAY_STATE_STOPPED)
+}
+
+func waitRelayState(t *testing.T, b *Broadcast, state string) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		if status := b.RelayStatus(); len(status) == 1 && status[0].State == state {
+			return
+		}
+
+		if i == 300 {
+			t.Fatalf("timeout waiting for relay state %s : %+v", state, b.RelayStatus())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
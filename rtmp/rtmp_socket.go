@@ -30,6 +30,8 @@ const (
 	SEND_PLAY_MESSAGE          = "Send Play Message"
 	SEND_PLAY_RESPONSE_MESSAGE = "Send Play Response Message"
 
+	SEND_PUBLISH_MESSAGE = "Send Publish Message"
+
 	SEND_PUBLISH_RESPONSE_MESSAGE = "Send Publish Response Message"
 	SEND_PUBLISH_START_MESSAGE    = "Send Publish Start Message"
 
@@ -39,6 +41,7 @@ const (
 	SEND_FULL_AUDIO_MESSAGE = "Send Full Audio Message"
 	SEND_VIDEO_MESSAGE      = "Send Video Message"
 	SEND_FULL_VDIEO_MESSAGE = "Send Full Video Message"
+	SEND_DATA_MESSAGE       = "Send Data Message"
 )
 
 func newConnectResponseMessageData(objectEncoding float64) (amfobj AMFObjects) {
@@ -54,6 +57,16 @@ func newConnectResponseMessageData(objectEncoding float64) (amfobj AMFObjects) {
 	return
 }
 
+// 拒绝客户端的连接, description 是拒绝的原因
+func newConnectRejectedMessageData(description string) (amfobj AMFObjects) {
+	amfobj = newAMFObjects()
+	amfobj["level"] = Level_Error
+	amfobj["code"] = NetConnection_Connect_Rejected
+	amfobj["description"] = description
+
+	return
+}
+
 func newPublishResponseMessageData(streamid uint32, code, level string) (amfobj AMFObjects) {
 	amfobj = newAMFObjects()
 	amfobj["code"] = code
@@ -266,13 +279,14 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 		}
 	case SEND_CREATE_STREAM_MESSAGE:
 		{
-			if args != nil {
-				return errors.New(SEND_CREATE_STREAM_MESSAGE + ", The parameter is nil")
+			tid, ok := args.(uint64)
+			if !ok {
+				return errors.New(SEND_CREATE_STREAM_MESSAGE + ", The parameter only one(TransactionId uint64)!")
 			}
 
 			m := newCreateStreamMessage()
 			m.CommandName = "createStream"
-			m.TransactionId = 1
+			m.TransactionId = tid
 			m.Encode0()
 			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
 			m.RtmpHeader = head
@@ -298,7 +312,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 		{
 			data, ok := args.(map[interface{}]interface{})
 			if !ok {
-				errors.New(SEND_PLAY_MESSAGE + ", The parameter is map[interface{}]interface{}")
+				return errors.New(SEND_PLAY_MESSAGE + ", The parameter is map[interface{}]interface{}")
 			}
 
 			var streamName string
@@ -326,7 +340,35 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.Duration = duration
 			m.Rest = rest
 			m.Encode0()
-			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, conn.streamID, 0) // play 在 createStream 创建的流上发送
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
+		}
+	case SEND_PUBLISH_MESSAGE:
+		{
+			data, ok := args.(map[interface{}]interface{})
+			if !ok {
+				return errors.New(SEND_PUBLISH_MESSAGE + ", The parameter is map[interface{}]interface{}")
+			}
+
+			var publishingName string
+			publishingType := "live"
+
+			for i, v := range data {
+				if i == "PublishingName" {
+					publishingName = v.(string)
+				} else if i == "PublishingType" {
+					publishingType = v.(string)
+				}
+			}
+
+			m := newPublishMessage()
+			m.CommandName = "publish"
+			m.TransactionId = 0
+			m.PublishingName = publishingName
+			m.PublishingType = publishingType
+			m.Encode0()
+			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, conn.streamID, 0) // publish 在 createStream 创建的流上发送
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
@@ -350,6 +392,10 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						obj[i] = v
 					}
+				case "description":
+					{
+						obj[i] = v
+					}
 				case "streamid":
 					{
 						if t, ok := v.(uint32); ok {
@@ -410,11 +456,18 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						info[i] = v
 					}
+				case "description":
+					{
+						info[i] = v
+					}
 				}
 			}
 
 			m := newResponseConnectMessage()
 			m.CommandName = Response_Result
+			if info["level"] == Level_Error { // 拒绝连接
+				m.CommandName = Response_Error
+			}
 			m.TransactionId = 1
 			m.Properties = pro
 			m.Infomation = info
@@ -427,7 +480,7 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 		{
 			data, ok := args.(AMFObjects)
 			if !ok {
-				errors.New(SEND_CONNECT_MESSAGE + ", The parameter is AMFObjects(map[string]interface{})")
+				return errors.New(SEND_CONNECT_MESSAGE + ", The parameter is AMFObjects(map[string]interface{})")
 			}
 
 			obj := newAMFObjects()
@@ -479,6 +532,14 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						obj[i] = v
 					}
+				case "type":
+					{
+						obj[i] = v
+					}
+				default:
+					{
+						info[i] = v // 其他的作为可选的用户变量
+					}
 				}
 
 			}
@@ -487,13 +548,15 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.CommandName = "connect"
 			m.TransactionId = 1
 			m.Object = obj
-			m.Optional = info
+			if len(info) > 0 {
+				m.Optional = info
+			}
 			m.Encode0()
 			head := newRtmpHeader(RTMP_CSID_COMMAND, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_COMMAND, 0, 0)
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
-	case SEND_PUBLISH_RESPONSE_MESSAGE, SEND_PUBLISH_START_MESSAGE:
+	case SEND_PUBLISH_RESPONSE_MESSAGE, SEND_PUBLISH_START_MESSAGE, SEND_UNPUBLISH_RESPONSE_MESSAGE:
 		{
 			data, ok := args.(AMFObjects)
 			if !ok {
@@ -513,6 +576,10 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 					{
 						info[i] = v
 					}
+				case "description":
+					{
+						info[i] = v
+					}
 				case "streamid":
 					{
 						if t, ok := v.(uint32); ok {
@@ -533,9 +600,6 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 			m.RtmpHeader = head
 			return writeMessage(conn, m)
 		}
-	case SEND_UNPUBLISH_RESPONSE_MESSAGE:
-		{
-		}
 	case SEND_FULL_AUDIO_MESSAGE:
 		{
 			audio, ok := args.(*AVPacket)
@@ -572,72 +636,33 @@ func sendMessage(conn *RtmpNetConnection, message string, args interface{}) erro
 
 			return sendAVMessage(conn, video, false, false)
 		}
+	case SEND_DATA_MESSAGE:
+		{
+			data, ok := args.(*AVPacket)
+			if !ok {
+				return errors.New(SEND_DATA_MESSAGE + ", The parameter is AVPacket")
+			}
+
+			// 数据消息(onMetaData...)单独使用一个块流,不影响音视频块流的时间戳差值
+			m := newMetadataMessage()
+			m.RtmpBody.Payload = data.Payload
+			head := newRtmpHeader(RTMP_CSID_DATA, 0, uint32(len(m.RtmpBody.Payload)), RTMP_MSG_AMF0_METADATA, conn.streamID, 0)
+			m.RtmpHeader = head
+			return writeMessage(conn, m)
+		}
 	}
 
 	return errors.New("send message no exist")
 }
 
 func writeMessage(conn *RtmpNetConnection, msg RtmpMessage) error {
-	if conn.writeSeqNum > conn.bandwidth {
-		conn.totalWrite += conn.writeSeqNum
-		conn.writeSeqNum = 0
-		sendMessage(conn, SEND_ACK_MESSAGE, conn.totalWrite)
-		sendMessage(conn, SEND_PING_REQUEST_MESSAGE, nil)
-	}
-
-	mark, need, err := encodeChunk12(msg.Header(), msg.Body().Payload, conn.writeChunkSize)
-	if err != nil {
-		return err
-	}
-
-	_, err = conn.bw.Write(mark)
-	if err != nil {
-		return err
-	}
-
-	err = conn.bw.Flush()
-	if err != nil {
-		return err
-	}
-
-	conn.writeSeqNum += uint32(len(mark))
-
-	for need != nil && len(need) > 0 {
-		mark, need, err = encodeChunk1(msg.Header(), need, conn.writeChunkSize)
-		if err != nil {
-			return err
-		}
-
-		_, err = conn.bw.Write(mark)
-		if err != nil {
-			return err
-		}
-
-		err = conn.bw.Flush()
-		if err != nil {
-			return err
-		}
-
-		conn.writeSeqNum += uint32(len(mark))
-	}
-
-	return nil
+	return writeChunks(conn, msg.Header(), msg.Body().Payload, true)
 }
 
 // 当发送音视频数据的时候,当块类型为12的时候,Chunk Message Header有一个字段TimeStamp,指明一个时间
 // 当块类型为4,8的时候,Chunk Message Header有一个字段TimeStamp Delta,记录与上一个Chunk的时间差值
 // 当块类型为0的时候,Chunk Message Header没有时间字段,与上一个Chunk时间值相同
 func sendAVMessage(conn *RtmpNetConnection, av *AVPacket, isAudio bool, isFirst bool) error {
-	if conn.writeSeqNum > conn.bandwidth {
-		conn.totalWrite += conn.writeSeqNum
-		conn.writeSeqNum = 0
-		sendMessage(conn, SEND_ACK_MESSAGE, conn.totalWrite)
-		sendMessage(conn, SEND_PING_REQUEST_MESSAGE, nil)
-	}
-
-	var err error
-	var mark []byte
-	var need []byte
 	var head *RtmpHeader
 
 	if isAudio {
@@ -646,31 +671,37 @@ func sendAVMessage(conn *RtmpNetConnection, av *AVPacket, isAudio bool, isFirst
 		head = newRtmpHeader(RTMP_CSID_VIDEO, av.Timestamp, uint32(len(av.Payload)), RTMP_MSG_VIDEO, conn.streamID, 0)
 	}
 
-	// 第一次是发送关键帧,需要完整的消息头(Chunk Basic Header(1) + Chunk Message Header(11) + Extended Timestamp(4)(可能会要包括))
-	// 后面开始,就是直接发送音视频数据,那么直接发送,不需要完整的块(Chunk Basic Header(1) + Chunk Message Header(7))
-	// 当Chunk Type为0时(即Chunk12),
-	if isFirst {
-		mark, need, err = encodeChunk12(head, av.Payload, conn.writeChunkSize)
-	} else {
-		mark, need, err = encodeChunk8(head, av.Payload, conn.writeChunkSize)
+	return writeChunks(conn, head, av.Payload, isFirst)
+}
+
+// 将一个消息分成块发送出去.
+// 第一次是发送关键帧,需要完整的消息头(Chunk Basic Header(1) + Chunk Message Header(11) + Extended Timestamp(4)(可能会要包括))
+// 后面开始,就是直接发送音视频数据,那么直接发送,不需要完整的块(Chunk Basic Header(1) + Chunk Message Header(7))
+// 当Chunk Type为0时(即Chunk12),
+func writeChunks(conn *RtmpNetConnection, head *RtmpHeader, payload []byte, isFirst bool) error {
+	if total, ok := conn.checkWriteAck(); ok {
+		sendMessage(conn, SEND_ACK_MESSAGE, total)
+		sendMessage(conn, SEND_PING_REQUEST_MESSAGE, nil)
 	}
 
-	if err != nil {
-		return err
+	var err error
+	var mark []byte
+	var need []byte
+
+	if isFirst {
+		mark, need, err = encodeChunk12(head, payload, conn.writeChunkSize)
+	} else {
+		mark, need, err = encodeChunk8(head, payload, conn.writeChunkSize)
 	}
 
-	_, err = conn.bw.Write(mark)
 	if err != nil {
 		return err
 	}
 
-	err = conn.bw.Flush()
-	if err != nil {
+	if err = conn.writeChunk(mark); err != nil {
 		return err
 	}
 
-	conn.writeSeqNum += uint32(len(mark))
-
 	// 如果音视频数据太大,一次发送不完,那么在这里进行分割(data + Chunk Basic Header(1))
 	for need != nil && len(need) > 0 {
 		mark, need, err = encodeChunk1(head, need, conn.writeChunkSize)
@@ -678,17 +709,9 @@ func sendAVMessage(conn *RtmpNetConnection, av *AVPacket, isAudio bool, isFirst
 			return err
 		}
 
-		_, err = conn.bw.Write(mark)
-		if err != nil {
-			return err
-		}
-
-		err = conn.bw.Flush()
-		if err != nil {
+		if err = conn.writeChunk(mark); err != nil {
 			return err
 		}
-
-		conn.writeSeqNum += uint32(len(mark))
 	}
 
 	return nil
@@ -727,6 +750,12 @@ func readChunk(conn *RtmpNetConnection) (msg RtmpMessage, err error) {
 		return nil, errors.New("get chunk type error :" + err.Error())
 	}
 
+	// 块类型为3的时候,如果是一个新的消息,时间戳差值和上一个消息相同.如果是消息剩下的块,块类型保持为消息第一个块的类型.
+	// 这样读出来的消息头中的块类型,就可以知道时间戳是绝对时间戳(0)还是时间戳差值(1,2,3).
+	if cbh.ChunkType == 3 && conn.incompleteRtmpBody[cbh.ChunkStreamID] == nil {
+		chunkHead.ChunkBasicHeader.ChunkType = cbh.ChunkType
+	}
+
 	if conn.incompleteRtmpBody[cbh.ChunkStreamID] == nil {
 		conn.incompleteRtmpBody[cbh.ChunkStreamID] = make([]byte, 0)
 	}
@@ -806,6 +835,7 @@ func readChunkType(conn *RtmpNetConnection, h *RtmpHeader, chunkType byte) (head
 				return nil, err
 			}
 			conn.readSeqNum += 3
+			h.ChunkBasicHeader.ChunkType = chunkType
 			h.ChunkMessgaeHeader.Timestamp = util.BigEndian.Uint24(b) //type = 0的时间戳为绝对时间,其他的都为相对时间
 
 			// Message Length 3 bytes
@@ -899,7 +929,6 @@ func readChunkType(conn *RtmpNetConnection, h *RtmpHeader, chunkType byte) (head
 		}
 	case 3:
 		{
-			h.ChunkBasicHeader.ChunkType = chunkType
 		}
 	}
 
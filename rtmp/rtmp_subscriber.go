@@ -0,0 +1,234 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// 订阅者发送队列满了之后的处理策略
+const (
+	SUBSCRIBER_OVERFLOW_DROP_FRAME = "drop_frame" // 丢弃非关键帧,直到下一个关键帧(IDR)
+	SUBSCRIBER_OVERFLOW_DROP_GOP   = "drop_gop"   // 丢弃队列中整个GOP,直到下一个关键帧(IDR)
+	SUBSCRIBER_OVERFLOW_DISCONNECT = "disconnect" // 断开订阅者
+)
+
+// 订阅者发送音视频包的目标.
+// RTMP的播放者(RtmpNetStream)和HTTP-FLV的播放者(FlvSubscriber)都实现了这个接口,在广播中都是普通的订阅者.
+type subscriberSink interface {
+	SendAudio(audio *AVPacket) error
+	SendVideo(video *AVPacket) error
+	SendData(data *AVPacket) error
+	subscriberID() string        // 在广播中的标识
+	subscriberClosed() bool      // 已经关闭,广播收到之后删除订阅者
+	subscriberError(err error)   // 发送失败
+	closeSubscriber(notify bool) // 广播结束的时候关闭,notify为true的时候通知客户端播放结束
+	Close()
+}
+
+// 订阅者.
+// 广播的goroutine只负责将发布者的音视频包放入每个订阅者自己的发送队列中(不会阻塞),
+// 每个订阅者有自己的goroutine从队列中取出音视频包发送给客户端.
+// 这样某一个网络不好的订阅者,不会阻塞发布者和其他的订阅者.
+//
+// 广播 --> | queue | --> writer goroutine --> 订阅者1
+//
+//	--> | queue | --> writer goroutine --> 订阅者2
+//	--> | queue | --> writer goroutine --> 订阅者3
+type Subscriber struct {
+	sink         subscriberSink // 订阅者
+	queue        chan *AVPacket // 发送队列
+	snapshot     []*AVPacket    // 加入时的元数据和GOP缓存,在发送队列之前先发送
+	policy       string         // 发送队列满了之后的处理策略
+	waitKeyFrame bool           // 丢帧之后,等待下一个关键帧
+	once         sync.Once      // 只停止一次
+	done         chan struct{}  // 停止writer goroutine
+	exited       chan struct{}  // writer goroutine退出之后关闭
+	droppedAudio uint64         // 丢弃的音频包个数
+	droppedVideo uint64         // 丢弃的视频包个数
+	droppedData  uint64         // 丢弃的数据消息个数
+}
+
+func newSubscriber(s subscriberSink, size int, policy string, snapshot []*AVPacket) *Subscriber {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &Subscriber{
+		sink:     s,
+		queue:    make(chan *AVPacket, size),
+		snapshot: snapshot,
+		policy:   policy,
+		done:     make(chan struct{}),
+		exited:   make(chan struct{})}
+}
+
+// 丢弃的音频包个数
+func (sub *Subscriber) DroppedAudio() uint64 {
+	return atomic.LoadUint64(&sub.droppedAudio)
+}
+
+// 丢弃的视频包个数
+func (sub *Subscriber) DroppedVideo() uint64 {
+	return atomic.LoadUint64(&sub.droppedVideo)
+}
+
+// 丢弃的数据消息个数
+func (sub *Subscriber) DroppedData() uint64 {
+	return atomic.LoadUint64(&sub.droppedData)
+}
+
+// 丢弃的包的总个数
+func (sub *Subscriber) Dropped() uint64 {
+	return sub.DroppedAudio() + sub.DroppedVideo() + sub.DroppedData()
+}
+
+func (sub *Subscriber) drop(pkt *AVPacket) {
+	switch pkt.Type {
+	case RTMP_MSG_AUDIO:
+		atomic.AddUint64(&sub.droppedAudio, 1)
+	case RTMP_MSG_VIDEO:
+		atomic.AddUint64(&sub.droppedVideo, 1)
+	default:
+		atomic.AddUint64(&sub.droppedData, 1)
+	}
+}
+
+// 将音视频包放入发送队列,只在广播的goroutine中调用,不会阻塞.
+// 队列满了之后,根据策略丢帧或者断开订阅者.
+func (sub *Subscriber) push(pkt *AVPacket) {
+	select {
+	case <-sub.done: // 已经停止
+		return
+	default:
+	}
+
+	isVideo := pkt.Type == RTMP_MSG_VIDEO
+	isKeyFrame := isVideo && pkt.isKeyFrame()
+
+	// 丢帧之后,在下一个关键帧到来之前,非关键帧都无法解码,直接丢弃
+	if sub.waitKeyFrame && isVideo {
+		if !isKeyFrame {
+			sub.drop(pkt)
+			return
+		}
+
+		sub.waitKeyFrame = false
+	}
+
+	select {
+	case sub.queue <- pkt:
+		return
+	default:
+	}
+
+	switch sub.policy {
+	case SUBSCRIBER_OVERFLOW_DISCONNECT:
+		{
+			sub.drop(pkt)
+			fmt.Println("Subscriber queue full, disconnect :", sub.sink.subscriberID())
+			sub.stop()
+			go sub.sink.Close()
+			return
+		}
+	case SUBSCRIBER_OVERFLOW_DROP_GOP:
+		{
+			// 丢弃队列中所有的包(整个GOP),关键帧可以重新开始一个GOP
+		loop:
+			for {
+				select {
+				case p := <-sub.queue:
+					sub.drop(p)
+				default:
+					break loop
+				}
+			}
+
+			if isKeyFrame {
+				sub.queue <- pkt
+				return
+			}
+		}
+	}
+
+	sub.drop(pkt)
+
+	// 丢弃的视频帧之后的非关键帧都无法解码, drop_gop 策略下整个GOP都已经丢弃了
+	if isVideo || sub.policy == SUBSCRIBER_OVERFLOW_DROP_GOP {
+		sub.waitKeyFrame = true
+	}
+}
+
+func (sub *Subscriber) start() {
+	go func(sub *Subscriber) {
+		defer close(sub.exited)
+
+		// 先发送元数据和缓存的GOP,SendVideo()会在发送第一个关键帧之前发送AVC sequence header
+		for _, pkt := range sub.snapshot {
+			if err := sub.send(pkt.Clone()); err != nil {
+				sub.sink.subscriberError(err)
+				return
+			}
+		}
+
+		sub.snapshot = nil
+
+		for {
+			select {
+			case pkt := <-sub.queue:
+				{
+					// 发送队列中的包是所有订阅者共享的,SendAudio()和SendVideo()会改变时间戳,因此拷贝一份
+					if err := sub.send(pkt.Clone()); err != nil {
+						sub.sink.subscriberError(err)
+						return
+					}
+				}
+			case <-sub.done:
+				{
+					return
+				}
+			}
+		}
+	}(sub)
+}
+
+func (sub *Subscriber) send(pkt *AVPacket) error {
+	switch pkt.Type {
+	case RTMP_MSG_AUDIO:
+		return sub.sink.SendAudio(pkt)
+	case RTMP_MSG_VIDEO:
+		return sub.sink.SendVideo(pkt)
+	default:
+		return sub.sink.SendData(pkt)
+	}
+}
+
+// RtmpNetStream 作为订阅者
+func (s *RtmpNetStream) subscriberID() string {
+	return s.conn.remoteAddr
+}
+
+func (s *RtmpNetStream) subscriberClosed() bool {
+	return s.closed
+}
+
+func (s *RtmpNetStream) subscriberError(err error) {
+	s.serverHandler.OnError(s, err)
+}
+
+func (s *RtmpNetStream) closeSubscriber(notify bool) {
+	if notify {
+		prmdStop := newPlayResponseMessageData(s.conn.streamID, NetStream_Play_Stop, Level_Status)
+		if err := sendMessage(s.conn, SEND_PLAY_RESPONSE_MESSAGE, prmdStop); err != nil {
+			fmt.Println("send play stop error :", err)
+		}
+	}
+
+	s.Close() // 关闭RtmpNetStream
+}
+
+func (sub *Subscriber) stop() {
+	sub.once.Do(func() {
+		close(sub.done)
+	})
+}
@@ -0,0 +1,106 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+)
+
+// RTMPS(RTMP over TLS).
+// TLS监听和普通的TCP监听同时运行,TLS握手完成之后,RTMP的握手,消息和普通的TCP连接完全一样.
+// 证书可以根据客户端请求的域名(SNI)选择,没有匹配的域名的时候使用默认的证书.
+
+// 证书文件和私钥文件(PEM格式)
+type TLSCert struct {
+	CertFile string
+	KeyFile  string
+}
+
+// rtmps客户端(DialPublish, DialPlay)的TLS配置,为nil的时候使用默认配置(校验服务器证书)
+var ClientTLSConfig *tls.Config
+
+func (s *Server) listenTLS() (net.Listener, error) {
+	config, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", s.TLSAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(l, config), nil
+}
+
+// 自定义的TLS配置优先,否则根据默认证书和SNI证书生成TLS配置
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.TLSConfig != nil {
+		return s.TLSConfig.Clone(), nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(s.SNICerts) == 0 {
+		if len(config.Certificates) == 0 {
+			return nil, errors.New("rtmps: no certificate")
+		}
+
+		return config, nil
+	}
+
+	certs := make(map[string]*tls.Certificate, len(s.SNICerts))
+	for name, c := range s.SNICerts {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certs[strings.ToLower(name)] = &cert
+	}
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert := sniCertificate(certs, hello.ServerName); cert != nil {
+			return cert, nil
+		}
+
+		if len(config.Certificates) == 0 {
+			return nil, errors.New("rtmps: no certificate for " + hello.ServerName)
+		}
+
+		return &config.Certificates[0], nil
+	}
+
+	return config, nil
+}
+
+// 先精确匹配域名,再匹配通配符域名(*.example.com)
+func sniCertificate(certs map[string]*tls.Certificate, serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil
+	}
+
+	if cert, ok := certs[name]; ok {
+		return cert
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := certs["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package rtmp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 本地的空闲端口
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// 启动测试用的服务器,测试结束的时候关闭
+func startTestServer(t *testing.T, s *Server) {
+	if s.Handler == nil {
+		s.Handler = new(DefaultServerHandler)
+	}
+
+	if err := s.ListenAndServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+}
+
+// 生成自签名证书,写到dir中的 name.crt 和 name.key, CN是第一个域名
+func writeSelfSignedCert(t *testing.T, dir, name string, dnsNames ...string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestSNICertificate(t *testing.T) {
+	exact, wildcard := new(tls.Certificate), new(tls.Certificate)
+	certs := map[string]*tls.Certificate{
+		"live.example.com":  exact,
+		"*.cdn.example.com": wildcard,
+	}
+
+	tests := []struct {
+		serverName string
+		want       *tls.Certificate
+	}{
+		{"live.example.com", exact},
+		{"LIVE.Example.com.", exact},
+		{"edge1.cdn.example.com", wildcard},
+		{"cdn.example.com", nil},
+		{"a.edge1.cdn.example.com", nil},
+		{"other.example.com", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := sniCertificate(certs, tt.serverName); got != tt.want {
+			t.Errorf("sniCertificate(%q) = %p, want %p", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestRTMPSServeSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultCert, defaultKey, dc := writeSelfSignedCert(t, dir, "default", "default.test")
+	liveCert, liveKey, lc := writeSelfSignedCert(t, dir, "live", "live.example.com")
+	cdnCert, cdnKey, cc := writeSelfSignedCert(t, dir, "cdn", "*.cdn.example.com")
+
+	s := &Server{
+		Addr:     freeAddr(t),
+		TLSAddr:  freeAddr(t),
+		CertFile: defaultCert,
+		KeyFile:  defaultKey,
+		SNICerts: map[string]TLSCert{
+			"live.example.com":  {CertFile: liveCert, KeyFile: liveKey},
+			"*.cdn.example.com": {CertFile: cdnCert, KeyFile: cdnKey},
+		},
+	}
+	startTestServer(t, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(dc)
+	roots.AddCert(lc)
+	roots.AddCert(cc)
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"live.example.com", "live.example.com"},
+		{"edge1.cdn.example.com", "*.cdn.example.com"},
+		{"unknown.example.com", "default.test"},
+		{"", "default.test"},
+	}
+
+	for _, tt := range tests {
+		conn, err := tls.Dial("tcp", s.TLSAddr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial %q: %v", tt.serverName, err)
+		}
+
+		if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != tt.want {
+			t.Errorf("server name %q: got certificate %q, want %q", tt.serverName, got, tt.want)
+		}
+
+		conn.Close()
+	}
+
+	// TLS握手之后是普通的RTMP,客户端校验SNI选择的证书
+	defer func(c *tls.Config) { ClientTLSConfig = c }(ClientTLSConfig)
+	ClientTLSConfig = &tls.Config{RootCAs: roots, ServerName: "edge1.cdn.example.com"}
+
+	c, err := DialPublish("rtmps://" + s.TLSAddr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+}
+
+func TestRTMPSNoCertificate(t *testing.T) {
+	s := &Server{TLSAddr: "127.0.0.1:0"}
+	if _, err := s.tlsConfig(); err == nil {
+		t.Error("tlsConfig without certificates: want error")
+	}
+}
@@ -0,0 +1,203 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 回调的事件
+const (
+	WEBHOOK_ON_CONNECT     = "on_connect"     // 客户端connect
+	WEBHOOK_ON_PUBLISH     = "on_publish"     // 开始发布,回调失败(非2xx)拒绝发布
+	WEBHOOK_ON_UNPUBLISH   = "on_unpublish"   // 停止发布
+	WEBHOOK_ON_PLAY        = "on_play"        // 开始播放,回调失败(非2xx)拒绝播放
+	WEBHOOK_ON_STOP        = "on_stop"        // 停止播放
+	WEBHOOK_ON_RECORD_DONE = "on_record_done" // 广播结束,录制(HLS)完成
+)
+
+const WEBHOOK_TIMEOUT = time.Second * 5 // 回调的默认超时时间
+
+// POST给回调地址的JSON
+type WebhookEvent struct {
+	Action     string     `json:"action"`                // 事件,例如 on_publish
+	RemoteAddr string     `json:"remote_addr"`           // 客户端地址
+	TcUrl      string     `json:"tc_url"`                // 客户端connect的tcUrl
+	App        string     `json:"app"`                   // 应用名
+	Stream     string     `json:"stream,omitempty"`      // 流名称
+	StreamPath string     `json:"stream_path,omitempty"` // 流路径, 应用名/流名称
+	Query      url.Values `json:"query,omitempty"`       // 流名称(connect的时候是应用名)后面的参数
+	Path       string     `json:"path,omitempty"`        // 录制完成的文件(播放列表)
+	Time       int64      `json:"time"`                  // 事件的时间(unix秒)
+}
+
+// ServerHandler 实现了这个接口的时候,客户端connect的时候调用,返回错误表示拒绝连接(NetConnection.Connect.Rejected)
+type ConnectHandler interface {
+	OnConnect(c *RtmpNetConnection) error
+}
+
+// ServerHandler 实现了这个接口的时候,广播结束写完录制文件之后调用
+type RecordHandler interface {
+	OnRecordDone(s *RtmpNetStream, path string)
+}
+
+// HTTP回调.
+// 包装另一个ServerHandler(一般是DefaultServerHandler),在事件发生的时候POST JSON(WebhookEvent)到配置的地址,地址为空表示这个事件不回调.
+// 鉴权(Authenticator)在所有的回调之前,鉴权失败的发布和播放不回调.
+// on_publish在包装的ServerHandler开始广播之前,on_play在加入广播之前同步回调,返回非2xx的时候拒绝发布或者播放,
+// 其他的事件只是通知,在单独的goroutine中回调,不会阻塞连接.
+type WebhookHandler struct {
+	ServerHandler                // 被包装的处理器
+	OnConnectURL    string       // on_connect 回调地址
+	OnPublishURL    string       // on_publish 回调地址
+	OnUnpublishURL  string       // on_unpublish 回调地址
+	OnPlayURL       string       // on_play 回调地址
+	OnStopURL       string       // on_stop 回调地址
+	OnRecordDoneURL string       // on_record_done 回调地址
+	Client          *http.Client // 回调使用的HTTP客户端
+}
+
+func NewWebhookHandler(next ServerHandler) *WebhookHandler {
+	return &WebhookHandler{
+		ServerHandler: next,
+		Client:        &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+func (w *WebhookHandler) OnConnect(c *RtmpNetConnection) error {
+	if h, ok := w.ServerHandler.(ConnectHandler); ok {
+		if err := h.OnConnect(c); err != nil {
+			return err
+		}
+	}
+
+	if w.OnConnectURL != "" {
+		event := w.newEvent(WEBHOOK_ON_CONNECT, c)
+		event.Query = c.appQuery
+		go w.notify(w.OnConnectURL, event)
+	}
+
+	return nil
+}
+
+// on_publish在开始广播之前回调,被拒绝的流不会注册,不会转推,播放者也找不到这个流.
+// 之后包装的ServerHandler开始广播失败(例如流已经存在)的时候回调on_unpublish,和on_publish成对
+func (w *WebhookHandler) OnPublishing(s *RtmpNetStream) error {
+	if w.OnPublishURL != "" {
+		if err := w.post(w.OnPublishURL, w.newStreamEvent(WEBHOOK_ON_PUBLISH, s)); err != nil {
+			return newStatusError(NetStream_Publish_BadName, err.Error())
+		}
+	}
+
+	if err := w.ServerHandler.OnPublishing(s); err != nil {
+		if w.OnPublishURL != "" && w.OnUnpublishURL != "" {
+			go w.notify(w.OnUnpublishURL, w.newStreamEvent(WEBHOOK_ON_UNPUBLISH, s))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// on_play在加入广播之前回调,被拒绝的播放者不会收到任何音视频包.
+// 之后加入广播失败(例如流不存在)的时候回调on_stop,和on_play成对
+func (w *WebhookHandler) OnPlaying(s *RtmpNetStream) error {
+	if w.OnPlayURL != "" {
+		if err := w.post(w.OnPlayURL, w.newStreamEvent(WEBHOOK_ON_PLAY, s)); err != nil {
+			return newStatusError(NetStream_Play_Failed, err.Error())
+		}
+	}
+
+	if err := w.ServerHandler.OnPlaying(s); err != nil {
+		if w.OnPlayURL != "" && w.OnStopURL != "" {
+			go w.notify(w.OnStopURL, w.newStreamEvent(WEBHOOK_ON_STOP, s))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// 只有发布或者播放成功的流才回调,边缘模式拉流的发布者没有on_publish,也就没有on_unpublish
+func (w *WebhookHandler) OnClosed(s *RtmpNetStream) {
+	w.ServerHandler.OnClosed(s)
+
+	if s.mode&1 != 0 && s.edge == nil && w.OnUnpublishURL != "" {
+		go w.notify(w.OnUnpublishURL, w.newStreamEvent(WEBHOOK_ON_UNPUBLISH, s))
+	}
+
+	if s.mode&2 != 0 && w.OnStopURL != "" {
+		go w.notify(w.OnStopURL, w.newStreamEvent(WEBHOOK_ON_STOP, s))
+	}
+}
+
+func (w *WebhookHandler) OnRecordDone(s *RtmpNetStream, path string) {
+	if h, ok := w.ServerHandler.(RecordHandler); ok {
+		h.OnRecordDone(s, path)
+	}
+
+	if w.OnRecordDoneURL != "" {
+		event := w.newStreamEvent(WEBHOOK_ON_RECORD_DONE, s)
+		event.Path = path
+		go w.notify(w.OnRecordDoneURL, event)
+	}
+}
+
+func (w *WebhookHandler) newEvent(action string, c *RtmpNetConnection) *WebhookEvent {
+	return &WebhookEvent{
+		Action:     action,
+		RemoteAddr: c.remoteAddr,
+		TcUrl:      c.url,
+		App:        c.appName,
+		Time:       time.Now().Unix()}
+}
+
+func (w *WebhookHandler) newStreamEvent(action string, s *RtmpNetStream) *WebhookEvent {
+	event := w.newEvent(action, s.conn)
+	event.Stream = s.streamName
+	event.StreamPath = s.streamPath
+	event.Query = s.streamQuery
+	return event
+}
+
+// 通知类的回调,失败只打印
+func (w *WebhookHandler) notify(rawurl string, event *WebhookEvent) {
+	if err := w.post(rawurl, event); err != nil {
+		fmt.Println("Webhook", event.Action, "error :", err)
+	}
+}
+
+// POST JSON到回调地址,返回非2xx的时候返回错误
+func (w *WebhookHandler) post(rawurl string, event *WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Post(rawurl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("webhook " + event.Action + " rejected : " + strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode))
+	}
+
+	return nil
+}
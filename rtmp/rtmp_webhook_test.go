@@ -0,0 +1,252 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"github.com/onedss/gortmp/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 记录收到的回调,on_publish的流名称是denied或者on_play带着deny参数的时候拒绝.
+// 流名称是slow-denied的时候,等一会再拒绝
+func newWebhookTestServer(t *testing.T) (*httptest.Server, chan *WebhookEvent) {
+	events := make(chan *WebhookEvent, 32)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := new(WebhookEvent)
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			t.Error("decode webhook event:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if "/"+event.Action != r.URL.Path {
+			t.Errorf("webhook %s posted to %s", event.Action, r.URL.Path)
+		}
+
+		events <- event
+
+		if event.Action == WEBHOOK_ON_PUBLISH && event.Stream == "slow-denied" {
+			time.Sleep(500 * time.Millisecond)
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+
+		if (event.Action == WEBHOOK_ON_PUBLISH && event.Stream == "denied") ||
+			(event.Action == WEBHOOK_ON_PLAY && event.Query.Get("deny") != "") {
+			http.Error(w, "denied", http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, events
+}
+
+func startWebhookTestServer(t *testing.T, auth Authenticator) (*Server, chan *WebhookEvent) {
+	ts, events := newWebhookTestServer(t)
+
+	w := NewWebhookHandler(new(DefaultServerHandler))
+	w.OnPublishURL = ts.URL + "/" + WEBHOOK_ON_PUBLISH
+	w.OnUnpublishURL = ts.URL + "/" + WEBHOOK_ON_UNPUBLISH
+	w.OnPlayURL = ts.URL + "/" + WEBHOOK_ON_PLAY
+	w.OnStopURL = ts.URL + "/" + WEBHOOK_ON_STOP
+
+	s := &Server{Addr: freeAddr(t), Handler: w, Authenticator: auth}
+	startTestServer(t, s)
+
+	return s, events
+}
+
+func waitWebhookEvent(t *testing.T, events chan *WebhookEvent, action string) *WebhookEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.Action != action {
+			t.Fatalf("got webhook %s, want %s", event.Action, action)
+		}
+
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for webhook %s", action)
+	}
+
+	return nil
+}
+
+func noWebhookEvent(t *testing.T, events chan *WebhookEvent) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected webhook %s", event.Action)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebhookPublishPlay(t *testing.T) {
+	s, events := startWebhookTestServer(t, nil)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	event := waitWebhookEvent(t, events, WEBHOOK_ON_PUBLISH)
+	if event.App != "live" || event.Stream != "test" || event.StreamPath != "live/test" {
+		t.Errorf("on_publish app/stream/path = %q/%q/%q", event.App, event.Stream, event.StreamPath)
+	}
+
+	if event.TcUrl != "rtmp://"+s.Addr+"/live" {
+		t.Errorf("on_publish tc_url = %q", event.TcUrl)
+	}
+
+	if event.Query.Get("token") != "abc" {
+		t.Errorf("on_publish query = %v", event.Query)
+	}
+
+	if event.RemoteAddr == "" || event.Time <= 0 {
+		t.Errorf("on_publish remote_addr = %q, time = %d", event.RemoteAddr, event.Time)
+	}
+
+	player, err := DialPlay("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event = waitWebhookEvent(t, events, WEBHOOK_ON_PLAY)
+	if event.StreamPath != "live/test" {
+		t.Errorf("on_play stream_path = %q", event.StreamPath)
+	}
+
+	player.Close()
+	waitWebhookEvent(t, events, WEBHOOK_ON_STOP)
+
+	pub.Close()
+	event = waitWebhookEvent(t, events, WEBHOOK_ON_UNPUBLISH)
+	if event.StreamPath != "live/test" {
+		t.Errorf("on_unpublish stream_path = %q", event.StreamPath)
+	}
+}
+
+func TestWebhookReject(t *testing.T) {
+	s, events := startWebhookTestServer(t, nil)
+
+	if c, err := DialPublish("rtmp://" + s.Addr + "/live/denied"); err == nil {
+		c.Close()
+		t.Fatal("publish rejected by on_publish: want error")
+	}
+
+	waitWebhookEvent(t, events, WEBHOOK_ON_PUBLISH)
+
+	// 被拒绝的发布没有开始广播,同一个流可以重新发布
+	if _, ok := s.Streams.Find("live/denied"); ok {
+		t.Error("rejected publish is still registered")
+	}
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	waitWebhookEvent(t, events, WEBHOOK_ON_PUBLISH)
+
+	if c, err := DialPlay("rtmp://" + s.Addr + "/live/test?deny=1"); err == nil {
+		c.Close()
+		t.Fatal("play rejected by on_play: want error")
+	}
+
+	waitWebhookEvent(t, events, WEBHOOK_ON_PLAY)
+	noWebhookEvent(t, events)
+}
+
+// 统计上游服务器收到的发布
+type countingPublishHandler struct {
+	DefaultServerHandler
+	publishes int32
+}
+
+func (h *countingPublishHandler) OnPublishing(s *RtmpNetStream) error {
+	atomic.AddInt32(&h.publishes, 1)
+	return h.DefaultServerHandler.OnPublishing(s)
+}
+
+// 等待on_publish回调的时候,流还没有开始广播:播放者找不到这个流,也不会转推到上游服务器.
+// 之后被拒绝的流从来没有被转推或者播放过
+func TestWebhookRejectBeforeBroadcast(t *testing.T) {
+	upstream := &Server{Addr: freeAddr(t), Handler: new(countingPublishHandler)}
+	startTestServer(t, upstream)
+
+	defer func(targets map[string][]string) { config.RelayTargets = targets }(config.RelayTargets)
+	config.RelayTargets = map[string][]string{"live": {"rtmp://" + upstream.Addr + "/up"}}
+
+	s, events := startWebhookTestServer(t, nil)
+
+	rejected := make(chan error, 1)
+	go func() {
+		c, err := DialPublish("rtmp://" + s.Addr + "/live/slow-denied")
+		if err == nil {
+			c.Close()
+		}
+
+		rejected <- err
+	}()
+
+	waitWebhookEvent(t, events, WEBHOOK_ON_PUBLISH)
+
+	if c, err := DialPlay("rtmp://" + s.Addr + "/live/slow-denied"); err == nil {
+		c.Close()
+		t.Error("play a stream waiting for on_publish: want error")
+	} else {
+		waitWebhookEvent(t, events, WEBHOOK_ON_PLAY)
+	}
+
+	if err := <-rejected; err == nil {
+		t.Fatal("publish rejected by on_publish: want error")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&upstream.Handler.(*countingPublishHandler).publishes); n != 0 {
+		t.Errorf("upstream publishes = %d, want 0", n)
+	}
+}
+
+func TestWebhookAfterAuth(t *testing.T) {
+	auth := NewHMACAuthenticator("secret", true)
+	s, events := startWebhookTestServer(t, auth)
+
+	// 鉴权失败的发布和播放不回调
+	if c, err := DialPublish("rtmp://" + s.Addr + "/live/test?expires=1&sign=00"); err == nil {
+		c.Close()
+		t.Fatal("publish with invalid sign: want error")
+	}
+
+	noWebhookEvent(t, events)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	query := "?expires=" + strconv.FormatInt(expires, 10) + "&sign=" + auth.Sign("live/test", expires)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitWebhookEvent(t, events, WEBHOOK_ON_PUBLISH)
+
+	if c, err := DialPlay("rtmp://" + s.Addr + "/live/test"); err == nil {
+		c.Close()
+		t.Fatal("play without sign: want error")
+	}
+
+	noWebhookEvent(t, events)
+
+	pub.Close()
+	waitWebhookEvent(t, events, WEBHOOK_ON_UNPUBLISH)
+}
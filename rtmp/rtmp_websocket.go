@@ -0,0 +1,241 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket(RFC 6455)服务器端,只实现WebSocket-FLV需要的部分.
+// 握手之后服务器只发送二进制帧(不分片,不掩码),客户端发送的帧只处理ping和close,其他的丢弃.
+//
+// ws://host/app/stream.flv --> 握手(101 Switching Protocols) --> 二进制帧(FLV数据) ...
+
+// 握手的时候和Sec-WebSocket-Key拼接的GUID
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 帧的操作码
+const (
+	WEBSOCKET_OPCODE_CONTINUATION = 0x0
+	WEBSOCKET_OPCODE_TEXT         = 0x1
+	WEBSOCKET_OPCODE_BINARY       = 0x2
+	WEBSOCKET_OPCODE_CLOSE        = 0x8
+	WEBSOCKET_OPCODE_PING         = 0x9
+	WEBSOCKET_OPCODE_PONG         = 0xA
+)
+
+const WEBSOCKET_MAX_FRAME_SIZE = 1 << 20 // 客户端发送的帧的最大长度
+
+var errWebSocketFrameTooLarge = errors.New("websocket frame too large")
+
+type wsConn struct {
+	conn      net.Conn      // hijack之后的连接
+	br        *bufio.Reader // 读客户端的帧
+	lock      sync.Mutex    // guards the following
+	closeSent bool          // 已经发送了close帧,之后不再发送
+	once      sync.Once     // 只关闭一次
+	closed    chan struct{} // 客户端断开或者发送了close帧之后关闭
+}
+
+// 是否是WebSocket握手请求
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Sec-WebSocket-Accept = base64(sha1(Sec-WebSocket-Key + GUID))
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + WEBSOCKET_GUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// 完成WebSocket握手,失败的时候已经回复了HTTP错误
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version or missing key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+
+	if _, err = conn.Write([]byte(res)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn:   conn,
+		br:     brw.Reader,
+		closed: make(chan struct{})}, nil
+}
+
+// 每次写是一个二进制帧
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(WEBSOCKET_OPCODE_BINARY, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// 服务器发送的帧: FIN(1) + RSV(3) + opcode(4) + MASK(1, 0) + payload length(7, 7+16, 7+64) + payload
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closeSent {
+		return io.ErrClosedPipe
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch l := len(p); {
+	case l <= 125:
+		header[1] = byte(l)
+	case l <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+	}
+
+	if opcode == WEBSOCKET_OPCODE_CLOSE {
+		c.closeSent = true
+	}
+
+	if _, err := c.conn.Write(append(header, p...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 客户端发送的帧都是掩码过的: FIN(1) + RSV(3) + opcode(4) + MASK(1) + payload length(7, 7+16, 7+64) + masking key(32) + payload
+func (c *wsConn) readFrame() (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.br, header); err != nil {
+		return
+	}
+
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err = io.ReadFull(c.br, b); err != nil {
+			return
+		}
+
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err = io.ReadFull(c.br, b); err != nil {
+			return
+		}
+
+		length = binary.BigEndian.Uint64(b)
+	}
+
+	if length > WEBSOCKET_MAX_FRAME_SIZE {
+		err = errWebSocketFrameTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return
+}
+
+// 读客户端发送的帧,回复ping,收到close或者连接断开之后关闭closed
+func (c *wsConn) readLoop() {
+	defer c.once.Do(func() { close(c.closed) })
+
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch opcode {
+		case WEBSOCKET_OPCODE_PING:
+			{
+				if err = c.writeFrame(WEBSOCKET_OPCODE_PONG, payload); err != nil {
+					return
+				}
+			}
+		case WEBSOCKET_OPCODE_CLOSE:
+			{
+				// 回复close帧,带着客户端的状态码
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+
+				c.writeFrame(WEBSOCKET_OPCODE_CLOSE, payload)
+				return
+			}
+		}
+	}
+}
+
+// 发送close帧(1000,正常关闭)之后关闭连接
+func (c *wsConn) Close() error {
+	c.writeFrame(WEBSOCKET_OPCODE_CLOSE, []byte{0x03, 0xE8})
+	return c.conn.Close()
+}
@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/onedss/gortmp/config"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 测试用的WebSocket客户端,发送的帧需要掩码
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *wsTestClient) writeFrame(opcode byte, p []byte) error {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(p))}
+	frame = append(frame, mask...)
+	for i, b := range p {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// 服务器发送的帧没有掩码
+func (c *wsTestClient) readFrame() (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.br, header); err != nil {
+		return
+	}
+
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err = io.ReadFull(c.br, b); err != nil {
+			return
+		}
+
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err = io.ReadFull(c.br, b); err != nil {
+			return
+		}
+
+		length = binary.BigEndian.Uint64(b)
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.br, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+// 握手,检查 101 Switching Protocols 和 Sec-WebSocket-Accept
+func dialWebSocketTest(t *testing.T, addr, path string) *wsTestClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err = conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d", res.StatusCode)
+	}
+
+	// RFC 6455 1.3 的例子
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", accept)
+	}
+
+	return &wsTestClient{conn: conn, br: br}
+}
+
+func TestWebSocketFLV(t *testing.T) {
+	// 播放者在发布者写完之后加入的时候,从缓存的GOP开始
+	defer func(n int) { config.GopCacheNum = n }(config.GopCacheNum)
+	config.GopCacheNum = 1
+
+	s := &Server{Addr: freeAddr(t), HTTPAddr: freeAddr(t)}
+	startTestServer(t, s)
+
+	pub, err := DialPublish("rtmp://" + s.Addr + "/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1e, 0xab, 0x40, 0x50, 0x1e, 0xc8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	seq := []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}
+	seq = append(seq, sps...)
+	seq = append(seq, 1, 0, byte(len(pps)))
+	seq = append(seq, pps...)
+	keyframe := []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 5, 0x65, 1, 2, 3, 4}
+
+	pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: 1000, Payload: seq})
+	pub.WritePacket(&AVPacket{Type: RTMP_MSG_VIDEO, Timestamp: 1000, Payload: keyframe})
+
+	c := dialWebSocketTest(t, s.HTTPAddr, "/live/test.flv")
+	defer c.conn.Close()
+
+	// FLV头(9) + PreviousTagSize0(4) + 两个tag(11 + 数据 + PreviousTagSize)
+	want := 9 + 4 + (11 + len(seq) + 4) + (11 + len(keyframe) + 4)
+
+	var flv bytes.Buffer
+	for flv.Len() < want {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opcode != WEBSOCKET_OPCODE_BINARY {
+			t.Fatalf("opcode = %d, want binary", opcode)
+		}
+
+		flv.Write(payload)
+	}
+
+	data := flv.Bytes()
+	if string(data[:3]) != "FLV" || data[3] != 1 || binary.BigEndian.Uint32(data[5:9]) != 9 {
+		t.Fatalf("FLV header = % x", data[:9])
+	}
+
+	if data[4]&0x01 == 0 {
+		t.Errorf("FLV header flags = %#x, want video", data[4])
+	}
+
+	if binary.BigEndian.Uint32(data[9:13]) != 0 {
+		t.Errorf("PreviousTagSize0 = %d", binary.BigEndian.Uint32(data[9:13]))
+	}
+
+	// AVC sequence header, 然后是关键帧, 时间戳从0开始
+	p := data[13:]
+	for i, payload := range [][]byte{seq, keyframe} {
+		size := int(p[1])<<16 | int(p[2])<<8 | int(p[3])
+		timestamp := uint32(p[4])<<16 | uint32(p[5])<<8 | uint32(p[6]) | uint32(p[7])<<24
+
+		if p[0] != RTMP_MSG_VIDEO || size != len(payload) || timestamp != 0 {
+			t.Fatalf("tag %d: type = %d, size = %d, timestamp = %d", i, p[0], size, timestamp)
+		}
+
+		if !bytes.Equal(p[11:11+size], payload) {
+			t.Errorf("tag %d: data = % x, want % x", i, p[11:11+size], payload)
+		}
+
+		if prev := binary.BigEndian.Uint32(p[11+size:]); prev != uint32(11+size) {
+			t.Errorf("tag %d: PreviousTagSize = %d", i, prev)
+		}
+
+		p = p[11+size+4:]
+	}
+
+	// ping -> pong, close -> close
+	if err = c.writeFrame(WEBSOCKET_OPCODE_PING, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.writeFrame(WEBSOCKET_OPCODE_CLOSE, []byte{0x03, 0xE8}); err != nil {
+		t.Fatal(err)
+	}
+
+	var pong bool
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opcode == WEBSOCKET_OPCODE_PONG {
+			pong = string(payload) == "hi"
+		}
+
+		if opcode == WEBSOCKET_OPCODE_CLOSE {
+			if !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+				t.Errorf("close payload = % x", payload)
+			}
+
+			break
+		}
+	}
+
+	if !pong {
+		t.Error("no pong for ping")
+	}
+}
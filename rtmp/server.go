@@ -2,35 +2,119 @@ package rtmp
 
 import (
 	//"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/onedss/gortmp/config"
 	"net"
+	"net/http"
+	"net/url"
 	"runtime"
 	"sync"
 	"time"
 )
 
-var begintime time.Time
+// Serve(ctx)的ctx结束之后,等待连接关闭的最长时间
+const RTMP_SHUTDOWN_TIMEOUT = time.Second * 10
+
+// Shutdown之后,Serve和ListenAndServer返回的错误
+var ErrServerClosed = errors.New("rtmp: Server closed")
 
 var handler ServerHandler = new(DefaultServerHandler)
 
 type Server struct {
-	Addr        string
-	Handler     ServerHandler
-	ReadTimeout time.Duration
-	WriteTimout time.Duration
-	Lock        *sync.Mutex
+	Addr             string
+	Handler          ServerHandler
+	ReadTimeout      time.Duration // 读一个消息的超时时间(发布者或者还没有开始播放的连接),0表示不超时
+	WriteTimout      time.Duration // 写一个块的超时时间,0表示不超时
+	HandshakeTimeout time.Duration // 握手和connect的超时时间,0表示不超时
+	IdleTimeout      time.Duration // 广播收不到音视频包的超时时间,超时之后停止广播,0表示不超时
+	Lock             *sync.Mutex
+	Authenticator    Authenticator      // connect,发布,播放的鉴权,为nil表示不鉴权
+	Streams          *StreamRegistry    // 服务器上所有正在发布的广播
+	TLSAddr          string             // RTMPS监听的IP地址和端口信息,为空表示不开启RTMPS
+	CertFile         string             // RTMPS默认的证书文件
+	KeyFile          string             // RTMPS默认的证书私钥文件
+	SNICerts         map[string]TLSCert // 根据客户端请求的域名(SNI)选择的证书,域名 -> 证书,域名可以是*.example.com
+	TLSConfig        *tls.Config        // 自定义的TLS配置,不为nil的时候忽略上面的证书配置
+	HTTPAddr         string             // HTTP(HTTP-FLV,HLS)监听的IP地址和端口信息,为空表示不开启HTTP
+	HLS              *HLSStore          // HLS文件的存储,HTTP服务从这里读取,为nil的时候只写文件,HTTP不提供HLS
+
+	connLock   sync.Mutex                      // guards the following
+	listeners  []net.Listener                  // 正在监听的listener
+	httpServer *http.Server                    // HTTP服务
+	conns      map[*RtmpNetConnection]struct{} // 正在处理的连接
+	closed     bool                            // 是否已经调用了Shutdown
+	done       chan struct{}                   // Shutdown之后关闭
+	connWait   sync.WaitGroup                  // 每个连接的goroutine
+}
+
+// 根据配置文件创建服务器
+func NewServer(addr string) *Server {
+	s := &Server{
+		Addr:             addr,                                                 // 服务器的IP地址和端口信息
+		Handler:          handler,                                              // 请求处理函数的路由复用器
+		ReadTimeout:      time.Duration(config.ReadTimeout) * time.Second,      // timeout
+		WriteTimout:      time.Duration(config.WriteTimeout) * time.Second,     // timeout
+		HandshakeTimeout: time.Duration(config.HandshakeTimeout) * time.Second, // 握手超时
+		IdleTimeout:      time.Duration(config.IdleTimeout) * time.Second,      // 广播空闲超时
+		Lock:             new(sync.Mutex),                                      // lock
+		Streams:          NewStreamRegistry(),                                  // 流注册表
+		TLSAddr:          config.RTMPSAddr,                                     // RTMPS
+		CertFile:         config.RTMPSCertFile,                                 // RTMPS证书
+		KeyFile:          config.RTMPSKeyFile,                                  // RTMPS证书私钥
+		SNICerts:         make(map[string]TLSCert),                             // RTMPS SNI证书
+		HTTPAddr:         config.HTTPAddr,                                      // HTTP
+		HLS:              NewHLSStore(config.HLSPath, config.HLSMemory)}        // HLS
+
+	if config.HLSEnabled {
+		s.HLS.Grace = time.Duration(config.HLSSegmentGrace) * time.Second
+		s.HLS.PurgeDelay = time.Duration(config.HLSPurgeDelay) * time.Second
+		s.HLS.Encrypt = config.HLSEncrypt
+		s.HLS.KeyRotate = config.HLSKeyRotate
+		s.HLS.KeyURL = config.HLSKeyURL
+		s.HLS.Variants = config.HLSVariants
+		s.HLS.SegmentTypes = config.HLSSegmentTypes
+		s.HLS.DASH = config.DASHEnabled
+		s.HLS.PlaylistTypes = config.HLSPlaylistTypes
+		s.HLS.LowLatency = config.HLSLowLatency
+		s.HLS.PartDuration = time.Duration(config.HLSPartDuration) * time.Millisecond
+	}
+
+	for name, files := range config.RTMPSCerts {
+		s.SNICerts[name] = TLSCert{CertFile: files[0], KeyFile: files[1]}
+	}
+
+	if config.AuthSecret != "" {
+		s.Authenticator = NewHMACAuthenticator(config.AuthSecret, config.AuthPlay)
+	}
+
+	// 配置了任意一个回调地址的时候,使用HTTP回调包装默认的处理器
+	if config.WebhookOnConnect != "" || config.WebhookOnPublish != "" || config.WebhookOnUnpublish != "" ||
+		config.WebhookOnPlay != "" || config.WebhookOnStop != "" || config.WebhookOnRecordDone != "" {
+		w := NewWebhookHandler(s.Handler)
+		w.OnConnectURL = config.WebhookOnConnect
+		w.OnPublishURL = config.WebhookOnPublish
+		w.OnUnpublishURL = config.WebhookOnUnpublish
+		w.OnPlayURL = config.WebhookOnPlay
+		w.OnStopURL = config.WebhookOnStop
+		w.OnRecordDoneURL = config.WebhookOnRecordDone
+		if config.WebhookTimeout > 0 {
+			w.Client.Timeout = time.Duration(config.WebhookTimeout) * time.Second
+		}
+
+		s.Handler = w
+	}
+
+	return s
 }
 
 func ListenAndServe(addr string) error {
-	s := Server{
-		Addr:        addr,                            // 服务器的IP地址和端口信息
-		Handler:     handler,                         // 请求处理函数的路由复用器
-		ReadTimeout: time.Duration(time.Second * 15), // timeout
-		WriteTimout: time.Duration(time.Second * 15), // timeout
-		Lock:        new(sync.Mutex)}                 // lock
-	return s.ListenAndServer()
+	return NewServer(addr).ListenAndServer()
 }
 
+// 开始监听,不会阻塞.需要停止服务器的时候调用Shutdown.
 // golang http.ListenAndServer source code
 func (s *Server) ListenAndServer() error {
 	addr := s.Addr
@@ -38,18 +122,206 @@ func (s *Server) ListenAndServer() error {
 		addr = ":1935"
 	}
 
+	if s.Streams == nil {
+		s.Streams = NewStreamRegistry()
+	}
+
+	// 删除上次运行留下的HLS文件
+	if s.HLS != nil {
+		if err := s.HLS.cleanup(); err != nil {
+			fmt.Println("HLS cleanup error :", err)
+		}
+	}
+
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	// RTMPS和普通的监听同时运行
+	listeners := []net.Listener{l}
+	if s.TLSAddr != "" {
+		tl, err := s.listenTLS()
+		if err != nil {
+			l.Close()
+			return err
+		}
+
+		listeners = append(listeners, tl)
+	}
+
+	// HTTP(HTTP-FLV)和RTMP的监听同时运行
+	var hl net.Listener
+	if s.HTTPAddr != "" {
+		if hl, err = net.Listen("tcp", s.HTTPAddr); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return err
+		}
+	}
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.closed {
+		for _, l := range listeners {
+			l.Close()
+		}
+
+		if hl != nil {
+			hl.Close()
+		}
+
+		return ErrServerClosed
+	}
+
+	s.listeners = append(s.listeners, listeners...)
+
+	if hl != nil {
+		s.listeners = append(s.listeners, hl)
+		s.serveHTTPLocked(hl)
+	}
+
 	for i := 0; i < runtime.NumCPU(); i++ {
-		go s.loop(l)
+		for _, l := range listeners {
+			go s.loop(l)
+		}
 	}
 
 	return nil
 }
 
+// 开始监听并处理连接,一直阻塞到ctx结束或者调用了Shutdown,返回ErrServerClosed.
+// ctx结束的时候会调用Shutdown,最多等待RTMP_SHUTDOWN_TIMEOUT.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.ListenAndServer(); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		{
+			sctx, cancel := context.WithTimeout(context.Background(), RTMP_SHUTDOWN_TIMEOUT)
+			defer cancel()
+
+			if err := s.Shutdown(sctx); err != nil {
+				return err
+			}
+		}
+	case <-s.doneChan():
+	}
+
+	return ErrServerClosed
+}
+
+// 优雅地关闭服务器.
+// 1. 停止监听,不再接受新的连接.
+// 2. 每个广播通知订阅者播放结束(NetStream.Play.Stop),通知发布者取消发布(NetStream.Unpublish.Success),写完HLS文件.
+// 3. 关闭其他的连接(还没有发布或者播放),等待所有连接的goroutine退出.
+// ctx结束的时候强制关闭所有的连接,返回ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.doneLocked())
+	}
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+
+	s.listeners = nil
+	s.connLock.Unlock()
+
+	if s.Streams != nil {
+		var broadcasts []*Broadcast
+		for _, path := range s.Streams.List() {
+			if b, ok := s.Streams.Find(path); ok {
+				broadcasts = append(broadcasts, b)
+				b.shutdown()
+			}
+		}
+
+		for _, b := range broadcasts {
+			select {
+			case <-b.done:
+			case <-ctx.Done():
+				s.closeConns()
+				return ctx.Err()
+			}
+		}
+	}
+
+	s.closeConns()
+
+	wait := make(chan struct{})
+	go func() {
+		s.connWait.Wait()
+		close(wait)
+	}()
+
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) doneChan() chan struct{} {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.doneLocked()
+}
+
+func (s *Server) doneLocked() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+
+	return s.done
+}
+
+// 记录正在处理的连接,服务器已经关闭的时候返回false
+func (s *Server) trackConn(c *RtmpNetConnection, add bool) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*RtmpNetConnection]struct{})
+	}
+
+	if !add {
+		delete(s.conns, c)
+		s.connWait.Done()
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+	s.connWait.Add(1)
+	return true
+}
+
+func (s *Server) closeConns() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
 func (s *Server) loop(listener net.Listener) error {
 	defer listener.Close()
 	var tempDelay time.Duration
@@ -75,13 +347,22 @@ func (s *Server) loop(listener net.Listener) error {
 
 		tempDelay = 0
 		c := newRtmpNetConnect(conn, s)
+		if !s.trackConn(c, true) {
+			c.Close()
+			return ErrServerClosed
+		}
+
 		go s.serve(c)
 	}
 }
 
 func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
+	defer s.trackConn(rtmpNetConn, false)
 
-	begintime = time.Now()
+	// 握手和connect阶段使用同一个截止时间,只打开TCP连接不发送数据的客户端不会一直占用goroutine
+	if s.HandshakeTimeout > 0 {
+		rtmpNetConn.conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 
 	/* Handshake */
 	err := handshake(rtmpNetConn.brw) // 握手
@@ -121,11 +402,18 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 		}
 	}
 
-	// data = decodeAMFObject(connect.Object, "tcUrl") // url
-	// if data != nil {
-	// 	TcUrl := data.(string)
-	// 	fmt.Println("tcurl :", TcUrl)
-	// }
+	data = decodeAMFObject(connect.Object, "tcUrl") // url
+	if data != nil {
+		rtmpNetConn.url, _ = data.(string)
+	}
+
+	// 应用名后面可能带着参数(例如myapp?key=value),没有的时候使用tcUrl后面的参数
+	rtmpNetConn.appName, rtmpNetConn.appQuery = splitQuery(rtmpNetConn.appName)
+	if len(rtmpNetConn.appQuery) == 0 {
+		if u, err := url.Parse(rtmpNetConn.url); err == nil {
+			rtmpNetConn.appQuery = u.Query()
+		}
+	}
 
 	data = decodeAMFObject(connect.Object, "objectEncoding") // AMF编码方法
 	if data != nil {
@@ -137,6 +425,23 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 		}
 	}
 
+	// 鉴权失败,回复 NetConnection.Connect.Rejected
+	if s.Authenticator != nil {
+		if err = s.Authenticator.Connect(rtmpNetConn); err != nil {
+			sendMessage(rtmpNetConn, SEND_CONNECT_RESPONSE_MESSAGE, newConnectRejectedMessageData(err.Error()))
+			rtmpNetConn.Close()
+			return
+		}
+	}
+
+	if h, ok := s.Handler.(ConnectHandler); ok {
+		if err = h.OnConnect(rtmpNetConn); err != nil {
+			sendMessage(rtmpNetConn, SEND_CONNECT_RESPONSE_MESSAGE, newConnectRejectedMessageData(err.Error()))
+			rtmpNetConn.Close()
+			return
+		}
+	}
+
 	err = sendMessage(rtmpNetConn, SEND_ACK_WINDOW_SIZE_MESSAGE, uint32(512<<10)) // 服务器端发送协议消息 '窗口确认大小' 到客户端
 	if err != nil {
 		rtmpNetConn.Close()
@@ -165,6 +470,11 @@ func (s *Server) serve(rtmpNetConn *RtmpNetConnection) {
 
 	rtmpNetConn.connected = true
 
+	// connect完成之后,每次读消息,写块都使用各自的超时时间
+	rtmpNetConn.conn.SetDeadline(time.Time{})
+	rtmpNetConn.readTimeout = s.ReadTimeout
+	rtmpNetConn.writeTimeout = s.WriteTimout
+
 	/* NetStream */
 
 	handler := s.Handler